@@ -1,6 +1,7 @@
 package link
 
 import (
+	"crypto/tls"
 	"io"
 	"net"
 	"strings"
@@ -23,6 +24,78 @@ type Codec interface {
 	Close() error
 }
 
+// PacketCodec is implemented by codecs that can encode a message apart
+// from writing it. Packet appends the encoded message to dst and must be
+// safe for concurrent use. SendPacket frames and writes an encoded message.
+type PacketCodec interface {
+	Packet(dst []byte, msg interface{}) ([]byte, error)
+	SendPacket(packet []byte) error
+}
+
+// ReaderCodec is implemented by length prefixed codecs that can send a
+// message of exactly size bytes streamed from r, without buffering it.
+type ReaderCodec interface {
+	SendReader(r io.Reader, size int) error
+}
+
+// RecvScratchCodec is implemented by length prefixed codecs that read
+// message bodies into a reused buffer, see Session.SetRecvScratch.
+type RecvScratchCodec interface {
+	SetRecvScratch(size int)
+}
+
+// BuffersWriter is implemented by the writer that sessions on a
+// connection give to Protocol.NewCodec. WriteBuffers writes bufs with one
+// vectored write (writev) when the connection supports it, so a codec
+// can write a head and a body without copying them into one buffer.
+type BuffersWriter interface {
+	WriteBuffers(bufs net.Buffers) (int64, error)
+}
+
+// WriteBuffers writes bufs to w in order, with WriteBuffers when w is a
+// BuffersWriter.
+func WriteBuffers(w io.Writer, bufs ...[]byte) error {
+	if bw, ok := w.(BuffersWriter); ok {
+		_, err := bw.WriteBuffers(bufs)
+		return err
+	}
+	for _, b := range bufs {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PingCodec is implemented by codecs that can send heartbeat pings next
+// to the application's messages and answer the peer's. Pongs returns how
+// many pongs were received so far.
+type PingCodec interface {
+	Ping() error
+	Pongs() uint64
+}
+
+// FramingStats is implemented by codecs that count suspicious frames,
+// such as oversized ones or ones that fail to decode. Session.Stats
+// reports the count.
+type FramingStats interface {
+	SuspiciousFrames() uint64
+}
+
+// RoutingCodec is implemented by codecs that can extract a routing key,
+// such as a room id, from a received message.
+type RoutingCodec interface {
+	RoutingKey(msg interface{}) (uint64, error)
+}
+
+// Serializer converts values to and from bytes. It's used by
+// Session.SendValue and Session.ReadValue on top of a codec that sends
+// and receives []byte messages, such as codec.FixLen(codec.Bytes(), ...).
+type Serializer interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
 type ClearSendChan interface {
 	ClearSendChan(<-chan interface{})
 }
@@ -35,16 +108,36 @@ func Listen(network, address string, protocol Protocol, sendChanSize int, handle
 	return NewServer(listener, protocol, sendChanSize, handler), nil
 }
 
+// ListenTLS is like Listen but wraps every accepted connection with
+// tls.Server using config.
+func ListenTLS(network, address string, config *tls.Config, protocol Protocol, sendChanSize int, handler Handler) (*Server, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(tls.NewListener(listener, config), protocol, sendChanSize, handler), nil
+}
+
 func Dial(network, address string, protocol Protocol, sendChanSize int) (*Session, error) {
 	conn, err := net.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
-	codec, err := protocol.NewCodec(conn)
+	return newConnSession(nil, conn, protocol, sendChanSize)
+}
+
+// DialFunc dials a connection, the Dial method of a net.Dialer is one.
+type DialFunc func(network, address string) (net.Conn, error)
+
+// DialWith is like Dial but the connection is dialed by dial, such as the
+// Dial method of a net.Dialer that sets a local address, keepalive or
+// socket options.
+func DialWith(dial DialFunc, network, address string, protocol Protocol, sendChanSize int) (*Session, error) {
+	conn, err := dial(network, address)
 	if err != nil {
 		return nil, err
 	}
-	return NewSession(codec, sendChanSize), nil
+	return newConnSession(nil, conn, protocol, sendChanSize)
 }
 
 func DialTimeout(network, address string, timeout time.Duration, protocol Protocol, sendChanSize int) (*Session, error) {
@@ -52,11 +145,64 @@ func DialTimeout(network, address string, timeout time.Duration, protocol Protoc
 	if err != nil {
 		return nil, err
 	}
-	codec, err := protocol.NewCodec(conn)
+	return newConnSession(nil, conn, protocol, sendChanSize)
+}
+
+// DialTLS is like Dial but does a TLS handshake using config before the
+// session is created.
+func DialTLS(network, address string, config *tls.Config, protocol Protocol, sendChanSize int) (*Session, error) {
+	conn, err := tls.Dial(network, address, config)
 	if err != nil {
 		return nil, err
 	}
-	return NewSession(codec, sendChanSize), nil
+	return newConnSession(nil, conn, protocol, sendChanSize)
+}
+
+// Pipe returns two sessions connected by net.Pipe, for tests that need no
+// real sockets. Closing one session makes the other one fail to receive.
+func Pipe(protocol Protocol, sendChanSize int) (*Session, *Session, error) {
+	c1, c2 := net.Pipe()
+	s1, err := newConnSession(nil, c1, protocol, sendChanSize)
+	if err != nil {
+		c2.Close()
+		return nil, nil, err
+	}
+	s2, err := newConnSession(nil, c2, protocol, sendChanSize)
+	if err != nil {
+		s1.Close()
+		return nil, nil, err
+	}
+	return s1, s2, nil
+}
+
+// DialRetry dials up to attempts times, waiting between attempts as told
+// by backoff, and returns the last error when all of them failed. When
+// validate is not nil it is called on every dialed session, and a session
+// failing it is closed and counts as a failed attempt. It dials at least
+// once.
+func DialRetry(network, address string, protocol Protocol, sendChanSize int, attempts int, backoff Backoff, validate func(*Session) error) (*Session, error) {
+	var err error
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff(attempt - 1))
+		}
+		var session *Session
+		session, err = Dial(network, address, protocol, sendChanSize)
+		if err != nil {
+			continue
+		}
+		if validate != nil {
+			if err = validate(session); err != nil {
+				session.Close()
+				continue
+			}
+		}
+		return session, nil
+	}
+	return nil, err
 }
 
 func Accept(listener net.Listener) (net.Conn, error) {
@@ -0,0 +1,177 @@
+package link
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+func Test_DialRetry(t *testing.T) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	addr := lsn.Addr().String()
+	lsn.Close()
+
+	// Nothing listens until the third attempt.
+	var server *Server
+	backoff := func(attempt int) time.Duration {
+		if attempt == 2 {
+			server, err = Listen("tcp", addr, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+				session.Close()
+			}))
+			utest.IsNilNow(t, err)
+			go server.Serve()
+		}
+		return time.Millisecond
+	}
+
+	_, err = DialRetry("tcp", addr, ProtocolFunc(NewTestCodec), 0, 2, backoff, nil)
+	utest.NotNilNow(t, err)
+	utest.IsNilNow(t, server)
+
+	session, err := DialRetry("tcp", addr, ProtocolFunc(NewTestCodec), 0, 3, backoff, nil)
+	utest.IsNilNow(t, err)
+	session.Close()
+	defer server.Stop()
+
+	// Validation failures are retried too.
+	validateErr := errors.New("validate failed")
+	var validated []*Session
+	validate := func(session *Session) error {
+		validated = append(validated, session)
+		if len(validated) < 3 {
+			return validateErr
+		}
+		return nil
+	}
+	session, err = DialRetry("tcp", addr, ProtocolFunc(NewTestCodec), 0, 3, ConstantBackoff(time.Millisecond), validate)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, session, validated[2])
+	utest.AssertNow(t, validated[0].IsClosed())
+	utest.AssertNow(t, validated[1].IsClosed())
+	session.Close()
+
+	validated = nil
+	_, err = DialRetry("tcp", addr, ProtocolFunc(NewTestCodec), 0, 2, ConstantBackoff(time.Millisecond), validate)
+	utest.EqualNow(t, err, validateErr)
+	utest.EqualNow(t, len(validated), 2)
+
+	session, err = DialRetry("tcp", addr, ProtocolFunc(NewTestCodec), 0, 0, backoff, nil)
+	utest.IsNilNow(t, err)
+	session.Close()
+}
+
+func NewTestTLSConfig(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	utest.IsNilNow(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	utest.IsNilNow(t, err)
+	cert, err := x509.ParseCertificate(der)
+	utest.IsNilNow(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client = &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	return
+}
+
+func Test_TLS(t *testing.T) {
+	serverConfig, clientConfig := NewTestTLSConfig(t)
+	server, err := ListenTLS("tcp", "127.0.0.1:0", serverConfig, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		for {
+			msg, err := session.Receive()
+			if err != nil || session.Send(msg) != nil {
+				return
+			}
+		}
+	}))
+	utest.IsNilNow(t, err)
+	go server.Serve()
+	defer server.Stop()
+
+	session, err := DialTLS("tcp", server.Listener().Addr().String(), clientConfig, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	_, ok := session.Conn().(*tls.Conn)
+	utest.AssertNow(t, ok)
+
+	msg := []byte("encrypted")
+	utest.IsNilNow(t, session.Send(msg))
+	recv, err := session.Receive()
+	utest.IsNilNow(t, err)
+	utest.AssertNow(t, bytes.Equal(msg, recv.([]byte)))
+
+	_, err = DialTLS("tcp", server.Listener().Addr().String(), &tls.Config{ServerName: "localhost"}, ProtocolFunc(NewTestCodec), 0)
+	utest.NotNilNow(t, err)
+}
+
+func Test_Pipe(t *testing.T) {
+	for _, sendChanSize := range []int{0, 10} {
+		s1, s2, err := Pipe(ProtocolFunc(NewTestCodec), sendChanSize)
+		utest.IsNilNow(t, err)
+
+		go s1.Send([]byte("ping"))
+		msg, err := s2.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "ping")
+
+		go s2.Send([]byte("pong"))
+		msg, err = s1.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "pong")
+
+		s1.Close()
+		_, err = s2.Receive()
+		utest.NotNilNow(t, err)
+		WaitClosed(t, s2)
+	}
+}
+
+func Test_DialWith(t *testing.T) {
+	server := EchoServer(t, 0)
+	defer server.Stop()
+	addr := server.Listener().Addr().String()
+
+	var dials []string
+	netDialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		KeepAlive: time.Minute,
+	}
+	dial := func(network, address string) (net.Conn, error) {
+		dials = append(dials, address)
+		return netDialer.Dial(network, address)
+	}
+	session, err := DialWith(dial, "tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, session.Conn().LocalAddr().(*net.TCPAddr).IP.String(), "127.0.0.1")
+	session.Close()
+
+	dialer := NewDialer("tcp", []string{addr}, ProtocolFunc(NewTestCodec), 0)
+	dialer.SetDialFunc(dial)
+	session, err = dialer.Dial()
+	utest.IsNilNow(t, err)
+	session.Close()
+	utest.EqualNow(t, dials, []string{addr, addr})
+}
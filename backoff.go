@@ -0,0 +1,43 @@
+package link
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff returns how long to wait before the given retry attempt,
+// counting from 1.
+type Backoff func(attempt int) time.Duration
+
+func ConstantBackoff(d time.Duration) Backoff {
+	return func(int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff doubles the delay on every attempt, starting from
+// base and never exceeding max.
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// Jitter randomizes the delays of backoff between half and all of their
+// length, so clients that failed together don't retry together.
+func Jitter(backoff Backoff) Backoff {
+	return func(attempt int) time.Duration {
+		d := backoff(attempt)
+		if d <= 1 {
+			return d
+		}
+		return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+}
@@ -0,0 +1,84 @@
+package link
+
+import "context"
+
+// BackpressurePolicy tells an asynchronous session what to do when a
+// message is sent while its send queue lane is full.
+type BackpressurePolicy int
+
+const (
+	// BackpressureClose closes the session with SessionBlockedError, it's
+	// the default.
+	BackpressureClose BackpressurePolicy = iota
+	// BackpressureBlock waits until the lane has room.
+	BackpressureBlock
+	// BackpressureDropNewest drops the message being sent.
+	BackpressureDropNewest
+	// BackpressureDropOldest drops the oldest queued messages of the lane
+	// until the message being sent fits.
+	BackpressureDropOldest
+)
+
+type backpressure struct {
+	policy BackpressurePolicy
+	onDrop func(*Session, interface{})
+}
+
+// SetBackpressure sets the policy of the session's send queue. When it
+// is not nil, onDrop is called with every message a drop policy drops,
+// which Send doesn't report as an error. A packet sent by SendPacket is
+// reported as a []byte, a reader sent by SendReader as its io.Reader and
+// its SendReader call fails with MessageDroppedError.
+func (session *Session) SetBackpressure(policy BackpressurePolicy, onDrop func(session *Session, msg interface{})) {
+	session.backpressure.Store(backpressure{policy, onDrop})
+}
+
+// applyBackpressure handles msg not fitting in lane, the caller holds the
+// read lock of sendMutex.
+func (session *Session) applyBackpressure(ctx context.Context, lane chan interface{}, msg interface{}) error {
+	bp, _ := session.backpressure.Load().(backpressure)
+	switch bp.policy {
+	case BackpressureBlock:
+		select {
+		case lane <- msg:
+			return nil
+		case <-session.closeChan:
+			return SessionClosedError
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	case BackpressureDropNewest:
+		session.dropped(bp, msg, MessageDroppedError)
+		return nil
+	case BackpressureDropOldest:
+		for {
+			select {
+			case old := <-lane:
+				session.dropped(bp, old, MessageDroppedError)
+			default:
+			}
+			select {
+			case lane <- msg:
+				return nil
+			default:
+			}
+		}
+	}
+	return SessionBlockedError
+}
+
+// dropped unqueues msg dropped by the policy of bp, failing its completion
+// with reason. A dropped flushMsg is closed, the messages before it have
+// left the lane already.
+func (session *Session) dropped(bp backpressure, msg interface{}, reason error) {
+	if flush, ok := msg.(flushMsg); ok {
+		close(flush)
+		return
+	}
+	session.freeBytes(messageSize(msg))
+	msg = unqueue(msg, reason)
+	session.debug("message dropped", "reason", reason)
+	if bp.onDrop != nil {
+		bp.onDrop(session, msg)
+	}
+}
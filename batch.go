@@ -0,0 +1,69 @@
+package link
+
+import "sync/atomic"
+
+// maxBatchBuffer is the largest batch buffer kept between batches.
+const maxBatchBuffer = 64 * 1024
+
+// SetWriteBatch makes an asynchronous session on a connection drain up
+// to n queued messages at a time and write them to the connection with a
+// single write, saving system calls when many small messages are queued.
+// A failed write fails every message of the batch and closes the session,
+// without SetWriteRetry nor SetShouldClose being consulted. Messages sent
+// by SendReader are never batched. Zero or one disables batching.
+func (session *Session) SetWriteBatch(n int) {
+	atomic.StoreInt32(&session.writeBatch, int32(n))
+}
+
+func (session *Session) batchSize(msg interface{}) int {
+	if session.conn == nil {
+		return 0
+	}
+	if unbatched(msg) {
+		return 0
+	}
+	return int(atomic.LoadInt32(&session.writeBatch))
+}
+
+// unbatched reports whether msg must not be part of a batch.
+func unbatched(msg interface{}) bool {
+	switch msg.(type) {
+	case *readerMsg, flushMsg:
+		return true
+	}
+	return false
+}
+
+// sendBatch sends msg and up to n-1 more queued messages with one write.
+// It returns the message that ended the batch without being sent, if any.
+func (session *Session) sendBatch(msg interface{}, n int) (interface{}, error) {
+	session.conn.startBatch()
+	var err error
+	for i := 1; ; i++ {
+		if err = session.send(msg); err != nil {
+			break
+		}
+		msg = nil
+		if i == n {
+			break
+		}
+		var ok bool
+		if msg, ok = session.pollMsg(); !ok {
+			msg = nil
+			break
+		}
+		session.dequeued(msg)
+		if unbatched(msg) {
+			break
+		}
+	}
+	if flushErr := session.timeWrite(session.conn.flush); err == nil {
+		err = flushErr
+	}
+	for i, callback := range session.batchCallbacks {
+		callback(err)
+		session.batchCallbacks[i] = nil
+	}
+	session.batchCallbacks = session.batchCallbacks[:0]
+	return msg, err
+}
@@ -0,0 +1,77 @@
+package link
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var broadcastObserver atomic.Value
+
+type broadcastObserverHolder struct {
+	observe func(sessions int, d time.Duration)
+}
+
+// SetBroadcastObserver sets a function called after every Broadcast and
+// Channel broadcast with the number of sessions and the time it took to
+// hand the message to all of them. Nil removes it.
+func SetBroadcastObserver(observe func(sessions int, d time.Duration)) {
+	broadcastObserver.Store(broadcastObserverHolder{observe})
+}
+
+// Broadcast sends msg to every session. When the sessions' codecs
+// implement PacketCodec the message is encoded only once and sent with
+// SendPacket, so all of them must use the same protocol. Failed sends are
+// ignored, the error is the one of the encoding.
+func Broadcast(msg interface{}, sessions ...*Session) error {
+	b := newBroadcaster(msg)
+	defer b.done()
+	for _, session := range sessions {
+		if err := b.send(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcaster sends one message to many sessions, encoding it on first
+// use.
+type broadcaster struct {
+	msg      interface{}
+	packet   []byte
+	sessions int
+	start    time.Time
+	observe  func(int, time.Duration)
+}
+
+func newBroadcaster(msg interface{}) *broadcaster {
+	b := &broadcaster{msg: msg}
+	if holder, ok := broadcastObserver.Load().(broadcastObserverHolder); ok && holder.observe != nil {
+		b.observe = holder.observe
+		b.start = time.Now()
+	}
+	return b
+}
+
+func (b *broadcaster) done() {
+	if b.observe != nil {
+		b.observe(b.sessions, time.Since(b.start))
+	}
+}
+
+func (b *broadcaster) send(session *Session) error {
+	b.sessions++
+	codec, ok := session.codec.(PacketCodec)
+	if !ok {
+		session.Send(b.msg)
+		return nil
+	}
+	if b.packet == nil {
+		packet, err := codec.Packet(nil, b.msg)
+		if err != nil {
+			return err
+		}
+		b.packet = packet
+	}
+	session.SendPacket(b.packet)
+	return nil
+}
@@ -0,0 +1,79 @@
+package link
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+var BudgetExceededError = errors.New("Budget Exceeded")
+
+// sendBudget caps the bytes queued by all the sessions of a manager.
+type sendBudget struct {
+	max      int64
+	bytes    int64
+	shedding int32
+	manager  *Manager
+}
+
+// SetSendBudget caps the bytes queued together by the asynchronous
+// sessions of the manager to max. When they go over it, the sessions with
+// the most bytes queued are closed with BudgetExceededError until the
+// others fit, so the budget may be exceeded for a short while. Zero
+// removes the cap. It must be called before the first session is created.
+func (manager *Manager) SetSendBudget(max int) {
+	manager.budget = nil
+	if max > 0 {
+		manager.budget = &sendBudget{max: int64(max), manager: manager}
+	}
+}
+
+// SendBudgetBytes returns the bytes queued by the sessions of the manager
+// that count against SetSendBudget.
+func (manager *Manager) SendBudgetBytes() int64 {
+	if manager.budget == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&manager.budget.bytes)
+}
+
+// check sheds the sessions queuing the most bytes until the others fit
+// in the budget, unless it's already being done.
+func (b *sendBudget) check() {
+	if atomic.LoadInt64(&b.bytes) <= b.max || !atomic.CompareAndSwapInt32(&b.shedding, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&b.shedding, 0)
+		type offender struct {
+			session *Session
+			bytes   int64
+		}
+		var offenders []offender
+		b.manager.Range(func(session *Session) bool {
+			if bytes := atomic.LoadInt64(&session.queueBytes.bytes); bytes > 0 {
+				offenders = append(offenders, offender{session, bytes})
+			}
+			return true
+		})
+		sort.Slice(offenders, func(i, j int) bool {
+			return offenders[i].bytes > offenders[j].bytes
+		})
+		excess := atomic.LoadInt64(&b.bytes) - b.max
+		for _, o := range offenders {
+			if excess <= 0 {
+				break
+			}
+			o.session.debug("session shed", "bytes", o.bytes)
+			o.session.close(BudgetExceededError)
+			excess -= o.bytes
+		}
+	}()
+}
+
+// SetSendBudget caps the bytes queued together by the sessions accepted
+// by the server, see Manager.SetSendBudget. It must be called before
+// Serve.
+func (server *Server) SetSendBudget(max int) {
+	server.manager.SetSendBudget(max)
+}
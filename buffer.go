@@ -0,0 +1,84 @@
+package link
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	minBufferClass = 6  // 64 bytes
+	maxBufferClass = 16 // 64 KiB
+)
+
+// Buffer is a byte slice handed out by a BufferPool. Data may be replaced
+// by a grown slice, such as one returned by append, before Release gives
+// it back to the pool. It must not be used after.
+type Buffer struct {
+	Data []byte
+	pool *BufferPool
+}
+
+// Release returns the buffer to its pool, it does nothing for buffers
+// too small or too large to be pooled.
+func (b *Buffer) Release() {
+	if b.pool == nil {
+		return
+	}
+	class := -1
+	for c := maxBufferClass - minBufferClass; c >= 0; c-- {
+		if cap(b.Data) >= 1<<uint(c+minBufferClass) {
+			class = c
+			break
+		}
+	}
+	if class < 0 || cap(b.Data) > 1<<maxBufferClass {
+		return
+	}
+	b.Data = b.Data[:0]
+	b.pool.classes[class].Put(b)
+}
+
+// BufferPool hands out reusable buffers so the busy paths of a server
+// don't allocate one per message. Sizes are rounded up to a power of two
+// between 64 bytes and 64 KiB, larger buffers are left to the garbage
+// collector.
+type BufferPool struct {
+	classes [maxBufferClass - minBufferClass + 1]sync.Pool
+}
+
+// DefaultBufferPool is used by sessions to encode the packets written by
+// SetBeforeWrite and SetInterleave sends, so PacketCodec.SendPacket must
+// not keep the packet once it returns.
+var DefaultBufferPool = NewBufferPool()
+
+func NewBufferPool() *BufferPool {
+	return &BufferPool{}
+}
+
+// Get returns an empty buffer whose Data has room for at least size bytes.
+func (p *BufferPool) Get(size int) *Buffer {
+	for c := 0; c <= maxBufferClass-minBufferClass; c++ {
+		if size > 1<<uint(c+minBufferClass) {
+			continue
+		}
+		if b, ok := p.classes[c].Get().(*Buffer); ok {
+			return b
+		}
+		return &Buffer{Data: make([]byte, 0, 1<<uint(c+minBufferClass)), pool: p}
+	}
+	return &Buffer{Data: make([]byte, 0, size), pool: p}
+}
+
+// packet encodes msg into a buffer of DefaultBufferPool, sized after the
+// last packet, the caller releases it once the packet is written.
+func (session *Session) packet(codec PacketCodec, msg interface{}) (*Buffer, error) {
+	buf := DefaultBufferPool.Get(int(atomic.LoadInt32(&session.packetSize)))
+	packet, err := codec.Packet(buf.Data, msg)
+	if err != nil {
+		buf.Release()
+		return nil, err
+	}
+	buf.Data = packet
+	atomic.StoreInt32(&session.packetSize, int32(len(packet)))
+	return buf, nil
+}
@@ -0,0 +1,44 @@
+package link
+
+import (
+	"testing"
+
+	"github.com/funny/utest"
+)
+
+func Test_BufferPool(t *testing.T) {
+	pool := NewBufferPool()
+	for _, size := range []int{0, 64, 65, 1000, 1 << 16} {
+		buf := pool.Get(size)
+		utest.EqualNow(t, len(buf.Data), 0)
+		utest.Assert(t, cap(buf.Data) >= size)
+		buf.Data = append(buf.Data, make([]byte, size)...)
+		buf.Release()
+	}
+
+	large := pool.Get(1<<16 + 1)
+	utest.Assert(t, cap(large.Data) > 1<<16)
+	large.Release()
+
+	buf := pool.Get(10)
+	buf.Data = append(buf.Data, make([]byte, 1000)...)
+	buf.Release()
+	utest.EqualNow(t, len(buf.Data), 0)
+
+	(&Buffer{Data: []byte("not pooled")}).Release()
+}
+
+func Test_PooledPacket(t *testing.T) {
+	session, peer, err := Pipe(ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	defer peer.Close()
+	session.SetInterleave(true)
+
+	for _, msg := range []string{"short", string(make([]byte, 300)), "again"} {
+		go session.Send([]byte(msg))
+		recv, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(recv.([]byte)), msg)
+	}
+}
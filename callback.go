@@ -0,0 +1,32 @@
+package link
+
+type callbackMsg struct {
+	msg      interface{}
+	callback func(error)
+}
+
+// SendCallback is like Send but calls callback once msg was written to
+// the connection, with nil, or with the error that prevented it, such as
+// SessionClosedError when the session was closed with msg still queued.
+// On an asynchronous session the callback runs on the send goroutine, so
+// it must not block. It's not called when SendCallback returns an error.
+func (session *Session) SendCallback(msg interface{}, callback func(error)) error {
+	if session.sendChan == nil {
+		if err := session.Send(msg); err != nil {
+			return err
+		}
+		callback(nil)
+		return nil
+	}
+	if err := session.checkClosing(); err != nil {
+		return err
+	}
+	msg, dropped, err := session.interceptSend(msg)
+	if dropped || err != nil {
+		if err == nil {
+			callback(MessageDroppedError)
+		}
+		return err
+	}
+	return session.sendAsync(session.sendChan, &callbackMsg{msg, callback})
+}
@@ -0,0 +1,108 @@
+package link
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var CaptureUnsupportedError = errors.New("Capture Unsupported")
+
+// CaptureFormat tells SetCapture how to record the traffic of a session.
+type CaptureFormat int
+
+const (
+	// CaptureHexDump writes a line with the time, session id, direction
+	// and size of every read or write followed by a hex dump of its bytes.
+	CaptureHexDump CaptureFormat = iota
+	// CaptureBinary writes records for ReadCapture: the direction byte,
+	// the time as big endian unix nanoseconds, the big endian uint32 size
+	// and the bytes.
+	CaptureBinary
+)
+
+const captureHeadSize = 13
+
+// CaptureRecord is the bytes of one read from or write to the connection
+// of a session.
+type CaptureRecord struct {
+	Sent bool
+	Time time.Time
+	Data []byte
+}
+
+type capture struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	format CaptureFormat
+	id     uint64
+	clock  Clock
+}
+
+// SetCapture records every read from and write to the connection of the
+// session into w, so the bytes on the wire can be examined without
+// external tools. A write is usually a whole frame, but a read may hold
+// part of one or several frames depending on the codec. A nil w stops
+// recording. Errors writing to w are ignored. Sessions created by
+// NewSession have no connection and return CaptureUnsupportedError.
+func (session *Session) SetCapture(w io.Writer, format CaptureFormat) error {
+	if session.conn == nil {
+		return CaptureUnsupportedError
+	}
+	if w == nil {
+		session.conn.capture.Store((*capture)(nil))
+		return nil
+	}
+	session.conn.capture.Store(&capture{
+		w:      w,
+		format: format,
+		id:     session.id,
+		clock:  session.getClock(),
+	})
+	return nil
+}
+
+func (c *capture) record(sent bool, b []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.clock.Now()
+	switch c.format {
+	case CaptureBinary:
+		var head [captureHeadSize]byte
+		if sent {
+			head[0] = 1
+		}
+		binary.BigEndian.PutUint64(head[1:], uint64(now.UnixNano()))
+		binary.BigEndian.PutUint32(head[9:], uint32(len(b)))
+		c.w.Write(head[:])
+		c.w.Write(b)
+	default:
+		direction := "recv"
+		if sent {
+			direction = "send"
+		}
+		fmt.Fprintf(c.w, "%s session %d %s %d bytes\n%s", now.Format(time.RFC3339Nano), c.id, direction, len(b), hex.Dump(b))
+	}
+}
+
+// ReadCapture reads the next record written by SetCapture with
+// CaptureBinary. It returns io.EOF once r is exhausted.
+func ReadCapture(r io.Reader) (*CaptureRecord, error) {
+	var head [captureHeadSize]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	record := &CaptureRecord{
+		Sent: head[0] == 1,
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(head[1:]))),
+		Data: make([]byte, binary.BigEndian.Uint32(head[9:])),
+	}
+	if _, err := io.ReadFull(r, record.Data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return record, nil
+}
@@ -68,6 +68,24 @@ func (channel *Channel) Remove(key KEY) bool {
 	return exists
 }
 
+// Join puts session in the channel keyed by its id.
+func (channel *Channel) Join(session *Session) {
+	channel.Put(session.ID(), session)
+}
+
+// Leave removes session from a channel it joined, and reports whether it
+// was in the channel.
+func (channel *Channel) Leave(session *Session) bool {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	key := KEY(session.ID())
+	if channel.sessions[key] != session {
+		return false
+	}
+	channel.remove(key, session)
+	return true
+}
+
 func (channel *Channel) FetchAndRemove(callback func(*Session)) {
 	channel.mutex.Lock()
 	defer channel.mutex.Unlock()
@@ -85,3 +103,28 @@ func (channel *Channel) Close() {
 		channel.remove(key, session)
 	}
 }
+
+// Broadcast sends msg to every session in the channel, see BroadcastFilter.
+func (channel *Channel) Broadcast(msg interface{}) error {
+	return channel.BroadcastFilter(msg, nil)
+}
+
+// BroadcastFilter sends msg to every session accepted by filter. When the
+// sessions' codecs implement PacketCodec the message is encoded only once,
+// so all sessions in the channel must use the same protocol.
+func (channel *Channel) BroadcastFilter(msg interface{}, filter func(*Session) bool) error {
+	channel.mutex.RLock()
+	defer channel.mutex.RUnlock()
+
+	b := newBroadcaster(msg)
+	defer b.done()
+	for _, session := range channel.sessions {
+		if filter != nil && !filter(session) {
+			continue
+		}
+		if err := b.send(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
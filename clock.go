@@ -0,0 +1,43 @@
+package link
+
+import "time"
+
+// Clock is the source of time used by the time based session features,
+// so they can be tested without real sleeps.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// DefaultClock is used by new sessions. Replace it before creating any
+// session, it's not safe to change it concurrently.
+var DefaultClock Clock = realClock{}
+
+// clockHolder keeps ConnectedAt along with the clock it was read from.
+type clockHolder struct {
+	Clock
+	connectedAt time.Time
+}
+
+// SetClock replaces the clock used by the session. ConnectedAt is moved
+// to the time base of clock, keeping the age of the session.
+func (session *Session) SetClock(clock Clock) {
+	old := session.clock.Load().(clockHolder)
+	age := old.Now().Sub(old.connectedAt)
+	session.clock.Store(clockHolder{clock, clock.Now().Add(-age)})
+	session.wakeTimers()
+}
+
+func (session *Session) getClock() Clock {
+	return session.clock.Load().(clockHolder).Clock
+}
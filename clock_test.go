@@ -0,0 +1,282 @@
+package link
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := fakeTimer{c.now.Add(d), make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer.c
+	}
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+// WaitTimers blocks until at least n timers are pending.
+func (c *FakeClock) WaitTimers(n int) {
+	for {
+		c.mutex.Lock()
+		pending := len(c.timers)
+		c.mutex.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			timers = append(timers, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = timers
+}
+
+func WaitClosed(t *testing.T, session *Session) {
+	select {
+	case <-session.closeChan:
+	case <-time.After(time.Second):
+		t.Fatal("session not closed")
+	}
+}
+
+func Test_FakeClockConnectedAt(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := NewSession(&TestCodec{c1}, 0)
+	defer session.Close()
+	base := time.Unix(1000, 0)
+	session.SetClock(NewFakeClock(base))
+
+	age := base.Sub(session.ConnectedAt())
+	utest.Assert(t, age >= 0 && age < time.Second, age)
+}
+
+func Test_FakeClockMaxLifetime(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := NewSession(&TestCodec{c1}, 0)
+	clock := NewFakeClock(session.ConnectedAt())
+	session.SetClock(clock)
+
+	session.SetMaxLifetime(time.Minute)
+	clock.WaitTimers(1)
+	clock.Advance(59 * time.Second)
+	utest.Assert(t, !session.IsClosed())
+
+	clock.Advance(time.Second)
+	WaitClosed(t, session)
+	utest.EqualNow(t, session.CloseReason(), MaxLifetimeExceededError)
+}
+
+func Test_FakeClockMaxLifetimeDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := NewSession(&TestCodec{c1}, 0)
+	base := time.Unix(1000, 0)
+	clock := NewFakeClock(base)
+	session.SetClock(clock)
+
+	session.SetMaxLifetime(time.Minute)
+	deadline := session.ConnectedAt().Add(time.Minute)
+	utest.Assert(t, deadline.Sub(base) <= time.Minute && deadline.Sub(base) > 59*time.Second, deadline)
+	clock.WaitTimers(1)
+	clock.Advance(deadline.Sub(clock.Now()) - time.Nanosecond)
+	clock.WaitTimers(1)
+	utest.Assert(t, !session.IsClosed())
+
+	clock.Advance(time.Nanosecond)
+	WaitClosed(t, session)
+	utest.EqualNow(t, session.CloseReason(), MaxLifetimeExceededError)
+}
+
+type pingCodec struct {
+	*TestCodec
+	pings uint64
+	pongs uint64
+}
+
+func (c *pingCodec) Ping() error {
+	atomic.AddUint64(&c.pings, 1)
+	return nil
+}
+
+func (c *pingCodec) Pongs() uint64 {
+	return atomic.LoadUint64(&c.pongs)
+}
+
+func Test_FakeClockHeartbeat(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	codec := &pingCodec{TestCodec: &TestCodec{c1}}
+	session := NewSession(codec, 0)
+	clock := NewFakeClock(session.ConnectedAt())
+	session.SetClock(clock)
+
+	utest.EqualNow(t, NewSession(&TestCodec{c1}, 0).SetHeartbeat(time.Second, time.Second), HeartbeatUnsupportedError)
+	utest.IsNilNow(t, session.SetHeartbeat(10*time.Second, 5*time.Second))
+	clock.WaitTimers(1)
+	clock.Advance(10 * time.Second)
+	clock.WaitTimers(1)
+	utest.EqualNow(t, atomic.LoadUint64(&codec.pings), uint64(1))
+
+	atomic.AddUint64(&codec.pongs, 1)
+	clock.Advance(5 * time.Second)
+	clock.WaitTimers(1)
+	utest.Assert(t, !session.IsClosed())
+
+	clock.Advance(5 * time.Second)
+	clock.WaitTimers(1)
+	utest.EqualNow(t, atomic.LoadUint64(&codec.pings), uint64(2))
+
+	clock.Advance(5 * time.Second)
+	WaitClosed(t, session)
+	utest.EqualNow(t, session.CloseReason(), HeartbeatTimeoutError)
+}
+
+func Test_FakeClockIdleTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := NewSession(&TestCodec{c1}, 0)
+	peer := NewSession(&TestCodec{c2}, 0)
+	clock := NewFakeClock(session.ConnectedAt())
+	session.SetClock(clock)
+
+	session.SetIdleTimeout(time.Minute)
+	clock.WaitTimers(1)
+	clock.Advance(30 * time.Second)
+
+	go peer.Receive()
+	utest.IsNilNow(t, session.Send([]byte("ping")))
+	clock.Advance(30 * time.Second)
+	clock.WaitTimers(1)
+	utest.Assert(t, !session.IsClosed())
+
+	clock.Advance(30 * time.Second)
+	WaitClosed(t, session)
+	utest.EqualNow(t, session.CloseReason(), IdleTimeoutError)
+}
+
+func Test_FakeClockSlowConsumer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := NewSession(&TestCodec{c1}, 10)
+	defer session.Close()
+	clock := NewFakeClock(session.ConnectedAt())
+	session.SetClock(clock)
+
+	slow := make(chan *Session, 10)
+	session.SetSlowConsumer(2, time.Minute, SlowConsumerReport, func(session *Session) {
+		slow <- session
+	})
+	clock.WaitTimers(1)
+	for i := 0; i < 4; i++ {
+		utest.IsNilNow(t, session.Send([]byte("hello")))
+	}
+	clock.Advance(30 * time.Second)
+	utest.EqualNow(t, session.Stats().BackloggedFor, 30*time.Second)
+
+	clock.Advance(30 * time.Second)
+	select {
+	case s := <-slow:
+		utest.Assert(t, s == session)
+	case <-time.After(time.Second):
+		t.Fatal("slow consumer not reported")
+	}
+	clock.WaitTimers(1)
+	clock.Advance(time.Minute)
+	clock.WaitTimers(1)
+	utest.EqualNow(t, len(slow), 0)
+	utest.Assert(t, !session.IsClosed())
+
+	session.SetSlowConsumer(2, time.Minute, SlowConsumerClose, nil)
+	utest.IsNilNow(t, session.Send([]byte("hello")))
+	clock.WaitTimers(1)
+	clock.Advance(time.Minute)
+	WaitClosed(t, session)
+	utest.EqualNow(t, session.CloseReason(), SlowConsumerError)
+}
+
+func Test_FakeClockSlowWrite(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := NewSession(&TestCodec{c1}, 0)
+	clock := NewFakeClock(session.ConnectedAt())
+	session.SetClock(clock)
+
+	session.SetSlowConsumer(-1, time.Minute, SlowConsumerClose, nil)
+	clock.WaitTimers(1)
+	go session.Send([]byte("hello"))
+	for session.Stats().WriteBlockedFor == 0 {
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Minute)
+	WaitClosed(t, session)
+	utest.EqualNow(t, session.CloseReason(), SlowConsumerError)
+}
+
+func Test_FakeClockSendRate(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+	session, err := NewConnSession(c1, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	clock := NewFakeClock(session.ConnectedAt())
+	session.SetClock(clock)
+
+	utest.IsNilNow(t, session.SetSendRate(100, 100))
+	sent := make(chan error, 1)
+	go func() {
+		sent <- session.Send(make([]byte, 100))
+	}()
+	clock.WaitTimers(1)
+	select {
+	case <-sent:
+		t.Fatal("rate limit not applied")
+	default:
+	}
+	clock.Advance(time.Second)
+	utest.IsNilNow(t, <-sent)
+}
@@ -0,0 +1,208 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/funny/link"
+)
+
+var ErrNoKey = errors.New("No Key")
+var ErrNotSealed = errors.New("Not Sealed")
+
+// KeySetter is implemented by codecs that encrypt with keys supplied by
+// the application.
+type KeySetter interface {
+	// SetKeys switches to encrypting sent messages with sendKey and
+	// decrypting received ones with recvKey. Each key is 16, 24 or 32
+	// bytes and its nonce counter restarts from zero. The two sides
+	// must use each other's keys in reverse.
+	SetKeys(sendKey, recvKey []byte) error
+}
+
+const (
+	aesgcmPlain = iota
+	aesgcmSealed
+)
+
+// AESGCM frames everything base writes during a Send with a 4 bytes big
+// endian length and a flag byte, and encrypts it with AES-GCM once the
+// codec was given keys through KeySetter. Until then frames are sent in
+// plain text, so the application can run its own handshake on the same
+// session, and plain frames received after it fail with ErrNotSealed.
+// Nonces are counters that are never sent. Frames larger than
+// maxSize fail with ErrTooLargePacket. Base should not read ahead of the
+// message it decodes, or it may consume a sealed frame before the keys
+// are set.
+func AESGCM(base link.Protocol, maxSize int) link.Protocol {
+	return &aesgcmProtocol{base, maxSize}
+}
+
+type aesgcmProtocol struct {
+	base    link.Protocol
+	maxSize int
+}
+
+func (p *aesgcmProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &aesgcmCodec{
+		rw:             rw,
+		aesgcmProtocol: p,
+	}
+	codec.stream.codec = codec
+	codec.base, err = p.base.NewCodec(&codec.stream)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+type aesgcmState struct {
+	aead    cipher.AEAD
+	counter uint64
+	nonce   []byte
+}
+
+func newAESGCMState(key []byte) (*aesgcmState, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesgcmState{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (s *aesgcmState) nextNonce() []byte {
+	binary.BigEndian.PutUint64(s.nonce[len(s.nonce)-8:], s.counter)
+	s.counter++
+	return s.nonce
+}
+
+type aesgcmStream struct {
+	codec   *aesgcmCodec
+	plain   []byte
+	sendBuf bytes.Buffer
+}
+
+func (s *aesgcmStream) Read(p []byte) (int, error) {
+	if len(s.plain) == 0 {
+		if err := s.codec.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *aesgcmStream) Write(p []byte) (int, error) {
+	return s.sendBuf.Write(p)
+}
+
+type aesgcmCodec struct {
+	base      link.Codec
+	rw        io.ReadWriter
+	stream    aesgcmStream
+	head      [5]byte
+	recvFrame []byte
+	sendFrame []byte
+	sendState atomic.Value
+	recvState atomic.Value
+	*aesgcmProtocol
+}
+
+func (c *aesgcmCodec) SetKeys(sendKey, recvKey []byte) error {
+	send, err := newAESGCMState(sendKey)
+	if err != nil {
+		return err
+	}
+	recv, err := newAESGCMState(recvKey)
+	if err != nil {
+		return err
+	}
+	c.sendState.Store(send)
+	c.recvState.Store(recv)
+	return nil
+}
+
+func (c *aesgcmCodec) readFrame() error {
+	if _, err := io.ReadFull(c.rw, c.head[:]); err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint32(c.head[:4]))
+	if size > c.maxSize {
+		return ErrTooLargePacket
+	}
+	if cap(c.recvFrame) < size {
+		c.recvFrame = make([]byte, size)
+	}
+	frame := c.recvFrame[:size]
+	if _, err := io.ReadFull(c.rw, frame); err != nil {
+		return err
+	}
+	switch c.head[4] {
+	case aesgcmPlain:
+		if c.recvState.Load() != nil {
+			return ErrNotSealed
+		}
+		c.stream.plain = frame
+	case aesgcmSealed:
+		state, _ := c.recvState.Load().(*aesgcmState)
+		if state == nil {
+			return ErrNoKey
+		}
+		plain, err := state.aead.Open(frame[:0], state.nextNonce(), frame, c.head[4:])
+		if err != nil {
+			return err
+		}
+		c.stream.plain = plain
+	default:
+		return ErrBadHead
+	}
+	return nil
+}
+
+func (c *aesgcmCodec) Receive() (interface{}, error) {
+	return c.base.Receive()
+}
+
+func (c *aesgcmCodec) Send(msg interface{}) error {
+	c.stream.sendBuf.Reset()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	state, _ := c.sendState.Load().(*aesgcmState)
+	size := c.stream.sendBuf.Len()
+	if state != nil {
+		size += state.aead.Overhead()
+	}
+	if size > c.maxSize {
+		return ErrTooLargePacket
+	}
+	frame := append(c.sendFrame[:0], 0, 0, 0, 0, aesgcmPlain)
+	if state != nil {
+		frame[4] = aesgcmSealed
+		frame = state.aead.Seal(frame, state.nextNonce(), c.stream.sendBuf.Bytes(), frame[4:5])
+	} else {
+		frame = append(frame, c.stream.sendBuf.Bytes()...)
+	}
+	c.sendFrame = frame
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-5))
+	_, err := c.rw.Write(frame)
+	return err
+}
+
+func (c *aesgcmCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
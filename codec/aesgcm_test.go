@@ -0,0 +1,108 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/funny/link"
+)
+
+func Test_AESGCM(t *testing.T) {
+	type pipe struct {
+		io.Reader
+		io.Writer
+	}
+	var b12, b21 bytes.Buffer
+	protocol := AESGCM(FixLen(Bytes(), 2, binary.LittleEndian, 1024, 1024), 1024)
+	c1, _ := protocol.NewCodec(pipe{&b21, &b12})
+	c2, _ := protocol.NewCodec(pipe{&b12, &b21})
+
+	exchange := func(from, to link.Codec, stream *bytes.Buffer, msg []byte) []byte {
+		if err := from.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		wire := append([]byte(nil), stream.Bytes()...)
+		recv, err := to.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, recv.([]byte)) {
+			t.Fatal("message not match")
+		}
+		return wire
+	}
+
+	msg := []byte("hello link")
+	if wire := exchange(c1, c2, &b12, msg); !bytes.Contains(wire, msg) {
+		t.Fatal("handshake message not in plain text")
+	}
+
+	k1, k2 := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 32)
+	if err := c1.(KeySetter).SetKeys(k1, k2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.(KeySetter).SetKeys(k2, k1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if wire := exchange(c1, c2, &b12, msg); bytes.Contains(wire, msg) {
+			t.Fatal("message not encrypted")
+		}
+		exchange(c2, c1, &b21, msg)
+	}
+
+	// Same message, different nonce.
+	c1.Send(msg)
+	first := append([]byte(nil), b12.Bytes()...)
+	c2.Receive()
+	c1.Send(msg)
+	if bytes.Equal(first, b12.Bytes()) {
+		t.Fatal("nonce reused")
+	}
+	b12.Bytes()[b12.Len()-1] ^= 1
+	if _, err := c2.Receive(); err == nil {
+		t.Fatal("tampered message accepted")
+	}
+
+	c3, _ := protocol.NewCodec(pipe{&b12, &b21})
+	c1.Send(msg)
+	if _, err := c3.Receive(); err != ErrNoKey {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c3.(KeySetter).SetKeys(k1, []byte("short")); err == nil {
+		t.Fatal("bad key accepted")
+	}
+}
+
+func Test_AESGCMPlainInjected(t *testing.T) {
+	type pipe struct {
+		io.Reader
+		io.Writer
+	}
+	var b12, b21 bytes.Buffer
+	protocol := AESGCM(FixLen(Bytes(), 2, binary.LittleEndian, 1024, 1024), 64)
+	c1, _ := protocol.NewCodec(pipe{&b21, &b12})
+	c2, _ := protocol.NewCodec(pipe{&b12, &b21})
+	k1, k2 := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+	c1.(KeySetter).SetKeys(k1, k2)
+	c2.(KeySetter).SetKeys(k2, k1)
+
+	// Too large messages must not use up a nonce.
+	if err := c1.Send(make([]byte, 60)); err != ErrTooLargePacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b12.Reset()
+	if err := c1.Send([]byte("sealed")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := c2.Receive(); err != nil || string(msg.([]byte)) != "sealed" {
+		t.Fatal(msg, err)
+	}
+
+	b12.Write([]byte{0, 0, 0, 7, aesgcmPlain, 5, 0, 'h', 'e', 'l', 'l', 'o'})
+	if _, err := c2.Receive(); err != ErrNotSealed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -2,11 +2,20 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+	"sync"
 
 	"github.com/funny/link"
 )
 
+// BufferResizer is implemented by codecs whose buffers can be resized
+// while the session is in use.
+type BufferResizer interface {
+	SetReadBufferSize(n int)
+	SetWriteBufferSize(n int) error
+}
+
 func Bufio(base link.Protocol, readBuf, writeBuf int) link.Protocol {
 	return &bufioProtocol{
 		base:     base,
@@ -23,26 +32,23 @@ type bufioProtocol struct {
 
 func (b *bufioProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
 	codec := new(bufioCodec)
-
-	if b.writeBuf > 0 {
-		codec.stream.w = bufio.NewWriterSize(rw, b.writeBuf)
-		codec.stream.Writer = codec.stream.w
-	} else {
-		codec.stream.Writer = rw
-	}
-
-	if b.readBuf > 0 {
-		codec.stream.Reader = bufio.NewReaderSize(rw, b.readBuf)
-	} else {
-		codec.stream.Reader = rw
-	}
-
+	codec.stream.rw = rw
+	codec.stream.src = rw
+	codec.stream.setWriteBuf(b.writeBuf)
+	codec.stream.setReadBuf(b.readBuf)
 	codec.stream.c, _ = rw.(io.Closer)
 
 	codec.base, err = b.base.NewCodec(&codec.stream)
 	if err != nil {
 		return
 	}
+	if base, ok := codec.base.(link.PacketCodec); ok {
+		cc = &bufioPacketCodec{codec, base}
+		if base, ok := codec.base.(link.ReaderCodec); ok {
+			cc = &bufioReaderCodec{cc.(*bufioPacketCodec), base}
+		}
+		return
+	}
 	cc = codec
 	return
 }
@@ -50,8 +56,11 @@ func (b *bufioProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
 type bufioStream struct {
 	io.Reader
 	io.Writer
-	c io.Closer
-	w *bufio.Writer
+	rw  io.ReadWriter
+	src io.Reader
+	c   io.Closer
+	r   *bufio.Reader
+	w   *bufio.Writer
 }
 
 func (s *bufioStream) Flush() error {
@@ -61,6 +70,36 @@ func (s *bufioStream) Flush() error {
 	return nil
 }
 
+// setReadBuf replaces the read buffer. Bytes already buffered are read
+// again before anything else from the connection.
+func (s *bufioStream) setReadBuf(n int) {
+	if s.r != nil && s.r.Buffered() > 0 {
+		buffered, _ := s.r.Peek(s.r.Buffered())
+		s.src = io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), s.src)
+	}
+	if n > 0 {
+		s.r = bufio.NewReaderSize(s.src, n)
+		s.Reader = s.r
+	} else {
+		s.r = nil
+		s.Reader = s.src
+	}
+}
+
+func (s *bufioStream) setWriteBuf(n int) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if n > 0 {
+		s.w = bufio.NewWriterSize(s.rw, n)
+		s.Writer = s.w
+	} else {
+		s.w = nil
+		s.Writer = s.rw
+	}
+	return nil
+}
+
 func (s *bufioStream) close() error {
 	if s.c != nil {
 		return s.c.Close()
@@ -69,11 +108,15 @@ func (s *bufioStream) close() error {
 }
 
 type bufioCodec struct {
-	base   link.Codec
-	stream bufioStream
+	base       link.Codec
+	stream     bufioStream
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
 }
 
 func (c *bufioCodec) Send(msg interface{}) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 	if err := c.base.Send(msg); err != nil {
 		return err
 	}
@@ -81,9 +124,34 @@ func (c *bufioCodec) Send(msg interface{}) error {
 }
 
 func (c *bufioCodec) Receive() (interface{}, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
 	return c.base.Receive()
 }
 
+// SetReadBufferSize waits for a running Receive to return. Nothing that
+// was buffered already is lost.
+func (c *bufioCodec) SetReadBufferSize(n int) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	c.stream.setReadBuf(n)
+}
+
+// SetWriteBufferSize flushes the current write buffer first. When that
+// fails the old buffer is kept.
+func (c *bufioCodec) SetWriteBufferSize(n int) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.stream.setWriteBuf(n)
+}
+
+func (c *bufioCodec) SuspiciousFrames() uint64 {
+	if stats, ok := c.base.(FramingStats); ok {
+		return stats.SuspiciousFrames()
+	}
+	return 0
+}
+
 func (c *bufioCodec) Close() error {
 	err1 := c.base.Close()
 	err2 := c.stream.close()
@@ -92,3 +160,35 @@ func (c *bufioCodec) Close() error {
 	}
 	return err2
 }
+
+type bufioPacketCodec struct {
+	*bufioCodec
+	base link.PacketCodec
+}
+
+func (c *bufioPacketCodec) Packet(dst []byte, msg interface{}) ([]byte, error) {
+	return c.base.Packet(dst, msg)
+}
+
+func (c *bufioPacketCodec) SendPacket(packet []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := c.base.SendPacket(packet); err != nil {
+		return err
+	}
+	return c.stream.Flush()
+}
+
+type bufioReaderCodec struct {
+	*bufioPacketCodec
+	base link.ReaderCodec
+}
+
+func (c *bufioReaderCodec) SendReader(r io.Reader, size int) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := c.base.SendReader(r, size); err != nil {
+		return err
+	}
+	return c.stream.Flush()
+}
@@ -1,6 +1,7 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
 	"testing"
 )
@@ -8,3 +9,32 @@ import (
 func Test_Bufio(t *testing.T) {
 	JsonTest(t, Bufio(FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 64*1024, 64*1024), 1024, 1024))
 }
+
+func Test_Bufio_Resize(t *testing.T) {
+	var stream bytes.Buffer
+	protocol := Bufio(FixLen(Bytes(), 2, binary.LittleEndian, 1024, 1024), 64, 64)
+	codec, _ := protocol.NewCodec(&stream)
+	resizer := codec.(BufferResizer)
+
+	msgs := make([][]byte, 20)
+	for i := range msgs {
+		msgs[i] = bytes.Repeat([]byte{byte(i)}, 10+i)
+		if err := codec.Send(msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := resizer.SetWriteBufferSize(16 * (i % 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, msg := range msgs {
+		recv, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, recv.([]byte)) {
+			t.Fatalf("message %d not match: %v", i, recv)
+		}
+		resizer.SetReadBufferSize([]int{16, 0, 4096, 32}[i%4])
+	}
+}
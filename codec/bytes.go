@@ -0,0 +1,47 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/funny/link"
+)
+
+var ErrNotBytes = errors.New("Not Bytes")
+
+// Bytes sends []byte messages as they are and receives everything that
+// can be read as one message. It's meant to be wrapped by a framing
+// protocol such as FixLen.
+func Bytes() link.Protocol {
+	return link.ProtocolFunc(func(rw io.ReadWriter) (link.Codec, error) {
+		codec := &bytesCodec{rw: rw}
+		codec.closer, _ = rw.(io.Closer)
+		return codec, nil
+	})
+}
+
+type bytesCodec struct {
+	rw     io.ReadWriter
+	closer io.Closer
+}
+
+func (c *bytesCodec) Receive() (interface{}, error) {
+	return ioutil.ReadAll(c.rw)
+}
+
+func (c *bytesCodec) Send(msg interface{}) error {
+	b, ok := msg.([]byte)
+	if !ok {
+		return ErrNotBytes
+	}
+	_, err := c.rw.Write(b)
+	return err
+}
+
+func (c *bytesCodec) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
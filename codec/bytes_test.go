@@ -0,0 +1,55 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/funny/link"
+)
+
+func Test_Bytes(t *testing.T) {
+	var stream bytes.Buffer
+	protocol := FixLen(Bytes(), 2, binary.LittleEndian, 1024, 1024)
+	codec, _ := protocol.NewCodec(&stream)
+
+	for _, msg := range [][]byte{[]byte("abc"), []byte{}, bytes.Repeat([]byte("x"), 1000)} {
+		if err := codec.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		recv, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, recv.([]byte)) {
+			t.Fatalf("message not match: %v, %v", msg, recv)
+		}
+	}
+
+	if err := codec.Send("abc"); err != ErrNotBytes {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func Test_Bytes_SendReader(t *testing.T) {
+	var stream bytes.Buffer
+	protocol := Bufio(FixLen(Bytes(), 4, binary.LittleEndian, 1<<21, 1<<21), 4096, 4096)
+	codec, _ := protocol.NewCodec(&stream)
+
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	if err := codec.(link.ReaderCodec).SendReader(bytes.NewReader(msg), len(msg)); err != nil {
+		t.Fatal(err)
+	}
+	recv, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, recv.([]byte)) {
+		t.Fatal("message not match")
+	}
+
+	if err := codec.(link.ReaderCodec).SendReader(bytes.NewReader(msg[:10]), 20); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"github.com/funny/link"
+)
+
+// ChecksumError is returned when a received message is corrupted.
+type ChecksumError struct {
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Checksum Mismatch: expected %08x, actual %08x", e.Expected, e.Actual)
+}
+
+// Checksum appends a 4 bytes big endian CRC32 of every message encoded by
+// base, using table, or the Castagnoli table when it's nil. It reads a
+// whole message from the connection, so it's meant to be wrapped by a
+// framing protocol such as FixLen.
+func Checksum(base link.Protocol, table *crc32.Table) link.Protocol {
+	if table == nil {
+		table = crc32.MakeTable(crc32.Castagnoli)
+	}
+	return &checksumProtocol{base, table}
+}
+
+type checksumProtocol struct {
+	base  link.Protocol
+	table *crc32.Table
+}
+
+func (p *checksumProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &checksumCodec{
+		rw:               rw,
+		checksumProtocol: p,
+	}
+	codec.base, err = p.base.NewCodec(&codec.fixlenReadWriter)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+type checksumCodec struct {
+	base link.Codec
+	rw   io.ReadWriter
+	*checksumProtocol
+	fixlenReadWriter
+}
+
+func (c *checksumCodec) Receive() (interface{}, error) {
+	data, err := ioutil.ReadAll(c.rw)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body := data[:len(data)-4]
+	expected := binary.BigEndian.Uint32(data[len(body):])
+	if actual := crc32.Checksum(body, c.table); actual != expected {
+		return nil, &ChecksumError{expected, actual}
+	}
+	c.recvBuf.Reset(body)
+	return c.base.Receive()
+}
+
+func (c *checksumCodec) Send(msg interface{}) error {
+	c.sendBuf.Reset()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(c.sendBuf.Bytes(), c.table))
+	c.sendBuf.Write(sum[:])
+	_, err := c.rw.Write(c.sendBuf.Bytes())
+	return err
+}
+
+func (c *checksumCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func Test_Checksum(t *testing.T) {
+	JsonTest(t, FixLen(Checksum(JsonTestProtocol(), nil), 2, binary.LittleEndian, 1024, 1024))
+
+	var stream bytes.Buffer
+	codec, _ := FixLen(Checksum(Bytes(), nil), 2, binary.LittleEndian, 1024, 1024).NewCodec(&stream)
+	if err := codec.Send([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.Send([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	stream.Bytes()[3] = 'x'
+
+	if _, err := codec.Receive(); err == nil {
+		t.Fatal("corrupted message received")
+	} else if _, ok := err.(*ChecksumError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	recv, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recv.([]byte)) != "abc" {
+		t.Fatalf("message not match: %q", recv)
+	}
+}
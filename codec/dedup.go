@@ -0,0 +1,123 @@
+package codec
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/funny/link"
+)
+
+// SequenceFunc extracts the sequence id of a received message. Messages
+// for which it returns false are not deduplicated.
+type SequenceFunc func(msg interface{}) (uint64, bool)
+
+// DedupStats is implemented by codecs that drop replayed messages.
+type DedupStats interface {
+	// Duplicates returns how many messages were dropped because a message
+	// with the same sequence id was already received.
+	Duplicates() uint64
+	// Stale returns how many messages were dropped because their sequence
+	// id fell behind the window.
+	Stale() uint64
+}
+
+// Dedup drops received messages whose sequence id was already seen. Ids
+// may arrive out of order within window ids behind the highest one, older
+// ids are dropped as stale. Window must be positive.
+func Dedup(base link.Protocol, sequence SequenceFunc, window int) link.Protocol {
+	if window <= 0 {
+		panic("Dedup: window must be positive")
+	}
+	return &dedupProtocol{base, sequence, window}
+}
+
+type dedupProtocol struct {
+	base     link.Protocol
+	sequence SequenceFunc
+	window   int
+}
+
+func (p *dedupProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	base, err := p.base.NewCodec(rw)
+	if err != nil {
+		return nil, err
+	}
+	codec := &dedupCodec{
+		Codec:         base,
+		dedupProtocol: p,
+		seen:          make([]bool, p.window),
+	}
+	if base, ok := base.(link.PacketCodec); ok {
+		return &dedupPacketCodec{codec, base}, nil
+	}
+	return codec, nil
+}
+
+type dedupCodec struct {
+	link.Codec
+	*dedupProtocol
+	started    bool
+	highest    uint64
+	seen       []bool
+	duplicates uint64
+	stale      uint64
+}
+
+func (c *dedupCodec) Receive() (interface{}, error) {
+	for {
+		msg, err := c.Codec.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if seq, ok := c.sequence(msg); !ok || c.accept(seq) {
+			return msg, nil
+		}
+	}
+}
+
+func (c *dedupCodec) accept(seq uint64) bool {
+	window := uint64(len(c.seen))
+	switch {
+	case !c.started || seq > c.highest:
+		if !c.started || seq-c.highest >= window {
+			for i := range c.seen {
+				c.seen[i] = false
+			}
+		} else {
+			for i := c.highest + 1; i < seq; i++ {
+				c.seen[i%window] = false
+			}
+		}
+		c.started = true
+		c.highest = seq
+	case c.highest-seq >= window:
+		atomic.AddUint64(&c.stale, 1)
+		return false
+	case c.seen[seq%window]:
+		atomic.AddUint64(&c.duplicates, 1)
+		return false
+	}
+	c.seen[seq%window] = true
+	return true
+}
+
+func (c *dedupCodec) Duplicates() uint64 {
+	return atomic.LoadUint64(&c.duplicates)
+}
+
+func (c *dedupCodec) Stale() uint64 {
+	return atomic.LoadUint64(&c.stale)
+}
+
+type dedupPacketCodec struct {
+	*dedupCodec
+	base link.PacketCodec
+}
+
+func (c *dedupPacketCodec) Packet(dst []byte, msg interface{}) ([]byte, error) {
+	return c.base.Packet(dst, msg)
+}
+
+func (c *dedupPacketCodec) SendPacket(packet []byte) error {
+	return c.base.SendPacket(packet)
+}
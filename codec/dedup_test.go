@@ -0,0 +1,61 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func Test_Dedup(t *testing.T) {
+	sequence := func(msg interface{}) (uint64, bool) {
+		b := msg.([]byte)
+		if len(b) < 8 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint64(b), true
+	}
+
+	var stream bytes.Buffer
+	protocol := Dedup(FixLen(Bytes(), 2, binary.LittleEndian, 1024, 1024), sequence, 4)
+	codec, _ := protocol.NewCodec(&stream)
+
+	for _, seq := range []uint64{1, 2, 2, 5, 3, 3, 1, 4, 9, 5, 8} {
+		msg := make([]byte, 8)
+		binary.BigEndian.PutUint64(msg, seq)
+		if err := codec.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	codec.Send([]byte("raw"))
+
+	var recv []uint64
+	for {
+		msg, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, ok := sequence(msg)
+		if !ok {
+			break
+		}
+		recv = append(recv, seq)
+	}
+
+	if expect := []uint64{1, 2, 5, 3, 4, 9, 8}; !reflect.DeepEqual(recv, expect) {
+		t.Fatalf("unexpected sequence: %v", recv)
+	}
+	stats := codec.(DedupStats)
+	if stats.Duplicates() != 2 || stats.Stale() != 2 {
+		t.Fatalf("unexpected stats: %d, %d", stats.Duplicates(), stats.Stale())
+	}
+}
+
+func Test_DedupZeroWindow(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("zero window accepted")
+		}
+	}()
+	Dedup(Bytes(), nil, 0)
+}
@@ -0,0 +1,85 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/funny/link"
+)
+
+var ErrDelimInMessage = errors.New("Delimiter In Message")
+
+// Delim frames the messages of base by ending each of them with delim,
+// like "\n" or "\r\n" for text protocols. Received lines longer than
+// maxLine, the delimiter excluded, fail with ErrTooLargePacket.
+func Delim(base link.Protocol, delim []byte, maxLine int) link.Protocol {
+	return &delimProtocol{base, delim, maxLine}
+}
+
+type delimProtocol struct {
+	base    link.Protocol
+	delim   []byte
+	maxLine int
+}
+
+func (p *delimProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &delimCodec{
+		rw:            rw,
+		r:             bufio.NewReader(rw),
+		delimProtocol: p,
+	}
+	codec.base, err = p.base.NewCodec(&codec.fixlenReadWriter)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+type delimCodec struct {
+	base link.Codec
+	rw   io.ReadWriter
+	r    *bufio.Reader
+	line []byte
+	*delimProtocol
+	fixlenReadWriter
+}
+
+func (c *delimCodec) Receive() (interface{}, error) {
+	last := c.delim[len(c.delim)-1]
+	c.line = c.line[:0]
+	for !bytes.HasSuffix(c.line, c.delim) {
+		b, err := c.r.ReadSlice(last)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		c.line = append(c.line, b...)
+		if len(c.line) > c.maxLine+len(c.delim) {
+			return nil, ErrTooLargePacket
+		}
+	}
+	c.recvBuf.Reset(c.line[:len(c.line)-len(c.delim)])
+	return c.base.Receive()
+}
+
+func (c *delimCodec) Send(msg interface{}) error {
+	c.sendBuf.Reset()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	if bytes.Contains(c.sendBuf.Bytes(), c.delim) {
+		return ErrDelimInMessage
+	}
+	c.sendBuf.Write(c.delim)
+	_, err := c.rw.Write(c.sendBuf.Bytes())
+	return err
+}
+
+func (c *delimCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Delim(t *testing.T) {
+	var stream bytes.Buffer
+	codec, _ := Delim(Bytes(), []byte("\r\n"), 16).NewCodec(&stream)
+
+	for _, line := range []string{"PING", "", "SET a 1\r", "0123456789abcdef"} {
+		if err := codec.Send([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.WriteString("GET a\r\nPARTIAL")
+	for _, line := range []string{"PING", "", "SET a 1\r", "0123456789abcdef", "GET a"} {
+		recv, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(recv.([]byte)) != line {
+			t.Fatalf("line not match: %q, %q", line, recv)
+		}
+	}
+
+	if err := codec.Send([]byte("a\r\nb")); err != ErrDelimInMessage {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stream.WriteString("0123456789abcdefg\r\n")
+	if _, err := codec.Receive(); err != ErrTooLargePacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -4,13 +4,31 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
+	"sync"
+	"sync/atomic"
 
 	"github.com/funny/link"
 )
 
 var ErrTooLargePacket = errors.New("Too Large Packet")
+var ErrBadHead = errors.New("Bad Head")
+
+// FramingDesyncError is returned by a FixLen codec once too many
+// consecutive frames were oversized or failed to decode, which usually
+// means the two sides disagree on the framing.
+type FramingDesyncError struct {
+	Lengths []int
+}
+
+func (e *FramingDesyncError) Error() string {
+	return fmt.Sprintf("Framing Desync: last frame lengths %v", e.Lengths)
+}
+
+// FramingStats is implemented by codecs that count suspicious frames.
+type FramingStats = link.FramingStats
 
 type FixLenProtocol struct {
 	base        link.Protocol
@@ -19,6 +37,11 @@ type FixLenProtocol struct {
 	maxSend     int
 	headDecoder func([]byte) int
 	headEncoder func([]byte, int)
+	prefix      []byte
+	includeHead bool
+	maxLength   int
+
+	desyncThreshold int
 }
 
 func FixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxSend int) *FixLenProtocol {
@@ -28,6 +51,7 @@ func FixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxS
 	}
 	switch n {
 	case 1:
+		proto.maxLength = math.MaxUint8
 		if maxRecv > math.MaxUint8 {
 			maxRecv = math.MaxUint8
 		}
@@ -41,6 +65,7 @@ func FixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxS
 			b[0] = byte(size)
 		}
 	case 2:
+		proto.maxLength = math.MaxUint16
 		if maxRecv > math.MaxUint16 {
 			maxRecv = math.MaxUint16
 		}
@@ -54,6 +79,7 @@ func FixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxS
 			byteOrder.PutUint16(b, uint16(size))
 		}
 	case 4:
+		proto.maxLength = math.MaxUint32
 		if maxRecv > math.MaxUint32 {
 			maxRecv = math.MaxUint32
 		}
@@ -67,6 +93,7 @@ func FixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxS
 			byteOrder.PutUint32(b, uint32(size))
 		}
 	case 8:
+		proto.maxLength = math.MaxInt64
 		proto.headDecoder = func(b []byte) int {
 			return int(byteOrder.Uint64(b))
 		}
@@ -81,12 +108,53 @@ func FixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxS
 	return proto
 }
 
+// DetectDesync makes the codecs return a FramingDesyncError after n
+// consecutive frames are oversized or can't be decoded, and keep
+// returning it since every following frame is garbage.
+func (p *FixLenProtocol) DetectDesync(n int) *FixLenProtocol {
+	p.desyncThreshold = n
+	return p
+}
+
+// Prefix makes every frame start with prefix, like a magic number or a
+// version, followed by the length field. Received frames that don't start
+// with it fail with ErrBadHead.
+func (p *FixLenProtocol) Prefix(prefix []byte) *FixLenProtocol {
+	p.prefix = prefix
+	p.clamp()
+	return p
+}
+
+// LengthIncludesHead makes the length field count the prefix and the
+// length field itself besides the body. The limits of the body are
+// lowered when the length field couldn't hold them plus the head.
+func (p *FixLenProtocol) LengthIncludesHead() *FixLenProtocol {
+	p.includeHead = true
+	p.clamp()
+	return p
+}
+
+func (p *FixLenProtocol) clamp() {
+	if !p.includeHead {
+		return
+	}
+	max := p.maxLength - len(p.prefix) - p.n
+	if p.maxRecv > max {
+		p.maxRecv = max
+	}
+	if p.maxSend > max {
+		p.maxSend = max
+	}
+}
+
 func (p *FixLenProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
 	codec := &fixlenCodec{
 		rw:             rw,
 		FixLenProtocol: p,
 	}
-	codec.headBuf = codec.head[:p.n]
+	codec.headBuf = make([]byte, len(p.prefix)+p.n)
+	codec.sendHead = make([]byte, len(p.prefix)+p.n)
+	copy(codec.sendHead, p.prefix)
 
 	codec.base, err = p.base.NewCodec(&codec.fixlenReadWriter)
 	if err != nil {
@@ -109,49 +177,201 @@ func (rw *fixlenReadWriter) Write(p []byte) (int, error) {
 	return rw.sendBuf.Write(p)
 }
 
+// recvBody is the buffer message bodies are read into, it implements
+// link.RecvScratchCodec.
+type recvBody struct {
+	buf     []byte
+	scratch int
+}
+
+func (b *recvBody) SetRecvScratch(size int) {
+	b.scratch = size
+	b.buf = make([]byte, 0, size)
+}
+
+// get returns a buffer of size bytes, only kept for the next message when
+// it's within the scratch size.
+func (b *recvBody) get(size int) []byte {
+	if cap(b.buf) >= size {
+		return b.buf[:size]
+	}
+	buf := make([]byte, size, size+128)
+	if b.scratch == 0 {
+		b.buf = buf
+	}
+	return buf
+}
+
 type fixlenCodec struct {
-	base    link.Codec
-	head    [8]byte
-	headBuf []byte
-	bodyBuf []byte
-	rw      io.ReadWriter
+	base     link.Codec
+	headBuf  []byte
+	sendHead []byte
+	copyBuf  []byte
+	rw       io.ReadWriter
 	*FixLenProtocol
 	fixlenReadWriter
+	recvBody
+
+	anomalies  int
+	lengths    []int
+	desync     error
+	suspicious uint64
+
+	packetBufs [2][]byte
+	packer
+}
+
+// packer encodes messages for PacketCodec.Packet with one base codec
+// writing into a reused buffer, serialized since Packet may be called
+// concurrently.
+type packer struct {
+	mutex sync.Mutex
+	rw    fixlenReadWriter
+	base  link.Codec
+}
+
+func (p *packer) packet(protocol link.Protocol, dst []byte, msg interface{}) ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.base == nil {
+		base, err := protocol.NewCodec(&p.rw)
+		if err != nil {
+			return nil, err
+		}
+		p.base = base
+	}
+	p.rw.sendBuf.Reset()
+	if err := p.base.Send(msg); err != nil {
+		return nil, err
+	}
+	return append(dst, p.rw.sendBuf.Bytes()...), nil
 }
 
 func (c *fixlenCodec) Receive() (interface{}, error) {
+	if c.desync != nil {
+		return nil, c.desync
+	}
 	if _, err := io.ReadFull(c.rw, c.headBuf); err != nil {
 		return nil, err
 	}
-	size := c.headDecoder(c.headBuf)
-	if size > c.maxRecv {
-		return nil, ErrTooLargePacket
+	size, err := c.decodeHead(c.headBuf)
+	if err != nil {
+		return nil, c.anomaly(err)
 	}
-	if cap(c.bodyBuf) < size {
-		c.bodyBuf = make([]byte, size, size+128)
+	c.recordLength(size)
+	if size > c.maxRecv {
+		return nil, c.anomaly(ErrTooLargePacket)
 	}
-	buff := c.bodyBuf[:size]
+	buff := c.recvBody.get(size)
 	if _, err := io.ReadFull(c.rw, buff); err != nil {
 		return nil, err
 	}
 	c.recvBuf.Reset(buff)
 	msg, err := c.base.Receive()
-	return msg, err
+	if err != nil {
+		return nil, c.anomaly(err)
+	}
+	c.anomalies = 0
+	return msg, nil
+}
+
+func (c *fixlenCodec) decodeHead(head []byte) (int, error) {
+	if !bytes.Equal(head[:len(c.prefix)], c.prefix) {
+		return 0, ErrBadHead
+	}
+	size := c.headDecoder(head[len(c.prefix):])
+	if c.includeHead {
+		size -= len(head)
+	}
+	if size < 0 {
+		return 0, ErrBadHead
+	}
+	return size, nil
+}
+
+func (c *fixlenCodec) encodeHead(head []byte, size int) {
+	if c.includeHead {
+		size += len(head)
+	}
+	c.headEncoder(head[len(c.prefix):], size)
+}
+
+func (c *fixlenCodec) recordLength(size int) {
+	if c.desyncThreshold <= 0 {
+		return
+	}
+	if len(c.lengths) == c.desyncThreshold {
+		copy(c.lengths, c.lengths[1:])
+		c.lengths = c.lengths[:len(c.lengths)-1]
+	}
+	c.lengths = append(c.lengths, size)
+}
+
+func (c *fixlenCodec) anomaly(err error) error {
+	atomic.AddUint64(&c.suspicious, 1)
+	c.anomalies++
+	if c.desyncThreshold > 0 && c.anomalies >= c.desyncThreshold {
+		c.desync = &FramingDesyncError{
+			Lengths: append([]int(nil), c.lengths...),
+		}
+		return c.desync
+	}
+	return err
+}
+
+func (c *fixlenCodec) SuspiciousFrames() uint64 {
+	return atomic.LoadUint64(&c.suspicious)
 }
 
 func (c *fixlenCodec) Send(msg interface{}) error {
 	c.sendBuf.Reset()
-	c.sendBuf.Write(c.headBuf)
+	c.sendBuf.Write(c.sendHead)
 	err := c.base.Send(msg)
 	if err != nil {
 		return err
 	}
 	buff := c.sendBuf.Bytes()
-	c.headEncoder(buff, len(buff)-c.n)
+	if len(buff)-len(c.sendHead) > c.maxSend {
+		return ErrTooLargePacket
+	}
+	c.encodeHead(buff[:len(c.sendHead)], len(buff)-len(c.sendHead))
 	_, err = c.rw.Write(buff)
 	return err
 }
 
+func (c *fixlenCodec) Packet(dst []byte, msg interface{}) ([]byte, error) {
+	return c.packer.packet(c.FixLenProtocol.base, dst, msg)
+}
+
+func (c *fixlenCodec) SendPacket(packet []byte) error {
+	if len(packet) > c.maxSend {
+		return ErrTooLargePacket
+	}
+	c.encodeHead(c.sendHead, len(packet))
+	c.packetBufs = [2][]byte{c.sendHead, packet}
+	err := link.WriteBuffers(c.rw, c.packetBufs[:]...)
+	c.packetBufs[1] = nil
+	return err
+}
+
+func (c *fixlenCodec) SendReader(r io.Reader, size int) error {
+	if size > c.maxSend {
+		return ErrTooLargePacket
+	}
+	c.encodeHead(c.sendHead, size)
+	if _, err := c.rw.Write(c.sendHead); err != nil {
+		return err
+	}
+	if c.copyBuf == nil {
+		c.copyBuf = make([]byte, 32*1024)
+	}
+	n, err := io.CopyBuffer(c.rw, io.LimitReader(r, int64(size)), c.copyBuf)
+	if err == nil && n < int64(size) {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 func (c *fixlenCodec) Close() error {
 	if closer, ok := c.rw.(io.Closer); ok {
 		return closer.Close()
@@ -1,8 +1,13 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io"
+	"net"
 	"testing"
+
+	"github.com/funny/link"
 )
 
 func Test_FixLen(t *testing.T) {
@@ -10,3 +15,193 @@ func Test_FixLen(t *testing.T) {
 	protocol := FixLen(base, 2, binary.LittleEndian, 1024, 1024)
 	JsonTest(t, protocol)
 }
+
+func Test_FixLen_Packet(t *testing.T) {
+	var stream bytes.Buffer
+	protocol := FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 1024, 1024)
+	codec, _ := protocol.NewCodec(&stream)
+
+	sendMsg := MyMessage1{"abc", 123}
+	packet, err := codec.(link.PacketCodec).Packet(nil, &sendMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.(link.PacketCodec).SendPacket(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	recvMsg, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendMsg != *(recvMsg.(*MyMessage1)) {
+		t.Fatalf("message not match: %v, %v", sendMsg, recvMsg)
+	}
+}
+
+func Test_FixLen_Desync(t *testing.T) {
+	var stream bytes.Buffer
+	protocol := FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 1024, 1024).DetectDesync(3)
+	codec, _ := protocol.NewCodec(&stream)
+
+	if err := codec.Send(&MyMessage1{"abc", 123}); err != nil {
+		t.Fatal(err)
+	}
+	stream.Write(bytes.Repeat([]byte{0xff}, 64))
+
+	if _, err := codec.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := codec.Receive(); err != ErrTooLargePacket {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err := codec.Receive()
+		desync, ok := err.(*FramingDesyncError)
+		if !ok {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(desync.Lengths) != 3 || desync.Lengths[2] != 0xffff {
+			t.Fatalf("unexpected lengths: %v", desync.Lengths)
+		}
+	}
+	if n := codec.(FramingStats).SuspiciousFrames(); n != 3 {
+		t.Fatalf("unexpected suspicious frames: %d", n)
+	}
+	if n := link.NewSession(codec, 0).Stats().SuspiciousFrames; n != 3 {
+		t.Fatalf("unexpected session suspicious frames: %d", n)
+	}
+}
+
+func Test_FixLen_Head(t *testing.T) {
+	var stream bytes.Buffer
+	protocol := FixLen(Bytes(), 4, binary.BigEndian, 1024, 1024).Prefix([]byte("LK\x01")).LengthIncludesHead()
+	codec, _ := protocol.NewCodec(&stream)
+
+	if err := codec.Send([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.(link.PacketCodec).SendPacket([]byte("de")); err != nil {
+		t.Fatal(err)
+	}
+	expect := "LK\x01\x00\x00\x00\x0aabcLK\x01\x00\x00\x00\x09de"
+	if stream.String() != expect {
+		t.Fatalf("unexpected stream: %q", stream.String())
+	}
+	for _, msg := range []string{"abc", "de"} {
+		recv, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(recv.([]byte)) != msg {
+			t.Fatalf("message not match: %q", recv)
+		}
+	}
+
+	stream.WriteString("XX\x01\x00\x00\x00\x0aabc")
+	if _, err := codec.Receive(); err != ErrBadHead {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The length field of 1 byte can't count a 255 bytes body and itself.
+	stream.Reset()
+	codec, _ = FixLen(Bytes(), 1, binary.BigEndian, 1024, 1024).LengthIncludesHead().NewCodec(&stream)
+	if err := codec.Send(make([]byte, 255)); err != ErrTooLargePacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := codec.(link.PacketCodec).SendPacket(make([]byte, 255)); err != ErrTooLargePacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := codec.Send(make([]byte, 254)); err != nil {
+		t.Fatal(err)
+	}
+	if recv, err := codec.Receive(); err != nil || len(recv.([]byte)) != 254 {
+		t.Fatal(err)
+	}
+}
+
+type buffersStream struct {
+	bytes.Buffer
+	writes int
+}
+
+func (s *buffersStream) WriteBuffers(bufs net.Buffers) (int64, error) {
+	s.writes++
+	return bufs.WriteTo(&s.Buffer)
+}
+
+func Test_FixLen_WriteBuffers(t *testing.T) {
+	for _, protocol := range []link.Protocol{
+		FixLen(Bytes(), 2, binary.LittleEndian, 1024, 1024),
+		Uvarint(Bytes(), 1024, 1024),
+	} {
+		var stream buffersStream
+		codec, _ := protocol.NewCodec(&stream)
+		if err := codec.(link.PacketCodec).SendPacket([]byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+		if stream.writes != 1 {
+			t.Fatalf("unexpected writes: %d", stream.writes)
+		}
+		msg, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.([]byte)) != "abc" {
+			t.Fatalf("message not match: %q", msg)
+		}
+	}
+}
+
+func Test_FixLen_RecvScratch(t *testing.T) {
+	for _, protocol := range []link.Protocol{
+		FixLen(Bytes(), 2, binary.LittleEndian, 1024, 1024),
+		Uvarint(Bytes(), 1024, 1024),
+	} {
+		var stream bytes.Buffer
+		codec, _ := protocol.NewCodec(&stream)
+		session := link.NewSession(codec, 0)
+		session.SetSendScratch(256)
+		session.SetRecvScratch(16)
+		var body *recvBody
+		switch c := codec.(type) {
+		case *fixlenCodec:
+			body = &c.recvBody
+		case *uvarintCodec:
+			body = &c.recvBody
+		}
+		for _, size := range []int{8, 100, 8} {
+			if err := session.Send(bytes.Repeat([]byte{byte(size)}, size)); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := session.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg.([]byte), bytes.Repeat([]byte{byte(size)}, size)) {
+				t.Fatalf("message not match: %v", msg)
+			}
+			if cap(body.buf) != 16 {
+				t.Fatalf("scratch buffer not kept: %d", cap(body.buf))
+			}
+		}
+	}
+}
+
+type discardReadWriter struct{}
+
+func (discardReadWriter) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (discardReadWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func Benchmark_FixLen_SendScratch(b *testing.B) {
+	codec, _ := FixLen(Bytes(), 2, binary.BigEndian, 1024, 1024).NewCodec(discardReadWriter{})
+	session := link.NewSession(codec, 0)
+	session.SetSendScratch(64)
+	var msg interface{} = make([]byte, 32)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		session.Send(msg)
+	}
+}
@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"io"
+
+	"github.com/funny/link"
+)
+
+// FixSize frames the messages of base as records of exactly size bytes.
+// Shorter messages are padded with zero bytes, longer ones fail with
+// ErrTooLargePacket. Received records are handed to base whole, padding
+// included.
+func FixSize(base link.Protocol, size int) link.Protocol {
+	return &fixsizeProtocol{base, size}
+}
+
+type fixsizeProtocol struct {
+	base link.Protocol
+	size int
+}
+
+func (p *fixsizeProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &fixsizeCodec{
+		rw:              rw,
+		record:          make([]byte, p.size),
+		fixsizeProtocol: p,
+	}
+	codec.base, err = p.base.NewCodec(&codec.fixlenReadWriter)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+type fixsizeCodec struct {
+	base   link.Codec
+	rw     io.ReadWriter
+	record []byte
+	*fixsizeProtocol
+	fixlenReadWriter
+}
+
+func (c *fixsizeCodec) Receive() (interface{}, error) {
+	if _, err := io.ReadFull(c.rw, c.record); err != nil {
+		return nil, err
+	}
+	c.recvBuf.Reset(c.record)
+	return c.base.Receive()
+}
+
+func (c *fixsizeCodec) Send(msg interface{}) error {
+	c.sendBuf.Reset()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	n := c.sendBuf.Len()
+	if n > c.size {
+		return ErrTooLargePacket
+	}
+	for ; n < c.size; n++ {
+		c.sendBuf.WriteByte(0)
+	}
+	_, err := c.rw.Write(c.sendBuf.Bytes())
+	return err
+}
+
+func (c *fixsizeCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
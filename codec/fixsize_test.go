@@ -0,0 +1,37 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_FixSize(t *testing.T) {
+	var stream bytes.Buffer
+	codec, _ := FixSize(Bytes(), 8).NewCodec(&stream)
+
+	for _, msg := range []string{"abc", "", "12345678"} {
+		if err := codec.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stream.Len() != 24 {
+		t.Fatalf("unexpected stream size: %d", stream.Len())
+	}
+	for _, msg := range []string{"abc\x00\x00\x00\x00\x00", "\x00\x00\x00\x00\x00\x00\x00\x00", "12345678"} {
+		recv, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(recv.([]byte)) != msg {
+			t.Fatalf("record not match: %q, %q", msg, recv)
+		}
+	}
+
+	if err := codec.Send([]byte("123456789")); err != ErrTooLargePacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stream.WriteString("1234")
+	if _, err := codec.Receive(); err == nil {
+		t.Fatal("partial record received")
+	}
+}
@@ -0,0 +1,62 @@
+package codec
+
+import (
+	"encoding/gob"
+	"io"
+
+	"github.com/funny/link"
+)
+
+// GobProtocol encodes messages with encoding/gob. Every codec keeps its
+// encoder and decoder for the whole session, so type information is sent
+// only once. Gob streams delimit themselves and should not be wrapped by
+// FixLen.
+type GobProtocol struct{}
+
+func Gob() *GobProtocol {
+	return &GobProtocol{}
+}
+
+// Register records the concrete type of t with gob.Register, so it can be
+// sent as a message.
+func (g *GobProtocol) Register(t interface{}) {
+	gob.Register(t)
+}
+
+func (g *GobProtocol) RegisterName(name string, t interface{}) {
+	gob.RegisterName(name, t)
+}
+
+func (g *GobProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	codec := &gobCodec{
+		encoder: gob.NewEncoder(rw),
+		decoder: gob.NewDecoder(rw),
+	}
+	codec.closer, _ = rw.(io.Closer)
+	return codec, nil
+}
+
+type gobCodec struct {
+	closer  io.Closer
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+}
+
+func (c *gobCodec) Receive() (interface{}, error) {
+	var msg interface{}
+	if err := c.decoder.Decode(&msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *gobCodec) Send(msg interface{}) error {
+	return c.encoder.Encode(&msg)
+}
+
+func (c *gobCodec) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Gob(t *testing.T) {
+	protocol := Gob()
+	protocol.Register(&MyMessage1{})
+	protocol.Register(MyMessage2{})
+
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+
+	sendMsg1 := &MyMessage1{"abc", 123}
+	sendMsg2 := MyMessage2{123, "abc"}
+	for i := 0; i < 3; i++ {
+		if err := codec.Send(sendMsg1); err != nil {
+			t.Fatal(err)
+		}
+		if err := codec.Send(sendMsg2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := stream.Len()
+
+	for i := 0; i < 3; i++ {
+		recvMsg1, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *sendMsg1 != *(recvMsg1.(*MyMessage1)) {
+			t.Fatalf("message not match: %v, %v", sendMsg1, recvMsg1)
+		}
+		recvMsg2, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sendMsg2 != recvMsg2.(MyMessage2) {
+			t.Fatalf("message not match: %v, %v", sendMsg2, recvMsg2)
+		}
+	}
+
+	// Type information is only sent with the first message of a type.
+	codec.Send(sendMsg1)
+	if n := stream.Len(); n*3 > size {
+		t.Fatalf("type information sent again: %d bytes after %d", n, size)
+	}
+}
@@ -0,0 +1,103 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/funny/link"
+)
+
+// Gzip compresses every message encoded by base with the given level.
+// Received messages that decompress to more than maxSize bytes fail with
+// ErrTooLargePacket. It reads a whole message from the connection, so
+// it's meant to be wrapped by a framing protocol such as FixLen.
+func Gzip(base link.Protocol, level, maxSize int) link.Protocol {
+	return &gzipProtocol{base, level, maxSize}
+}
+
+type gzipProtocol struct {
+	base    link.Protocol
+	level   int
+	maxSize int
+}
+
+func (p *gzipProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &gzipCodec{
+		rw:           rw,
+		gzipProtocol: p,
+	}
+	codec.writer, err = gzip.NewWriterLevel(&codec.compressed, p.level)
+	if err != nil {
+		return
+	}
+	codec.base, err = p.base.NewCodec(&codec.fixlenReadWriter)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+type gzipCodec struct {
+	base       link.Codec
+	rw         io.ReadWriter
+	writer     *gzip.Writer
+	compressed bytes.Buffer
+	reader     *gzip.Reader
+	input      bytes.Reader
+	plain      bytes.Buffer
+	*gzipProtocol
+	fixlenReadWriter
+}
+
+func (c *gzipCodec) Receive() (interface{}, error) {
+	data, err := ioutil.ReadAll(c.rw)
+	if err != nil {
+		return nil, err
+	}
+	c.input.Reset(data)
+	if c.reader == nil {
+		c.reader, err = gzip.NewReader(&c.input)
+	} else {
+		err = c.reader.Reset(&c.input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.plain.Reset()
+	n, err := c.plain.ReadFrom(io.LimitReader(c.reader, int64(c.maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(c.maxSize) {
+		return nil, ErrTooLargePacket
+	}
+	c.recvBuf.Reset(c.plain.Bytes())
+	return c.base.Receive()
+}
+
+func (c *gzipCodec) Send(msg interface{}) error {
+	c.sendBuf.Reset()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	c.compressed.Reset()
+	c.writer.Reset(&c.compressed)
+	if _, err := c.writer.Write(c.sendBuf.Bytes()); err != nil {
+		return err
+	}
+	if err := c.writer.Close(); err != nil {
+		return err
+	}
+	_, err := c.rw.Write(c.compressed.Bytes())
+	return err
+}
+
+func (c *gzipCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
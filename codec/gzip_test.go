@@ -0,0 +1,34 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+)
+
+func Test_Gzip(t *testing.T) {
+	JsonTest(t, FixLen(Gzip(JsonTestProtocol(), gzip.BestSpeed, 1024), 2, binary.LittleEndian, 1024, 1024))
+
+	var stream bytes.Buffer
+	codec, _ := FixLen(Gzip(Bytes(), gzip.DefaultCompression, 4096), 2, binary.LittleEndian, 1024, 1024).NewCodec(&stream)
+	msg := bytes.Repeat([]byte("link"), 1024)
+	if err := codec.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	if stream.Len() > len(msg)/10 {
+		t.Fatalf("message not compressed: %d bytes", stream.Len())
+	}
+	recv, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, recv.([]byte)) {
+		t.Fatal("message not match")
+	}
+
+	codec.Send(append(msg, 'x'))
+	if _, err := codec.Receive(); err != ErrTooLargePacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
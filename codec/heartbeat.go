@@ -0,0 +1,220 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/funny/link"
+)
+
+const (
+	heartbeatData = iota
+	heartbeatPing
+	heartbeatPong
+	heartbeatMore
+)
+
+// Heartbeat frames everything base writes during a Send with a kind byte
+// and a 4 bytes big endian length, so ping and pong frames can travel
+// between messages without base knowing. Its codecs implement
+// link.PingCodec for Session.SetHeartbeat and answer pings while
+// receiving. Messages larger than maxSize fail with ErrTooLargePacket.
+//
+// Pings and pongs are written to the connection by the goroutines of
+// Session.SetHeartbeat and of Receive, so Heartbeat must be the outermost
+// layer of the protocol: a buffering layer around it, such as Bufio,
+// would hold them or write them concurrently with the sends. With
+// Session.SetWriteBatch they're written along with the batch being
+// accumulated, if any.
+func Heartbeat(base link.Protocol, maxSize int) link.Protocol {
+	return &heartbeatProtocol{base, maxSize, 0}
+}
+
+// Fragment is like Heartbeat but splits the messages larger than
+// frameSize in fragments of frameSize bytes, the last one excepted, so
+// pings and pongs can be written between the fragments of a large
+// message. Heartbeat codecs reassemble fragmented messages too.
+func Fragment(base link.Protocol, frameSize, maxSize int) link.Protocol {
+	return &heartbeatProtocol{base, maxSize, frameSize}
+}
+
+type heartbeatProtocol struct {
+	base      link.Protocol
+	maxSize   int
+	frameSize int
+}
+
+func (p *heartbeatProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &heartbeatCodec{
+		rw:                rw,
+		heartbeatProtocol: p,
+	}
+	codec.stream.codec = codec
+	codec.base, err = p.base.NewCodec(&codec.stream)
+	if err != nil {
+		return
+	}
+	if base, ok := codec.base.(link.PacketCodec); ok {
+		cc = &heartbeatPacketCodec{codec, base}
+		return
+	}
+	cc = codec
+	return
+}
+
+type heartbeatStream struct {
+	codec   *heartbeatCodec
+	plain   []byte
+	sendBuf []byte
+}
+
+func (s *heartbeatStream) Read(p []byte) (int, error) {
+	if len(s.plain) == 0 {
+		if err := s.codec.readData(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *heartbeatStream) Write(p []byte) (int, error) {
+	s.sendBuf = append(s.sendBuf, p...)
+	return len(p), nil
+}
+
+type heartbeatCodec struct {
+	base       link.Codec
+	rw         io.ReadWriter
+	stream     heartbeatStream
+	head       [5]byte
+	recvFrame  []byte
+	writeMutex sync.Mutex
+	sendFrame  []byte
+	pongs      uint64
+	*heartbeatProtocol
+}
+
+// readData reads frames until the last fragment of a message, answering
+// pings on the way.
+func (c *heartbeatCodec) readData() error {
+	received := 0
+	for {
+		if _, err := io.ReadFull(c.rw, c.head[:]); err != nil {
+			return err
+		}
+		size := int(binary.BigEndian.Uint32(c.head[1:]))
+		if size > c.maxSize {
+			return ErrTooLargePacket
+		}
+		switch c.head[0] {
+		case heartbeatData, heartbeatMore:
+			n := received + size
+			if n > c.maxSize {
+				return ErrTooLargePacket
+			}
+			if cap(c.recvFrame) < n {
+				frame := make([]byte, n, n+cap(c.recvFrame))
+				copy(frame, c.recvFrame[:received])
+				c.recvFrame = frame
+			}
+			frame := c.recvFrame[:n]
+			if _, err := io.ReadFull(c.rw, frame[received:]); err != nil {
+				return err
+			}
+			if c.head[0] == heartbeatMore {
+				received = n
+				continue
+			}
+			c.stream.plain = frame
+			return nil
+		case heartbeatPing:
+			if size != 0 {
+				return ErrBadHead
+			}
+			if err := c.writeFrame(heartbeatPong, nil); err != nil {
+				return err
+			}
+		case heartbeatPong:
+			if size != 0 {
+				return ErrBadHead
+			}
+			atomic.AddUint64(&c.pongs, 1)
+		default:
+			return ErrBadHead
+		}
+	}
+}
+
+func (c *heartbeatCodec) writeFrame(kind byte, data []byte) error {
+	if len(data) > c.maxSize {
+		return ErrTooLargePacket
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.sendFrame = append(c.sendFrame[:0], kind, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(c.sendFrame[1:], uint32(len(data)))
+	c.sendFrame = append(c.sendFrame, data...)
+	_, err := c.rw.Write(c.sendFrame)
+	return err
+}
+
+func (c *heartbeatCodec) writeData(data []byte) error {
+	if len(data) > c.maxSize {
+		return ErrTooLargePacket
+	}
+	for c.frameSize > 0 && len(data) > c.frameSize {
+		if err := c.writeFrame(heartbeatMore, data[:c.frameSize]); err != nil {
+			return err
+		}
+		data = data[c.frameSize:]
+	}
+	return c.writeFrame(heartbeatData, data)
+}
+
+func (c *heartbeatCodec) Receive() (interface{}, error) {
+	return c.base.Receive()
+}
+
+func (c *heartbeatCodec) Send(msg interface{}) error {
+	c.stream.sendBuf = c.stream.sendBuf[:0]
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	return c.writeData(c.stream.sendBuf)
+}
+
+func (c *heartbeatCodec) Ping() error {
+	return c.writeFrame(heartbeatPing, nil)
+}
+
+func (c *heartbeatCodec) Pongs() uint64 {
+	return atomic.LoadUint64(&c.pongs)
+}
+
+func (c *heartbeatCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type heartbeatPacketCodec struct {
+	*heartbeatCodec
+	base link.PacketCodec
+}
+
+func (c *heartbeatPacketCodec) Packet(dst []byte, msg interface{}) ([]byte, error) {
+	return c.base.Packet(dst, msg)
+}
+
+func (c *heartbeatPacketCodec) SendPacket(packet []byte) error {
+	c.stream.sendBuf = c.stream.sendBuf[:0]
+	if err := c.base.SendPacket(packet); err != nil {
+		return err
+	}
+	return c.writeData(c.stream.sendBuf)
+}
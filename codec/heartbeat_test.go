@@ -0,0 +1,99 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/funny/link"
+)
+
+func Test_Heartbeat(t *testing.T) {
+	type pipe struct {
+		io.Reader
+		io.Writer
+	}
+	var b12, b21 bytes.Buffer
+	protocol := Heartbeat(FixLen(Bytes(), 2, binary.LittleEndian, 1024, 1024), 1024)
+	c1, _ := protocol.NewCodec(pipe{&b21, &b12})
+	c2, _ := protocol.NewCodec(pipe{&b12, &b21})
+
+	if err := c1.(link.PingCodec).Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	packet, _ := c1.(link.PacketCodec).Packet(nil, []byte("link"))
+	if err := c1.(link.PacketCodec).SendPacket(packet); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"hello", "link"} {
+		msg, err := c2.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.([]byte)) != expect {
+			t.Fatalf("message not match: %q", msg)
+		}
+	}
+
+	c2.Send([]byte("world"))
+	msg, err := c1.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.([]byte)) != "world" {
+		t.Fatalf("message not match: %q", msg)
+	}
+	if n := c1.(link.PingCodec).Pongs(); n != 1 {
+		t.Fatalf("unexpected pongs: %d", n)
+	}
+	if n := c2.(link.PingCodec).Pongs(); n != 0 {
+		t.Fatalf("unexpected pongs: %d", n)
+	}
+}
+
+func Test_Fragment(t *testing.T) {
+	type pipe struct {
+		io.Reader
+		io.Writer
+	}
+	var b12, b21 bytes.Buffer
+	base := FixLen(Bytes(), 2, binary.LittleEndian, 2048, 2048)
+	c1, _ := Fragment(base, 16, 1024).NewCodec(pipe{&b21, &b12})
+	c2, _ := Heartbeat(base, 1024).NewCodec(pipe{&b12, &b21})
+
+	large := bytes.Repeat([]byte("0123456789"), 10)
+	if err := c1.Send(large); err != nil {
+		t.Fatal(err)
+	}
+	if n := b12.Len(); n != 2+len(large)+7*5 {
+		t.Fatalf("unexpected fragments: %d bytes", n)
+	}
+	if err := c1.Send([]byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range [][]byte{large, []byte("small")} {
+		msg, err := c2.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.([]byte), expect) {
+			t.Fatalf("message not match: %q", msg)
+		}
+	}
+
+	if err := c1.Send(make([]byte, 1025)); err != ErrTooLargePacket {
+		t.Fatal(err)
+	}
+	c3, _ := Fragment(base, 16, 1024).NewCodec(pipe{&b21, &b12})
+	c4, _ := Fragment(base, 16, 64).NewCodec(pipe{&b12, &b21})
+	if err := c3.Send(large); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c4.Receive(); err != ErrTooLargePacket {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,104 @@
+// Package msgpack provides a link protocol that encodes messages with
+// MessagePack, which is more compact than JSON. It lives in its own
+// package so the codec package does not depend on msgpack.
+package msgpack
+
+import (
+	"io"
+	"reflect"
+
+	"github.com/funny/link"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Protocol works like codec.Json: registered types are received as
+// pointers to the same type, other messages as generic maps and slices.
+type Protocol struct {
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+func New() *Protocol {
+	return &Protocol{
+		types: make(map[string]reflect.Type),
+		names: make(map[reflect.Type]string),
+	}
+}
+
+func (p *Protocol) Register(t interface{}) {
+	rt := reflect.TypeOf(t)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	p.RegisterName(rt.PkgPath()+"/"+rt.Name(), t)
+}
+
+func (p *Protocol) RegisterName(name string, t interface{}) {
+	rt := reflect.TypeOf(t)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	p.types[name] = rt
+	p.names[rt] = name
+}
+
+func (p *Protocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	codec := &msgpackCodec{
+		p:       p,
+		encoder: msgpack.NewEncoder(rw),
+		decoder: msgpack.NewDecoder(rw),
+	}
+	codec.closer, _ = rw.(io.Closer)
+	return codec, nil
+}
+
+type msgpackCodec struct {
+	p       *Protocol
+	closer  io.Closer
+	encoder *msgpack.Encoder
+	decoder *msgpack.Decoder
+}
+
+func (c *msgpackCodec) Receive() (interface{}, error) {
+	var head string
+	if err := c.decoder.Decode(&head); err != nil {
+		return nil, err
+	}
+	if t, exists := c.p.types[head]; exists {
+		body := reflect.New(t).Interface()
+		if err := c.decoder.Decode(body); err != nil {
+			return nil, err
+		}
+		return body, nil
+	}
+	return c.decoder.DecodeInterface()
+}
+
+func (c *msgpackCodec) Send(msg interface{}) error {
+	t := reflect.TypeOf(msg)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if err := c.encoder.EncodeString(c.p.names[t]); err != nil {
+		return err
+	}
+	return c.encoder.Encode(msg)
+}
+
+func (c *msgpackCodec) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+// Serializer implements link.Serializer with MessagePack.
+type Serializer struct{}
+
+func (Serializer) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (Serializer) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,80 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+type MyMessage1 struct {
+	Field1 string
+	Field2 int
+}
+
+type MyMessage2 struct {
+	Field1 int
+	Field2 string
+}
+
+func Test_Msgpack(t *testing.T) {
+	protocol := New()
+	protocol.Register(MyMessage1{})
+	protocol.RegisterName("msg2", &MyMessage2{})
+
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+
+	sendMsg1 := MyMessage1{"abc", 123}
+	sendMsg2 := MyMessage2{123, "abc"}
+	for _, msg := range []interface{}{&sendMsg1, sendMsg2, map[string]int{"a": 1}} {
+		if err := codec.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recvMsg1, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendMsg1 != *(recvMsg1.(*MyMessage1)) {
+		t.Fatalf("message not match: %v, %v", sendMsg1, recvMsg1)
+	}
+	recvMsg2, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendMsg2 != *(recvMsg2.(*MyMessage2)) {
+		t.Fatalf("message not match: %v, %v", sendMsg2, recvMsg2)
+	}
+	recvMsg3, err := codec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := recvMsg3.(map[string]interface{})["a"].(int8); v != 1 {
+		t.Fatalf("message not match: %#v", recvMsg3)
+	}
+}
+
+func Test_Serializer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	protocol := codec.FixLen(codec.Bytes(), 2, binary.LittleEndian, 1024, 1024)
+	s1, _ := link.NewConnSession(c1, protocol, 0)
+	s2, _ := link.NewConnSession(c2, protocol, 0)
+	defer s1.Close()
+	defer s2.Close()
+	s1.SetSerializer(Serializer{})
+	s2.SetSerializer(Serializer{})
+
+	go s1.SendValue(MyMessage1{"abc", 123})
+	var msg MyMessage1
+	if err := s2.ReadValue(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg != (MyMessage1{"abc", 123}) {
+		t.Fatalf("message not match: %v", msg)
+	}
+}
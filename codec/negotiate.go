@@ -0,0 +1,193 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/funny/link"
+)
+
+var ErrNoCommonVersion = errors.New("No Common Version")
+var ErrBadHello = errors.New("Bad Hello")
+
+var negotiateMagic = []byte("LNKV")
+
+// Version is a wire format the peers can agree on. Numbers must not be 0.
+type Version struct {
+	Number   uint16
+	Protocol link.Protocol
+}
+
+// Negotiated is implemented by the codecs of negotiating protocols.
+type Negotiated interface {
+	// Version returns the version the peers agreed on, 0 for a legacy
+	// peer.
+	Version() uint16
+	// Features returns the feature flags both peers support.
+	Features() uint64
+}
+
+// NegotiateClient sends the numbers of versions and the feature flags it
+// supports when a codec is created, and uses the protocol of the version
+// the server picks.
+func NegotiateClient(features uint64, versions ...Version) link.Protocol {
+	return &negotiateProtocol{versions, features, nil, false}
+}
+
+// NegotiateServer reads a client's hello when a codec is created, picks
+// the highest version both sides support and uses its protocol. Clients
+// that don't start with a hello use legacy, unless it's nil, so they must
+// send at least 4 bytes before expecting a reply.
+func NegotiateServer(legacy link.Protocol, features uint64, versions ...Version) link.Protocol {
+	return &negotiateProtocol{versions, features, legacy, true}
+}
+
+type negotiateProtocol struct {
+	versions []Version
+	features uint64
+	legacy   link.Protocol
+	server   bool
+}
+
+func (p *negotiateProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	var version Version
+	var features uint64
+	var err error
+	if p.server {
+		version, features, rw, err = p.accept(rw)
+	} else {
+		version, features, err = p.hello(rw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	base, err := version.Protocol.NewCodec(rw)
+	if err != nil {
+		return nil, err
+	}
+	codec := &negotiateCodec{base, version.Number, features}
+	if base, ok := base.(link.PacketCodec); ok {
+		return &negotiatePacketCodec{codec, base}, nil
+	}
+	return codec, nil
+}
+
+func (p *negotiateProtocol) hello(rw io.ReadWriter) (Version, uint64, error) {
+	hello := make([]byte, 0, len(negotiateMagic)+2+2*len(p.versions)+8)
+	hello = append(hello, negotiateMagic...)
+	hello = appendUint16(hello, uint16(len(p.versions)))
+	for _, v := range p.versions {
+		hello = appendUint16(hello, v.Number)
+	}
+	hello = append(hello, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(hello[len(hello)-8:], p.features)
+	if _, err := rw.Write(hello); err != nil {
+		return Version{}, 0, err
+	}
+
+	var reply [10]byte
+	if _, err := io.ReadFull(rw, reply[:]); err != nil {
+		return Version{}, 0, err
+	}
+	number := binary.BigEndian.Uint16(reply[:])
+	for _, v := range p.versions {
+		if number != 0 && v.Number == number {
+			return v, binary.BigEndian.Uint64(reply[2:]), nil
+		}
+	}
+	return Version{}, 0, ErrNoCommonVersion
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func (p *negotiateProtocol) accept(rw io.ReadWriter) (Version, uint64, io.ReadWriter, error) {
+	magic := make([]byte, len(negotiateMagic))
+	if _, err := io.ReadFull(rw, magic); err != nil {
+		return Version{}, 0, nil, err
+	}
+	if !bytes.Equal(magic, negotiateMagic) {
+		if p.legacy == nil {
+			return Version{}, 0, nil, ErrBadHello
+		}
+		replay := &replayReadWriter{io.MultiReader(bytes.NewReader(magic), rw), rw}
+		return Version{0, p.legacy}, 0, replay, nil
+	}
+
+	var head [2]byte
+	if _, err := io.ReadFull(rw, head[:]); err != nil {
+		return Version{}, 0, nil, err
+	}
+	body := make([]byte, 2*int(binary.BigEndian.Uint16(head[:]))+8)
+	if _, err := io.ReadFull(rw, body); err != nil {
+		return Version{}, 0, nil, err
+	}
+	features := p.features & binary.BigEndian.Uint64(body[len(body)-8:])
+
+	var version Version
+	for i := 0; i < len(body)-8; i += 2 {
+		number := binary.BigEndian.Uint16(body[i:])
+		for _, v := range p.versions {
+			if number != 0 && v.Number == number && v.Number > version.Number {
+				version = v
+			}
+		}
+	}
+
+	var reply [10]byte
+	binary.BigEndian.PutUint16(reply[:], version.Number)
+	binary.BigEndian.PutUint64(reply[2:], features)
+	if _, err := rw.Write(reply[:]); err != nil {
+		return Version{}, 0, nil, err
+	}
+	if version.Number == 0 {
+		return Version{}, 0, nil, ErrNoCommonVersion
+	}
+	return version, features, rw, nil
+}
+
+type replayReadWriter struct {
+	io.Reader
+	rw io.ReadWriter
+}
+
+func (r *replayReadWriter) Write(p []byte) (int, error) {
+	return r.rw.Write(p)
+}
+
+func (r *replayReadWriter) Close() error {
+	if closer, ok := r.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type negotiateCodec struct {
+	link.Codec
+	version  uint16
+	features uint64
+}
+
+func (c *negotiateCodec) Version() uint16 {
+	return c.version
+}
+
+func (c *negotiateCodec) Features() uint64 {
+	return c.features
+}
+
+type negotiatePacketCodec struct {
+	*negotiateCodec
+	base link.PacketCodec
+}
+
+func (c *negotiatePacketCodec) Packet(dst []byte, msg interface{}) ([]byte, error) {
+	return c.base.Packet(dst, msg)
+}
+
+func (c *negotiatePacketCodec) SendPacket(packet []byte) error {
+	return c.base.SendPacket(packet)
+}
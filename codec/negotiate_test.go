@@ -0,0 +1,86 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/funny/link"
+)
+
+func Test_Negotiate(t *testing.T) {
+	v1 := FixLen(Bytes(), 1, binary.BigEndian, 255, 255)
+	v2 := FixLen(Bytes(), 2, binary.BigEndian, 1024, 1024)
+	v3 := FixLen(Bytes(), 4, binary.BigEndian, 4096, 4096)
+	server := NegotiateServer(v1, 6, Version{2, v2}, Version{3, v3})
+
+	connect := func(client link.Protocol) (c1, c2 link.Codec, err1, err2 error) {
+		conn1, conn2 := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			c2, err2 = server.NewCodec(conn2)
+			if err2 != nil {
+				conn2.Close()
+			}
+			close(done)
+		}()
+		c1, err1 = client.NewCodec(conn1)
+		if err1 != nil {
+			conn1.Close()
+		}
+		<-done
+		return
+	}
+
+	check := func(c1, c2 link.Codec, version uint16, features uint64) {
+		for _, c := range []link.Codec{c1, c2} {
+			if n, ok := c.(Negotiated); !ok || n.Version() != version || n.Features() != features {
+				t.Fatalf("unexpected negotiation: %#v", c)
+			}
+		}
+		msg := []byte("hello link")
+		go c1.Send(msg)
+		recv, err := c2.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, recv.([]byte)) {
+			t.Fatal("message not match")
+		}
+		c1.Close()
+	}
+
+	c1, c2, err1, err2 := connect(NegotiateClient(3, Version{1, v1}, Version{2, v2}))
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if _, ok := c1.(link.PacketCodec); !ok {
+		t.Fatal("packet codec not passed through")
+	}
+	check(c1, c2, 2, 2)
+
+	_, _, err1, err2 = connect(NegotiateClient(0, Version{1, v1}))
+	if err1 != ErrNoCommonVersion || err2 != ErrNoCommonVersion {
+		t.Fatalf("unexpected error: %v, %v", err1, err2)
+	}
+
+	conn1, conn2 := net.Pipe()
+	legacy, _ := v1.NewCodec(conn1)
+	go legacy.Send([]byte("hello link"))
+	c2, err := server.NewCodec(conn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c2.(Negotiated); n.Version() != 0 || n.Features() != 0 {
+		t.Fatalf("unexpected negotiation: %d, %d", n.Version(), n.Features())
+	}
+	recv, err := c2.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recv.([]byte)) != "hello link" {
+		t.Fatalf("message not match: %q", recv)
+	}
+	c2.Close()
+}
@@ -0,0 +1,99 @@
+// Package protobuf provides a link protocol for protobuf messages. It
+// lives in its own package so the codec package does not depend on
+// protobuf.
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/funny/link"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var ErrUnregistered = errors.New("Unregistered Message Type")
+
+// Protocol sends protobuf messages prefixed with the 4 bytes big endian
+// id they were registered with. It reads a whole message from the
+// connection, so it's meant to be wrapped by a framing protocol such as
+// codec.FixLen.
+type Protocol struct {
+	types map[uint32]protoreflect.MessageType
+	ids   map[protoreflect.FullName]uint32
+}
+
+func New() *Protocol {
+	return &Protocol{
+		types: make(map[uint32]protoreflect.MessageType),
+		ids:   make(map[protoreflect.FullName]uint32),
+	}
+}
+
+// Register makes messages of the same type as msg be sent and received
+// with id. It must be called before any codec is created.
+func (p *Protocol) Register(id uint32, msg proto.Message) {
+	t := msg.ProtoReflect().Type()
+	p.types[id] = t
+	p.ids[t.Descriptor().FullName()] = id
+}
+
+func (p *Protocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	codec := &protobufCodec{p: p, rw: rw}
+	codec.closer, _ = rw.(io.Closer)
+	return codec, nil
+}
+
+type protobufCodec struct {
+	p      *Protocol
+	rw     io.ReadWriter
+	closer io.Closer
+	buf    []byte
+}
+
+func (c *protobufCodec) Receive() (interface{}, error) {
+	data, err := ioutil.ReadAll(c.rw)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	t, ok := c.p.types[binary.BigEndian.Uint32(data)]
+	if !ok {
+		return nil, ErrUnregistered
+	}
+	msg := t.New().Interface()
+	if err := proto.Unmarshal(data[4:], msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *protobufCodec) Send(msg interface{}) error {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return ErrUnregistered
+	}
+	id, ok := c.p.ids[m.ProtoReflect().Descriptor().FullName()]
+	if !ok {
+		return ErrUnregistered
+	}
+	buf := binary.BigEndian.AppendUint32(c.buf[:0], id)
+	buf, err := proto.MarshalOptions{}.MarshalAppend(buf, m)
+	if err != nil {
+		return err
+	}
+	c.buf = buf
+	_, err = c.rw.Write(buf)
+	return err
+}
+
+func (c *protobufCodec) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
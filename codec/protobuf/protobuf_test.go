@@ -0,0 +1,48 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/funny/link/codec"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func Test_Protobuf(t *testing.T) {
+	protobuf := New()
+	protobuf.Register(1, &wrapperspb.StringValue{})
+	protobuf.Register(2, &timestamppb.Timestamp{})
+
+	var stream bytes.Buffer
+	codec, _ := codec.FixLen(protobuf, 4, binary.BigEndian, 1024, 1024).NewCodec(&stream)
+
+	msgs := []proto.Message{
+		wrapperspb.String("hello"),
+		&timestamppb.Timestamp{Seconds: 123, Nanos: 456},
+		wrapperspb.String(""),
+	}
+	for _, msg := range msgs {
+		if err := codec.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range msgs {
+		recv, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(msg, recv.(proto.Message)) {
+			t.Fatalf("message not match: %v, %v", msg, recv)
+		}
+	}
+
+	if err := codec.Send(wrapperspb.Int32(1)); err != ErrUnregistered {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := codec.Send("hello"); err != ErrUnregistered {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
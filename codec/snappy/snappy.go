@@ -0,0 +1,129 @@
+// Package snappy provides a link protocol wrapper that compresses the
+// stream of another protocol with snappy. It lives in its own package so
+// the codec package does not depend on snappy.
+package snappy
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/funny/link"
+	"github.com/golang/snappy"
+)
+
+// Stats is implemented by the codecs of the protocol.
+type Stats interface {
+	// Ratio returns the number of bytes written to the connection divided
+	// by the number of bytes written by the wrapped protocol.
+	Ratio() float64
+}
+
+// New compresses everything base writes and flushes after every message,
+// so it can be stacked on top of any protocol.
+func New(base link.Protocol) link.Protocol {
+	return &snappyProtocol{base}
+}
+
+type snappyProtocol struct {
+	base link.Protocol
+}
+
+func (p *snappyProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &snappyCodec{}
+	codec.stream.w = snappy.NewBufferedWriter(&codec.stream.out)
+	codec.stream.out.w = rw
+	codec.stream.r = snappy.NewReader(rw)
+	codec.stream.c, _ = rw.(io.Closer)
+
+	codec.base, err = p.base.NewCodec(&codec.stream)
+	if err != nil {
+		return
+	}
+	if base, ok := codec.base.(link.PacketCodec); ok {
+		cc = &snappyPacketCodec{codec, base}
+		return
+	}
+	cc = codec
+	return
+}
+
+type countWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddUint64(&c.n, uint64(n))
+	return n, err
+}
+
+type snappyStream struct {
+	r   *snappy.Reader
+	w   *snappy.Writer
+	out countWriter
+	in  uint64
+	c   io.Closer
+}
+
+func (s *snappyStream) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+func (s *snappyStream) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	atomic.AddUint64(&s.in, uint64(n))
+	return n, err
+}
+
+type snappyCodec struct {
+	base   link.Codec
+	stream snappyStream
+}
+
+func (c *snappyCodec) Receive() (interface{}, error) {
+	return c.base.Receive()
+}
+
+func (c *snappyCodec) Send(msg interface{}) error {
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	return c.stream.w.Flush()
+}
+
+func (c *snappyCodec) Ratio() float64 {
+	in := atomic.LoadUint64(&c.stream.in)
+	if in == 0 {
+		return 1
+	}
+	return float64(atomic.LoadUint64(&c.stream.out.n)) / float64(in)
+}
+
+func (c *snappyCodec) Close() error {
+	err1 := c.base.Close()
+	var err2 error
+	if c.stream.c != nil {
+		err2 = c.stream.c.Close()
+	}
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+type snappyPacketCodec struct {
+	*snappyCodec
+	base link.PacketCodec
+}
+
+func (c *snappyPacketCodec) Packet(dst []byte, msg interface{}) ([]byte, error) {
+	return c.base.Packet(dst, msg)
+}
+
+func (c *snappyPacketCodec) SendPacket(packet []byte) error {
+	if err := c.base.SendPacket(packet); err != nil {
+		return err
+	}
+	return c.stream.w.Flush()
+}
@@ -0,0 +1,44 @@
+package snappy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+func Test_Snappy(t *testing.T) {
+	protocol := New(codec.FixLen(codec.Bytes(), 2, binary.LittleEndian, 64*1024, 64*1024))
+	c1, c2 := net.Pipe()
+	s1, _ := link.NewConnSession(c1, protocol, 0)
+	s2, _ := link.NewConnSession(c2, protocol, 0)
+	defer s1.Close()
+	defer s2.Close()
+
+	msgs := [][]byte{
+		bytes.Repeat([]byte("link"), 1000),
+		[]byte("short"),
+		bytes.Repeat([]byte("snappy"), 1000),
+	}
+	go func() {
+		s1.Send(msgs[0])
+		s1.Send(msgs[1])
+		s1.SendPacket(msgs[2])
+	}()
+	for _, msg := range msgs {
+		recv, err := s2.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, recv.([]byte)) {
+			t.Fatalf("message not match: %d bytes", len(msg))
+		}
+	}
+
+	if ratio := s1.Codec().(Stats).Ratio(); ratio <= 0 || ratio > 0.2 {
+		t.Fatalf("unexpected ratio: %f", ratio)
+	}
+}
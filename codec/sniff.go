@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/funny/link"
+)
+
+var ErrUnknownProtocol = errors.New("Unknown Protocol")
+
+// SniffProtocol picks the protocol of each connection by peeking at the
+// first bytes it receives, so clients of several protocols can share one
+// listener. The peeked bytes are still seen by the picked protocol.
+type SniffProtocol struct {
+	rules    []sniffRule
+	fallback link.Protocol
+}
+
+type sniffRule struct {
+	magic    []byte
+	protocol link.Protocol
+}
+
+// Sniff returns a SniffProtocol that uses fallback for connections no
+// registered magic matches, or fails them with ErrUnknownProtocol when
+// it's nil.
+func Sniff(fallback link.Protocol) *SniffProtocol {
+	return &SniffProtocol{fallback: fallback}
+}
+
+// Register makes connections that start with magic use protocol. Magics
+// are tried in the order they were registered. It must be called before
+// any codec is created.
+func (p *SniffProtocol) Register(magic []byte, protocol link.Protocol) {
+	p.rules = append(p.rules, sniffRule{magic, protocol})
+}
+
+func (p *SniffProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	var head []byte
+	buf := make([]byte, 64)
+	for {
+		protocol, more := p.match(head)
+		if !more {
+			if protocol == nil {
+				return nil, ErrUnknownProtocol
+			}
+			if len(head) > 0 {
+				rw = &replayReadWriter{io.MultiReader(bytes.NewReader(head), rw), rw}
+			}
+			return protocol.NewCodec(rw)
+		}
+		n, err := rw.Read(buf)
+		if n == 0 && err != nil {
+			return nil, err
+		}
+		head = append(head, buf[:n]...)
+	}
+}
+
+// match returns the protocol for a connection that started with head, or
+// more if it can't tell yet.
+func (p *SniffProtocol) match(head []byte) (protocol link.Protocol, more bool) {
+	for _, rule := range p.rules {
+		if len(head) < len(rule.magic) {
+			if bytes.HasPrefix(rule.magic, head) {
+				return nil, true
+			}
+			continue
+		}
+		if bytes.HasPrefix(head, rule.magic) {
+			return rule.protocol, false
+		}
+	}
+	return p.fallback, false
+}
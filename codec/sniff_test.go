@@ -0,0 +1,61 @@
+package codec
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_Sniff(t *testing.T) {
+	text := Delim(Bytes(), []byte("\n"), 1024)
+	binary := FixLen(Bytes(), 2, binary.LittleEndian, 1024, 1024)
+	protocol := Sniff(binary)
+	protocol.Register([]byte("HELLO "), text)
+
+	receive := func(protocol *SniffProtocol, writes ...string) (string, error) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go func() {
+			for _, w := range writes {
+				if _, err := c1.Write([]byte(w)); err != nil {
+					return
+				}
+			}
+		}()
+		codec, err := protocol.NewCodec(c2)
+		if err != nil {
+			return "", err
+		}
+		defer codec.Close()
+		msg, err := codec.Receive()
+		if err != nil {
+			return "", err
+		}
+		return string(msg.([]byte)), nil
+	}
+
+	for _, test := range []struct {
+		writes []string
+		msg    string
+	}{
+		{[]string{"HELLO link\n"}, "HELLO link"},
+		{[]string{"HEL", "LO", " link\n"}, "HELLO link"},
+		{[]string{"\x04\x00link"}, "link"},
+		{[]string{"H", "\x00" + strings.Repeat("x", 'H')}, strings.Repeat("x", 'H')},
+	} {
+		msg, err := receive(protocol, test.writes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != test.msg {
+			t.Fatalf("message not match: %q, %q", msg, test.msg)
+		}
+	}
+
+	strict := Sniff(nil)
+	strict.Register([]byte("HELLO "), text)
+	if _, err := receive(strict, "\x04\x00link"); err != ErrUnknownProtocol {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
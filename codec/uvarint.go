@@ -0,0 +1,120 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/funny/link"
+)
+
+// Uvarint frames the messages of base with a uvarint length head, as
+// protobuf's delimited format does. Frames longer than maxRecv or maxSend
+// are refused with ErrTooLargePacket, and heads longer than
+// binary.MaxVarintLen64 bytes with ErrBadHead.
+func Uvarint(base link.Protocol, maxRecv, maxSend int) link.Protocol {
+	return &uvarintProtocol{base, maxRecv, maxSend}
+}
+
+type uvarintProtocol struct {
+	base    link.Protocol
+	maxRecv int
+	maxSend int
+}
+
+func (p *uvarintProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &uvarintCodec{
+		rw:              rw,
+		uvarintProtocol: p,
+	}
+	codec.base, err = p.base.NewCodec(&codec.fixlenReadWriter)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+type uvarintCodec struct {
+	base link.Codec
+	head [binary.MaxVarintLen64]byte
+	rw   io.ReadWriter
+	*uvarintProtocol
+	fixlenReadWriter
+	recvBody
+
+	packetHead [binary.MaxVarintLen64]byte
+	packetBufs [2][]byte
+	packer
+}
+
+func (c *uvarintCodec) readHead() (int, error) {
+	var size uint64
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		if _, err := io.ReadFull(c.rw, c.head[:1]); err != nil {
+			return 0, err
+		}
+		b := c.head[0]
+		size |= uint64(b&0x7f) << (7 * uint(i))
+		if size > uint64(c.maxRecv) {
+			return 0, ErrTooLargePacket
+		}
+		if b < 0x80 {
+			return int(size), nil
+		}
+	}
+	return 0, ErrBadHead
+}
+
+func (c *uvarintCodec) Receive() (interface{}, error) {
+	size, err := c.readHead()
+	if err != nil {
+		return nil, err
+	}
+	buff := c.recvBody.get(size)
+	if _, err := io.ReadFull(c.rw, buff); err != nil {
+		return nil, err
+	}
+	c.recvBuf.Reset(buff)
+	return c.base.Receive()
+}
+
+func (c *uvarintCodec) Send(msg interface{}) error {
+	c.sendBuf.Reset()
+	c.sendBuf.Write(c.head[:])
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	buff := c.sendBuf.Bytes()
+	size := len(buff) - len(c.head)
+	if size > c.maxSend {
+		return ErrTooLargePacket
+	}
+	var head [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(head[:], uint64(size))
+	buff = buff[len(c.head)-n:]
+	copy(buff, head[:n])
+	_, err := c.rw.Write(buff)
+	return err
+}
+
+func (c *uvarintCodec) Packet(dst []byte, msg interface{}) ([]byte, error) {
+	return c.packer.packet(c.uvarintProtocol.base, dst, msg)
+}
+
+func (c *uvarintCodec) SendPacket(packet []byte) error {
+	if len(packet) > c.maxSend {
+		return ErrTooLargePacket
+	}
+	n := binary.PutUvarint(c.packetHead[:], uint64(len(packet)))
+	c.packetBufs = [2][]byte{c.packetHead[:n], packet}
+	err := link.WriteBuffers(c.rw, c.packetBufs[:]...)
+	c.packetBufs[1] = nil
+	return err
+}
+
+func (c *uvarintCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
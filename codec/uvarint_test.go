@@ -0,0 +1,50 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/funny/link"
+)
+
+func Test_Uvarint(t *testing.T) {
+	JsonTest(t, Uvarint(JsonTestProtocol(), 64*1024, 64*1024))
+
+	var stream bytes.Buffer
+	codec, _ := Uvarint(Bytes(), 1000, 1000).NewCodec(&stream)
+	for _, size := range []int{0, 1, 127, 128, 1000} {
+		msg := bytes.Repeat([]byte{'x'}, size)
+		if err := codec.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		if size == 1 && stream.Len() != 2 {
+			t.Fatalf("unexpected frame size: %d", stream.Len())
+		}
+		if err := codec.(link.PacketCodec).SendPacket(msg); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			recv, err := codec.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg, recv.([]byte)) {
+				t.Fatalf("message not match: %d", size)
+			}
+		}
+	}
+
+	if err := codec.Send(make([]byte, 1001)); err != ErrTooLargePacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stream.Write([]byte{0xe9, 0x07}) // 1001
+	if _, err := codec.Receive(); err != ErrTooLargePacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stream.Reset()
+	stream.Write(bytes.Repeat([]byte{0x80}, 100))
+	if _, err := codec.Receive(); err != ErrBadHead {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+// Package zstd provides a link protocol wrapper that compresses every
+// message of another protocol with zstd, optionally using dictionaries.
+// It lives in its own package so the codec package does not depend on
+// zstd.
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrBadDict = errors.New("Bad Dictionary")
+var ErrUnknownDict = errors.New("Unknown Dictionary")
+var ErrBadHeader = errors.New("Bad Header")
+
+const (
+	flagIds = 1 << iota
+	flagAck
+)
+
+// Dict is a raw content dictionary. Both sides must agree on the content
+// of a dictionary with a given ID. ID 0 means no dictionary.
+type Dict struct {
+	ID   uint32
+	Data []byte
+}
+
+// New compresses every message encoded by base. Messages are sent with
+// the last of dicts, which are pre-shared: the peer must know all of
+// them. Received messages that decompress to more than maxSize bytes fail
+// with codec.ErrTooLargePacket. It reads a whole message from the
+// connection, so it's meant to be wrapped by a framing protocol such as
+// codec.FixLen.
+func New(base link.Protocol, maxSize int, dicts ...Dict) link.Protocol {
+	return &zstdProtocol{base, maxSize, dicts, false}
+}
+
+// Negotiate is like New, but each side announces the IDs of its dicts in
+// the header of the messages it sends until the peer acknowledges them.
+// Messages are sent without a dictionary until the peer's IDs are known,
+// then with the last of dicts the peer also has.
+func Negotiate(base link.Protocol, maxSize int, dicts ...Dict) link.Protocol {
+	return &zstdProtocol{base, maxSize, dicts, true}
+}
+
+type zstdProtocol struct {
+	base      link.Protocol
+	maxSize   int
+	dicts     []Dict
+	negotiate bool
+}
+
+func (p *zstdProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	c := &zstdCodec{
+		rw:        rw,
+		encoders:  make(map[uint32]*zstd.Encoder),
+		dictIds:   make(map[uint32]bool),
+		negotiate: p.negotiate,
+	}
+	options := []zstd.DOption{
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(uint64(p.maxSize)),
+	}
+	for _, dict := range p.dicts {
+		if dict.ID == 0 || len(dict.Data) == 0 {
+			return nil, ErrBadDict
+		}
+		c.dictIds[dict.ID] = true
+		options = append(options, zstd.WithDecoderDictRaw(dict.ID, dict.Data))
+	}
+	c.decoder, err = zstd.NewReader(nil, options...)
+	if err != nil {
+		return
+	}
+	c.dicts = p.dicts
+	if !p.negotiate && len(p.dicts) > 0 {
+		c.sendDict = p.dicts[len(p.dicts)-1]
+	}
+	c.base, err = p.base.NewCodec(&c.buffer)
+	if err != nil {
+		return
+	}
+	cc = c
+	return
+}
+
+type buffer struct {
+	recvBuf bytes.Reader
+	sendBuf bytes.Buffer
+}
+
+func (b *buffer) Read(p []byte) (int, error) {
+	return b.recvBuf.Read(p)
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	return b.sendBuf.Write(p)
+}
+
+type zstdCodec struct {
+	base     link.Codec
+	rw       io.ReadWriter
+	buffer   buffer
+	decoder  *zstd.Decoder
+	plain    []byte
+	encoders map[uint32]*zstd.Encoder
+	frame    []byte
+	dicts    []Dict
+	dictIds  map[uint32]bool
+
+	mutex     sync.Mutex
+	sendDict  Dict
+	negotiate bool
+	gotIds    bool
+	acked     bool
+}
+
+func (c *zstdCodec) Receive() (interface{}, error) {
+	data, err := ioutil.ReadAll(c.rw)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.readHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	c.plain, err = c.decoder.DecodeAll(body, c.plain[:0])
+	if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+		return nil, codec.ErrTooLargePacket
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.buffer.recvBuf.Reset(c.plain)
+	return c.base.Receive()
+}
+
+func (c *zstdCodec) readHeader(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrBadHeader
+	}
+	flags := data[0]
+	data = data[1:]
+	id, n := binary.Uvarint(data)
+	if n <= 0 || id > 1<<32-1 {
+		return nil, ErrBadHeader
+	}
+	data = data[n:]
+	if id != 0 && !c.dictIds[uint32(id)] {
+		return nil, ErrUnknownDict
+	}
+	if flags&flagIds == 0 {
+		if flags&flagAck != 0 {
+			c.mutex.Lock()
+			c.acked = true
+			c.mutex.Unlock()
+		}
+		return data, nil
+	}
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return nil, ErrBadHeader
+	}
+	data = data[n:]
+	peerIds := make(map[uint32]bool, count)
+	for i := uint64(0); i < count; i++ {
+		id, n := binary.Uvarint(data)
+		if n <= 0 || id > 1<<32-1 {
+			return nil, ErrBadHeader
+		}
+		peerIds[uint32(id)] = true
+		data = data[n:]
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if flags&flagAck != 0 {
+		c.acked = true
+	}
+	if c.negotiate {
+		c.gotIds = true
+		c.sendDict = Dict{}
+		for i := len(c.dicts) - 1; i >= 0; i-- {
+			if peerIds[c.dicts[i].ID] {
+				c.sendDict = c.dicts[i]
+				break
+			}
+		}
+	}
+	return data, nil
+}
+
+func (c *zstdCodec) Send(msg interface{}) error {
+	c.buffer.sendBuf.Reset()
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	dict := c.sendDict
+	var flags byte
+	if c.negotiate && !c.acked {
+		flags |= flagIds
+	}
+	if c.gotIds {
+		flags |= flagAck
+	}
+	c.mutex.Unlock()
+
+	c.frame = append(c.frame[:0], flags)
+	c.frame = appendUvarint(c.frame, uint64(dict.ID))
+	if flags&flagIds != 0 {
+		c.frame = appendUvarint(c.frame, uint64(len(c.dicts)))
+		for _, d := range c.dicts {
+			c.frame = appendUvarint(c.frame, uint64(d.ID))
+		}
+	}
+
+	encoder, err := c.encoder(dict)
+	if err != nil {
+		return err
+	}
+	c.frame = encoder.EncodeAll(c.buffer.sendBuf.Bytes(), c.frame)
+	_, err = c.rw.Write(c.frame)
+	return err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (c *zstdCodec) encoder(dict Dict) (*zstd.Encoder, error) {
+	if encoder, ok := c.encoders[dict.ID]; ok {
+		return encoder, nil
+	}
+	options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if dict.ID != 0 {
+		options = append(options, zstd.WithEncoderDictRaw(dict.ID, dict.Data))
+	}
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	c.encoders[dict.ID] = encoder
+	return encoder, nil
+}
+
+func (c *zstdCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+type pipe struct {
+	io.Reader
+	io.Writer
+}
+
+func newPair(t *testing.T, p1, p2 link.Protocol) (c1, c2 link.Codec, b12, b21 *bytes.Buffer) {
+	b12, b21 = new(bytes.Buffer), new(bytes.Buffer)
+	c1, err := codec.FixLen(p1, 2, binary.LittleEndian, 1024, 1024).NewCodec(pipe{b21, b12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err = codec.FixLen(p2, 2, binary.LittleEndian, 1024, 1024).NewCodec(pipe{b12, b21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func exchange(t *testing.T, from, to link.Codec, stream *bytes.Buffer, msg []byte) (header []byte, size int) {
+	if err := from.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	size = stream.Len()
+	header = append(header, stream.Bytes()[2:4]...)
+	recv, err := to.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, recv.([]byte)) {
+		t.Fatal("message not match")
+	}
+	return
+}
+
+var testDict = []byte(`{"cmd":"chat","channel":"world","from":"player","text":""}`)
+
+func Test_Zstd(t *testing.T) {
+	msg := []byte(`{"cmd":"chat","channel":"world","from":"player","text":"hi"}`)
+
+	c1, c2, b12, _ := newPair(t, New(codec.Bytes(), 1024), New(codec.Bytes(), 1024))
+	_, plainSize := exchange(t, c1, c2, b12, msg)
+
+	dict := Dict{7, testDict}
+	c1, c2, b12, _ = newPair(t, New(codec.Bytes(), 1024, dict), New(codec.Bytes(), 1024, dict))
+	header, dictSize := exchange(t, c1, c2, b12, msg)
+	if header[0] != 0 || header[1] != 7 {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	if dictSize >= plainSize {
+		t.Fatalf("dictionary not used: %d >= %d", dictSize, plainSize)
+	}
+
+	c1, c2, b12, _ = newPair(t, New(codec.Bytes(), 1024, dict), New(codec.Bytes(), 1024))
+	c1.Send(msg)
+	if _, err := c2.Receive(); err != ErrUnknownDict {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c1, c2, b12, _ = newPair(t, New(codec.Bytes(), 10), New(codec.Bytes(), 10))
+	c1.Send(msg)
+	if _, err := c2.Receive(); err != codec.ErrTooLargePacket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := New(codec.Bytes(), 1024, Dict{0, testDict}).NewCodec(new(bytes.Buffer)); err != ErrBadDict {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func Test_Zstd_Negotiate(t *testing.T) {
+	msg := []byte(`{"cmd":"chat","channel":"world","from":"player","text":"hi"}`)
+	other := Dict{9, []byte("unrelated dictionary content")}
+	c1, c2, b12, b21 := newPair(t,
+		Negotiate(codec.Bytes(), 1024, Dict{7, testDict}, other),
+		Negotiate(codec.Bytes(), 1024, Dict{7, testDict}),
+	)
+
+	// c1 doesn't know c2's dictionaries yet.
+	header, _ := exchange(t, c1, c2, b12, msg)
+	if header[0] != flagIds || header[1] != 0 {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	// c2 acknowledges and uses the shared dictionary.
+	header, _ = exchange(t, c2, c1, b21, msg)
+	if header[0] != flagIds|flagAck || header[1] != 7 {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	// Both sides acknowledged, the IDs stop being sent.
+	header, _ = exchange(t, c1, c2, b12, msg)
+	if header[0] != flagAck || header[1] != 7 {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	header, _ = exchange(t, c2, c1, b21, msg)
+	if header[0] != flagAck || header[1] != 7 {
+		t.Fatalf("unexpected header: %v", header)
+	}
+}
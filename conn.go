@@ -0,0 +1,213 @@
+package link
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var SyscallConnUnsupportedError = errors.New("SyscallConn Unsupported")
+
+// sessionConn wraps the connection of a session so the session can tell
+// how many bytes have been written to it and limit its rates.
+type sessionConn struct {
+	net.Conn
+	written   uint64
+	read      uint64
+	sendLimit tokenBucket
+	recvLimit tokenBucket
+	closeChan chan int
+	clock     *atomic.Value
+	capture   atomic.Value
+
+	batching   int32
+	batchMutex sync.Mutex
+	batch      []byte
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.read, uint64(n))
+	if capture, _ := c.capture.Load().(*capture); capture != nil && n > 0 {
+		capture.record(false, b[:n])
+	}
+	c.wait(c.recvLimit.take(n, c.getClock()))
+	return n, err
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	if c.appendBatch(b) {
+		return len(b), nil
+	}
+	return c.write(b)
+}
+
+// WriteBuffers implements BuffersWriter. The buffers are still copied
+// while a batch accumulates, since they may be reused once it returns,
+// and when the connection is not a TCP or Unix socket, since datagram and
+// message based connections must get a whole packet in one Write.
+func (c *sessionConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	var size int
+	for _, b := range bufs {
+		size += len(b)
+	}
+	if c.appendBatch(bufs...) {
+		return int64(size), nil
+	}
+	switch c.Conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		joined := make([]byte, 0, size)
+		for _, b := range bufs {
+			joined = append(joined, b...)
+		}
+		n, err := c.write(joined)
+		return int64(n), err
+	}
+	var captured []byte
+	capture, _ := c.capture.Load().(*capture)
+	if capture != nil {
+		for _, b := range bufs {
+			captured = append(captured, b...)
+		}
+	}
+	c.wait(c.sendLimit.take(size, c.getClock()))
+	n, err := bufs.WriteTo(c.Conn)
+	atomic.AddUint64(&c.written, uint64(n))
+	if capture != nil && n > 0 {
+		capture.record(true, captured[:n])
+	}
+	return n, err
+}
+
+// appendBatch appends bufs to the batch and reports whether a batch is
+// accumulating.
+func (c *sessionConn) appendBatch(bufs ...[]byte) bool {
+	if atomic.LoadInt32(&c.batching) == 0 {
+		return false
+	}
+	c.batchMutex.Lock()
+	defer c.batchMutex.Unlock()
+	if atomic.LoadInt32(&c.batching) == 0 {
+		return false
+	}
+	for _, b := range bufs {
+		c.batch = append(c.batch, b...)
+	}
+	return true
+}
+
+func (c *sessionConn) write(b []byte) (int, error) {
+	c.wait(c.sendLimit.take(len(b), c.getClock()))
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	if capture, _ := c.capture.Load().(*capture); capture != nil && n > 0 {
+		capture.record(true, b[:n])
+	}
+	return n, err
+}
+
+// startBatch makes writes accumulate until flush.
+func (c *sessionConn) startBatch() {
+	c.batchMutex.Lock()
+	atomic.StoreInt32(&c.batching, 1)
+	c.batchMutex.Unlock()
+}
+
+func (c *sessionConn) isBatching() bool {
+	return atomic.LoadInt32(&c.batching) == 1
+}
+
+// flush writes the accumulated bytes at once and ends the batch.
+func (c *sessionConn) flush() error {
+	c.batchMutex.Lock()
+	defer c.batchMutex.Unlock()
+	atomic.StoreInt32(&c.batching, 0)
+	if len(c.batch) == 0 {
+		return nil
+	}
+	_, err := c.write(c.batch)
+	if cap(c.batch) > maxBatchBuffer {
+		c.batch = nil
+	} else {
+		c.batch = c.batch[:0]
+	}
+	return err
+}
+
+// getClock returns the clock of the session, or DefaultClock while the
+// codec is created.
+func (c *sessionConn) getClock() Clock {
+	if c.clock == nil {
+		return DefaultClock
+	}
+	return c.clock.Load().(clockHolder).Clock
+}
+
+// wait sleeps d unless the session gets closed.
+func (c *sessionConn) wait(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-c.getClock().After(d):
+	case <-c.closeChan:
+	}
+}
+
+func (c *sessionConn) Written() uint64 {
+	return atomic.LoadUint64(&c.written)
+}
+
+func (c *sessionConn) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.read)
+}
+
+// NewConnSession creates a session on a connection made by other means
+// than Dial, such as a websocket or a KCP connection. The connection is
+// closed when the codec can not be created.
+func NewConnSession(conn net.Conn, protocol Protocol, sendChanSize int) (*Session, error) {
+	return newConnSession(nil, conn, protocol, sendChanSize)
+}
+
+func newConnSession(manager *Manager, conn net.Conn, protocol Protocol, sendChanSize int) (*Session, error) {
+	sconn := &sessionConn{Conn: conn}
+	codec, err := protocol.NewCodec(sconn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if manager != nil {
+		return manager.newSession(sconn, codec, sendChanSize), nil
+	}
+	return newSession(nil, sconn, codec, sendChanSize), nil
+}
+
+// SyscallConn returns the raw connection underneath the session, looking
+// through wrappers like *tls.Conn that expose it with a NetConn method.
+// Its Control method gives access to the file descriptor for socket
+// options the net package does not cover, which are platform specific.
+func (session *Session) SyscallConn() (syscall.RawConn, error) {
+	conn := session.Conn()
+	for conn != nil {
+		if sc, ok := conn.(syscall.Conn); ok {
+			return sc.SyscallConn()
+		}
+		wrapper, ok := conn.(interface {
+			NetConn() net.Conn
+		})
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil, SyscallConnUnsupportedError
+}
+
+func isTemporary(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
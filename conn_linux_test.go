@@ -0,0 +1,48 @@
+package link
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/funny/utest"
+)
+
+func Test_SyscallConn(t *testing.T) {
+	server := EchoServer(t, 0)
+	defer server.Stop()
+	addr := server.Listener().Addr().String()
+
+	sockType := func(session *Session) int {
+		raw, err := session.SyscallConn()
+		utest.IsNilNow(t, err)
+		var value int
+		var optErr error
+		utest.IsNilNow(t, raw.Control(func(fd uintptr) {
+			value, optErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+		}))
+		utest.IsNilNow(t, optErr)
+		return value
+	}
+
+	session, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	utest.EqualNow(t, sockType(session), syscall.SOCK_STREAM)
+
+	conn, err := net.Dial("tcp", addr)
+	utest.IsNilNow(t, err)
+	tlsSession, err := newConnSession(nil, tls.Client(conn, &tls.Config{}), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer tlsSession.Close()
+	utest.EqualNow(t, sockType(tlsSession), syscall.SOCK_STREAM)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	pipeSession, err := newConnSession(nil, c1, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer pipeSession.Close()
+	_, err = pipeSession.SyscallConn()
+	utest.EqualNow(t, err, SyscallConnUnsupportedError)
+}
@@ -0,0 +1,110 @@
+package link
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type recvResult struct {
+	msg interface{}
+	err error
+}
+
+// ReceiveContext is like Receive but returns ctx.Err() when ctx is done
+// first. The session stays open: the message being received is returned
+// by the next Receive or ReceiveContext call.
+func (session *Session) ReceiveContext(ctx context.Context) (interface{}, error) {
+	session.pendingMutex.Lock()
+	pending := session.pendingRecv
+	if pending == nil {
+		pending = make(chan recvResult, 1)
+		session.pendingRecv = pending
+		go func() {
+			msg, err := session.receive()
+			pending <- recvResult{msg, err}
+		}()
+	}
+	session.pendingMutex.Unlock()
+
+	select {
+	case result := <-pending:
+		session.takePendingRecv()
+		return result.msg, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (session *Session) takePendingRecv() chan recvResult {
+	session.pendingMutex.Lock()
+	defer session.pendingMutex.Unlock()
+	pending := session.pendingRecv
+	session.pendingRecv = nil
+	return pending
+}
+
+// SendContext is like Send but gives up when ctx is done first, returning
+// ctx.Err(). An asynchronous session only waits when the queue is full
+// and the backpressure policy is BackpressureBlock. A synchronous session
+// interrupts the write through the connection's write deadline, which
+// closes the session since the peer may have got part of the message.
+// When the write completes anyway, the deadline of SetWriteDeadline or
+// SetWriteTimeout is set back.
+func (session *Session) SendContext(ctx context.Context, msg interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if session.sendChan != nil {
+		if err := session.checkClosing(); err != nil {
+			return err
+		}
+		msg, dropped, err := session.interceptSend(msg)
+		if dropped || err != nil {
+			return err
+		}
+		return session.sendAsyncContext(ctx, session.sendChan, msg)
+	}
+	if session.conn == nil || ctx.Done() == nil {
+		return session.Send(msg)
+	}
+	if err := session.checkClosing(); err != nil {
+		return err
+	}
+	msg, dropped, err := session.interceptSend(msg)
+	if dropped || err != nil {
+		return err
+	}
+	if session.IsClosed() {
+		return SessionClosedError
+	}
+	return session.sendSyncContext(ctx, msg)
+}
+
+// interruptWrite makes the write in progress fail once ctx is done, until
+// the returned function is called. That function reports whether the
+// write was interrupted, and then restores the write deadline. The caller
+// holds sendMutex, so no other write can be interrupted.
+func (session *Session) interruptWrite(ctx context.Context) func() bool {
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&session.interrupted, 1)
+			session.conn.SetWriteDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(stop)
+		if !<-interrupted {
+			return false
+		}
+		atomic.StoreInt32(&session.interrupted, 0)
+		session.restoreWriteDeadline()
+		return true
+	}
+}
@@ -0,0 +1,90 @@
+package link
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var DeadlineUnsupportedError = errors.New("Deadline Unsupported")
+
+// SetReadDeadline sets the read deadline of the session's connection, so a
+// blocked Receive fails with a timeout error and closes the session once
+// t has passed. A zero t clears it.
+func (session *Session) SetReadDeadline(t time.Time) error {
+	if session.conn == nil {
+		return DeadlineUnsupportedError
+	}
+	return session.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is like SetReadDeadline but for the writes of Send,
+// SendPacket and SendReader.
+func (session *Session) SetWriteDeadline(t time.Time) error {
+	if session.conn == nil {
+		return DeadlineUnsupportedError
+	}
+	var nsec int64
+	if !t.IsZero() {
+		nsec = t.UnixNano()
+	}
+	atomic.StoreInt64(&session.writeDeadline, nsec)
+	return session.setWriteDeadline(t)
+}
+
+// SetReadTimeout makes every Receive set the read deadline d from now
+// before reading, replacing the one set by SetReadDeadline. Zero disables
+// it.
+func (session *Session) SetReadTimeout(d time.Duration) error {
+	if session.conn == nil {
+		return DeadlineUnsupportedError
+	}
+	atomic.StoreInt64(&session.readTimeout, int64(d))
+	return nil
+}
+
+// SetWriteTimeout makes every write set the write deadline d from now,
+// replacing the one set by SetWriteDeadline. Zero disables it.
+func (session *Session) SetWriteTimeout(d time.Duration) error {
+	if session.conn == nil {
+		return DeadlineUnsupportedError
+	}
+	atomic.StoreInt64(&session.writeTimeout, int64(d))
+	return nil
+}
+
+func (session *Session) extendReadDeadline() {
+	if d := atomic.LoadInt64(&session.readTimeout); d > 0 {
+		session.conn.SetReadDeadline(time.Now().Add(time.Duration(d)))
+	}
+}
+
+func (session *Session) extendWriteDeadline() {
+	if d := atomic.LoadInt64(&session.writeTimeout); d > 0 {
+		session.setWriteDeadline(time.Now().Add(time.Duration(d)))
+	}
+}
+
+// restoreWriteDeadline sets back the write deadline of SetWriteTimeout or
+// SetWriteDeadline after SendContext interrupted a write.
+func (session *Session) restoreWriteDeadline() {
+	if atomic.LoadInt64(&session.writeTimeout) > 0 {
+		session.extendWriteDeadline()
+		return
+	}
+	var t time.Time
+	if nsec := atomic.LoadInt64(&session.writeDeadline); nsec != 0 {
+		t = time.Unix(0, nsec)
+	}
+	session.setWriteDeadline(t)
+}
+
+// setWriteDeadline sets t unless SendContext is interrupting a write, the
+// interrupt is set again after t so neither can undo the other.
+func (session *Session) setWriteDeadline(t time.Time) error {
+	err := session.conn.SetWriteDeadline(t)
+	if atomic.LoadInt32(&session.interrupted) == 1 {
+		session.conn.SetWriteDeadline(time.Unix(1, 0))
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package link
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var NoAddressError = errors.New("No Address")
+
+type BalancePolicy int32
+
+const (
+	// BalanceRoundRobin dials the addresses in turn.
+	BalanceRoundRobin BalancePolicy = iota
+	// BalanceRandom dials a random address.
+	BalanceRandom
+	// BalanceLeastConn dials the address with the fewest sessions open
+	// by the dialer.
+	BalanceLeastConn
+	// BalanceFailover dials the addresses in the given order, so the
+	// first one is used as long as it can be dialed, such as for an
+	// active and a standby server.
+	BalanceFailover
+)
+
+// Dialer dials sessions to one of several addresses. When dialing an
+// address fails the next ones are tried, in the order of the policy.
+type Dialer struct {
+	network      string
+	addresses    []string
+	protocol     Protocol
+	sendChanSize int
+	policy       int32
+	resolve      func() ([]string, error)
+	dial         DialFunc
+	maxFails     int
+	cooldown     time.Duration
+	manager      *Manager
+
+	mutex  sync.Mutex
+	next   uint32
+	conns  map[string]int
+	health map[string]*addressHealth
+}
+
+type addressHealth struct {
+	fails int
+	until time.Time
+}
+
+func NewDialer(network string, addresses []string, protocol Protocol, sendChanSize int) *Dialer {
+	return &Dialer{
+		network:      network,
+		addresses:    addresses,
+		protocol:     protocol,
+		sendChanSize: sendChanSize,
+		dial:         net.Dial,
+		conns:        make(map[string]int),
+		health:       make(map[string]*addressHealth),
+	}
+}
+
+// SetPolicy sets how the dialer picks an address, BalanceRoundRobin by
+// default.
+func (d *Dialer) SetPolicy(policy BalancePolicy) {
+	atomic.StoreInt32(&d.policy, int32(policy))
+}
+
+// SetResolver makes the dialer get the addresses from resolve on every
+// dial instead of using the ones given to NewDialer. It must be called
+// before Dial.
+func (d *Dialer) SetResolver(resolve func() ([]string, error)) {
+	d.resolve = resolve
+}
+
+// SetDialFunc makes the dialer dial connections with dial instead of
+// net.Dial. It must be called before Dial.
+func (d *Dialer) SetDialFunc(dial DialFunc) {
+	d.dial = dial
+}
+
+// SetManager makes the sessions dialed by the dialer managed by manager,
+// such as to gather their stats. It must be called before Dial.
+func (d *Dialer) SetManager(manager *Manager) {
+	d.manager = manager
+}
+
+// SetFailover makes the dialer mark an address unhealthy once dialing it
+// failed maxFails times in a row, and try it only after the healthy ones
+// during cooldown. Zero maxFails disables it. It must be called before
+// Dial.
+func (d *Dialer) SetFailover(maxFails int, cooldown time.Duration) {
+	d.maxFails = maxFails
+	d.cooldown = cooldown
+}
+
+// Dial dials a session to one of the addresses, it returns the error of
+// the last address tried when none could be dialed.
+func (d *Dialer) Dial() (*Session, error) {
+	addresses := d.addresses
+	if d.resolve != nil {
+		var err error
+		if addresses, err = d.resolve(); err != nil {
+			return nil, err
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, NoAddressError
+	}
+
+	err := NoAddressError
+	for _, address := range d.order(addresses) {
+		var conn net.Conn
+		if conn, err = d.dial(d.network, address); err != nil {
+			d.failed(address)
+			continue
+		}
+		var session *Session
+		if session, err = newConnSession(d.manager, conn, d.protocol, d.sendChanSize); err != nil {
+			continue
+		}
+		d.track(address, session)
+		d.succeeded(address)
+		return session, nil
+	}
+	return nil, err
+}
+
+// order returns the addresses in the order to try them.
+func (d *Dialer) order(addresses []string) []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	n := len(addresses)
+	policy := BalancePolicy(atomic.LoadInt32(&d.policy))
+	start := int(d.next % uint32(n))
+	d.next++
+	switch policy {
+	case BalanceRandom:
+		start = rand.Intn(n)
+	case BalanceFailover:
+		start = 0
+	}
+	ordered := make([]string, n)
+	for i := range ordered {
+		ordered[i] = addresses[(start+i)%n]
+	}
+	if policy == BalanceLeastConn {
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return d.conns[ordered[i]] < d.conns[ordered[j]]
+		})
+	}
+	if d.maxFails > 0 {
+		now := time.Now()
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return d.healthy(ordered[i], now) && !d.healthy(ordered[j], now)
+		})
+	}
+	return ordered
+}
+
+func (d *Dialer) healthy(address string, now time.Time) bool {
+	health, ok := d.health[address]
+	return !ok || health.fails < d.maxFails || now.After(health.until)
+}
+
+func (d *Dialer) failed(address string) {
+	if d.maxFails <= 0 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	health, ok := d.health[address]
+	if !ok {
+		health = &addressHealth{}
+		d.health[address] = health
+	}
+	if health.fails++; health.fails >= d.maxFails {
+		health.until = time.Now().Add(d.cooldown)
+	}
+}
+
+func (d *Dialer) succeeded(address string) {
+	if d.maxFails <= 0 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.health, address)
+}
+
+// track counts session as open to address until it's closed.
+func (d *Dialer) track(address string, session *Session) {
+	d.mutex.Lock()
+	d.conns[address]++
+	d.mutex.Unlock()
+	untrack := func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.conns[address]--; d.conns[address] == 0 {
+			delete(d.conns, address)
+		}
+	}
+	if token := session.AddCloseCallback(d, nil, untrack); token.callback == nil {
+		untrack()
+	}
+}
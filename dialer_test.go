@@ -0,0 +1,124 @@
+package link
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+func Test_Dialer(t *testing.T) {
+	var servers [3]*Server
+	var addresses []string
+	for i := range servers {
+		servers[i] = EchoServer(t, 0)
+		defer servers[i].Stop()
+		addresses = append(addresses, servers[i].Listener().Addr().String())
+	}
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	dead.Close()
+
+	dialer := NewDialer("tcp", append(addresses, dead.Addr().String()), ProtocolFunc(NewTestCodec), 0)
+	waitCounts := func(counts ...int) {
+		for i, server := range servers {
+			for server.SessionCount() != counts[i] {
+				runtime.Gosched()
+			}
+		}
+	}
+	waitConns := func(n int) {
+		for {
+			dialer.mutex.Lock()
+			var total int
+			for _, conns := range dialer.conns {
+				total += conns
+			}
+			dialer.mutex.Unlock()
+			if total == n {
+				return
+			}
+			runtime.Gosched()
+		}
+	}
+
+	var sessions []*Session
+	for i := 0; i < 4; i++ {
+		session, err := dialer.Dial()
+		utest.IsNilNow(t, err)
+		sessions = append(sessions, session)
+	}
+	waitCounts(2, 1, 1)
+
+	dialer.SetPolicy(BalanceLeastConn)
+	session, err := dialer.Dial()
+	utest.IsNilNow(t, err)
+	sessions = append(sessions, session)
+	waitCounts(2, 2, 1)
+	session, err = dialer.Dial()
+	utest.IsNilNow(t, err)
+	sessions = append(sessions, session)
+	waitCounts(2, 2, 2)
+	sessions[0].Close()
+	sessions[4].Close()
+	waitConns(4)
+	session, err = dialer.Dial()
+	utest.IsNilNow(t, err)
+	sessions = append(sessions, session)
+	waitCounts(2, 1, 2)
+
+	dialer.SetPolicy(BalanceRandom)
+	session, err = dialer.Dial()
+	utest.IsNilNow(t, err)
+	sessions = append(sessions, session)
+	for _, session := range sessions {
+		session.Close()
+	}
+
+	dialer.SetResolver(func() ([]string, error) {
+		return nil, nil
+	})
+	_, err = dialer.Dial()
+	utest.EqualNow(t, err, NoAddressError)
+}
+
+func Test_DialerFailover(t *testing.T) {
+	standby := EchoServer(t, 0)
+	defer standby.Stop()
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	active := lsn.Addr().String()
+	lsn.Close()
+
+	dialer := NewDialer("tcp", []string{active, standby.Listener().Addr().String()}, ProtocolFunc(NewTestCodec), 0)
+	dialer.SetPolicy(BalanceFailover)
+	dialer.SetFailover(2, 200*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		session, err := dialer.Dial()
+		utest.IsNilNow(t, err)
+		session.Close()
+	}
+	dialer.mutex.Lock()
+	fails := dialer.health[active].fails
+	dialer.mutex.Unlock()
+	utest.EqualNow(t, fails, 2)
+
+	server, err := Listen("tcp", active, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		session.Close()
+	}))
+	utest.IsNilNow(t, err)
+	go server.Serve()
+	defer server.Stop()
+	session, err := dialer.Dial()
+	utest.IsNilNow(t, err)
+	utest.Assert(t, session.Conn().RemoteAddr().String() != active)
+	session.Close()
+
+	time.Sleep(250 * time.Millisecond)
+	session, err = dialer.Dial()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, session.Conn().RemoteAddr().String(), active)
+	session.Close()
+}
@@ -0,0 +1,12 @@
+package link
+
+import "expvar"
+
+// PublishExpvar publishes the stats of manager with expvar under name, so
+// they show up on /debug/vars as a JSON object of ManagerStats. Like
+// expvar.Publish it panics when name is already used.
+func (manager *Manager) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return manager.Stats()
+	}))
+}
@@ -0,0 +1,46 @@
+package link
+
+import "bytes"
+
+// FrozenPacket is an encoded packet that can not be modified once it was
+// created. The same FrozenPacket may be sent to any number of sessions
+// using the protocol it was frozen with, from any number of goroutines.
+type FrozenPacket struct {
+	packet []byte
+}
+
+// FreezePacket encodes msg once with a codec of the given protocol, which
+// must implement PacketCodec.
+func FreezePacket(msg interface{}, protocol Protocol) (FrozenPacket, error) {
+	codec, err := protocol.NewCodec(new(bufferCloser))
+	if err != nil {
+		return FrozenPacket{}, err
+	}
+	packetCodec, ok := codec.(PacketCodec)
+	if !ok {
+		return FrozenPacket{}, PacketUnsupportedError
+	}
+	packet, err := packetCodec.Packet(nil, msg)
+	if err != nil {
+		return FrozenPacket{}, err
+	}
+	return FrozenPacket{packet}, nil
+}
+
+func (p FrozenPacket) Len() int {
+	return len(p.packet)
+}
+
+// SendFrozen sends a frozen packet. Nothing on the send path writes to
+// the packet: codecs only read it and SetBeforeWrite hooks get a copy.
+func (session *Session) SendFrozen(packet FrozenPacket) error {
+	return session.SendPacket(packet.packet)
+}
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package link
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var FutureTimeoutError = errors.New("Future Timeout")
+
+// Future is the result of an operation that completes later, such as a
+// send acknowledged once written or a remote call.
+type Future struct {
+	mutex     sync.Mutex
+	done      chan struct{}
+	value     interface{}
+	err       error
+	callbacks []func(interface{}, error)
+}
+
+func NewFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Complete sets the result of the future, it reports false and does
+// nothing when the future is already complete.
+func (f *Future) Complete(value interface{}, err error) bool {
+	f.mutex.Lock()
+	select {
+	case <-f.done:
+		f.mutex.Unlock()
+		return false
+	default:
+	}
+	f.value, f.err = value, err
+	close(f.done)
+	callbacks := f.callbacks
+	f.callbacks = nil
+	f.mutex.Unlock()
+	for _, callback := range callbacks {
+		callback(value, err)
+	}
+	return true
+}
+
+// Done returns a channel closed once the future is complete.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *Future) IsDone() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait waits for the future to complete and returns its result, or
+// FutureTimeoutError after timeout. Zero timeout waits forever.
+func (f *Future) Wait(timeout time.Duration) (interface{}, error) {
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-f.done:
+		case <-timer.C:
+			return nil, FutureTimeoutError
+		}
+	}
+	<-f.done
+	return f.value, f.err
+}
+
+// Then calls callback with the result once the future is complete, at
+// once when it already is.
+func (f *Future) Then(callback func(value interface{}, err error)) {
+	f.mutex.Lock()
+	select {
+	case <-f.done:
+		f.mutex.Unlock()
+		callback(f.value, f.err)
+	default:
+		f.callbacks = append(f.callbacks, callback)
+		f.mutex.Unlock()
+	}
+}
+
+// SendFuture is like SendCallback but returns a future completed with a
+// nil value once msg was written, or with the error that prevented it.
+func (session *Session) SendFuture(msg interface{}) *Future {
+	future := NewFuture()
+	err := session.SendCallback(msg, func(err error) {
+		future.Complete(nil, err)
+	})
+	if err != nil {
+		future.Complete(nil, err)
+	}
+	return future
+}
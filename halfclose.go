@@ -0,0 +1,68 @@
+package link
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var HalfCloseUnsupportedError = errors.New("Half Close Unsupported")
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type closeReader interface {
+	CloseRead() error
+}
+
+// CloseWrite shuts down the writing side of the session's connection, so
+// the peer reads EOF while the session can still receive its response.
+// New sends are refused with SessionClosingError, and the messages already
+// queued are written first. The connection must implement CloseWrite, as
+// TCP and Unix connections do.
+func (session *Session) CloseWrite() error {
+	if session.conn == nil {
+		return HalfCloseUnsupportedError
+	}
+	conn, ok := session.conn.Conn.(closeWriter)
+	if !ok {
+		return HalfCloseUnsupportedError
+	}
+	if session.IsClosed() {
+		return SessionClosedError
+	}
+	atomic.StoreInt32(&session.closing, 1)
+
+	if session.sendChan != nil {
+		done, err := session.queueFlush(nil)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-done:
+		case <-session.closeChan:
+			return SessionClosedError
+		}
+	}
+
+	session.sendMutex.Lock()
+	defer session.sendMutex.Unlock()
+	return conn.CloseWrite()
+}
+
+// CloseRead shuts down the reading side of the session's connection, so
+// Receive fails while the session can still send. The connection must
+// implement CloseRead, as TCP and Unix connections do.
+func (session *Session) CloseRead() error {
+	if session.conn == nil {
+		return HalfCloseUnsupportedError
+	}
+	conn, ok := session.conn.Conn.(closeReader)
+	if !ok {
+		return HalfCloseUnsupportedError
+	}
+	if session.IsClosed() {
+		return SessionClosedError
+	}
+	return conn.CloseRead()
+}
@@ -0,0 +1,35 @@
+package link
+
+import "sync/atomic"
+
+const sessionIdNamespaceBits = 48
+
+// SessionIds allocates session ids. Every id carries the namespace of its
+// allocator in the top 16 bits, so allocators with different namespaces
+// never hand out the same id and an id tells where the session came from.
+type SessionIds struct {
+	namespace uint64
+	counter   uint64
+}
+
+// DefaultSessionIds is used by Dial, NewSession and managers without their
+// own allocator.
+var DefaultSessionIds = NewSessionIds(0)
+
+func NewSessionIds(namespace uint16) *SessionIds {
+	return &SessionIds{namespace: uint64(namespace) << sessionIdNamespaceBits}
+}
+
+func (ids *SessionIds) next() uint64 {
+	return ids.namespace | atomic.AddUint64(&ids.counter, 1)&(1<<sessionIdNamespaceBits-1)
+}
+
+// Count returns how many ids were allocated so far.
+func (ids *SessionIds) Count() uint64 {
+	return atomic.LoadUint64(&ids.counter)
+}
+
+// SessionIdNamespace returns the namespace of the allocator that created id.
+func SessionIdNamespace(id uint64) uint16 {
+	return uint16(id >> sessionIdNamespaceBits)
+}
@@ -0,0 +1,26 @@
+// Package kcp runs link sessions over KCP, a reliable protocol on top of
+// UDP that trades bandwidth for lower latency.
+package kcp
+
+import (
+	"github.com/funny/link"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// Listen accepts KCP sessions on the UDP address. The returned server
+// works like one made by link.Listen.
+func Listen(address string, protocol link.Protocol, sendChanSize int, handler link.Handler) (*link.Server, error) {
+	listener, err := kcp.ListenWithOptions(address, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return link.NewServer(listener, protocol, sendChanSize, handler), nil
+}
+
+func Dial(address string, protocol link.Protocol, sendChanSize int) (*link.Session, error) {
+	conn, err := kcp.DialWithOptions(address, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return link.NewConnSession(conn, protocol, sendChanSize)
+}
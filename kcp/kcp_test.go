@@ -0,0 +1,52 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+func Test_KCP(t *testing.T) {
+	protocol := codec.FixLen(codec.Bytes(), 2, binary.LittleEndian, 4096, 4096)
+	closed := make(chan struct{})
+	server, err := Listen("127.0.0.1:0", protocol, 0, link.HandlerFunc(func(session *link.Session) {
+		session.AddCloseCallback(nil, nil, func() {
+			close(closed)
+		})
+		for {
+			msg, err := session.Receive()
+			if err != nil || session.Send(msg) != nil {
+				return
+			}
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	session, err := Dial(server.Listener().Addr().String(), protocol, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	for i := 0; i < 100; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, i*30+1)
+		if err := session.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		recv, err := session.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, recv.([]byte)) {
+			t.Fatalf("message %d not match", i)
+		}
+	}
+
+	server.Stop()
+	<-closed
+}
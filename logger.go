@@ -0,0 +1,40 @@
+package link
+
+// Logger receives the debug logs of sessions and servers: their
+// lifecycle, failed receives and sends and dropped messages. Keyvals
+// alternate keys and values, so a *slog.Logger is a Logger.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+}
+
+// DefaultLogger is used by new sessions, nil logs nothing. Replace it
+// before creating any session, it's not safe to change it concurrently.
+var DefaultLogger Logger
+
+type loggerHolder struct {
+	Logger
+}
+
+// SetLogger replaces the logger of the session, nil logs nothing.
+func (session *Session) SetLogger(logger Logger) {
+	session.logger.Store(loggerHolder{logger})
+}
+
+func (session *Session) debug(msg string, keyvals ...interface{}) {
+	logger := session.logger.Load().(loggerHolder).Logger
+	if logger != nil {
+		logger.Debug(msg, append([]interface{}{"session", session.id}, keyvals...)...)
+	}
+}
+
+// SetLogger sets the logger of the server and of the sessions it accepts,
+// nil logs nothing. It must be called before Serve.
+func (server *Server) SetLogger(logger Logger) {
+	server.logger = logger
+}
+
+func (server *Server) debug(msg string, keyvals ...interface{}) {
+	if server.logger != nil {
+		server.logger.Debug(msg, keyvals...)
+	}
+}
@@ -1,13 +1,49 @@
 package link
 
-import "sync"
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
 
 const sessionMapNum = 32
 
 type Manager struct {
-	sessionMaps [sessionMapNum]sessionMap
-	disposeOnce sync.Once
-	disposeWait sync.WaitGroup
+	sessionCount int64
+	ids          *SessionIds
+	queueBytes   int64
+	budget       *sendBudget
+	sessionMaps  [sessionMapNum]sessionMap
+	disposeOnce  sync.Once
+	disposeWait  sync.WaitGroup
+	statsMutex   sync.Mutex
+	closedStats  ManagerStats
+}
+
+// ManagerStats is a snapshot of the sessions of a manager. The traffic
+// counters add up the sessions closed already and the open ones.
+type ManagerStats struct {
+	SessionsOpened   uint64
+	SessionsClosed   uint64
+	SessionsOpen     int
+	BytesSent        uint64
+	BytesReceived    uint64
+	MessagesSent     uint64
+	MessagesReceived uint64
+	SendQueueLen     int
+	SendQueueBytes   int64
+	ReadErrors       uint64
+	SendErrors       uint64
+}
+
+func (stats *ManagerStats) add(session SessionStats) {
+	stats.BytesSent += session.BytesSent
+	stats.BytesReceived += session.BytesReceived
+	stats.MessagesSent += session.MessagesSent
+	stats.MessagesReceived += session.MessagesReceived
+	stats.SendQueueLen += session.SendQueueLen
+	stats.ReadErrors += session.ReadErrors
+	stats.SendErrors += session.SendErrors
 }
 
 type sessionMap struct {
@@ -17,7 +53,7 @@ type sessionMap struct {
 }
 
 func NewManager() *Manager {
-	manager := &Manager{}
+	manager := &Manager{ids: DefaultSessionIds}
 	for i := 0; i < len(manager.sessionMaps); i++ {
 		manager.sessionMaps[i].sessions = make(map[uint64]*Session)
 	}
@@ -39,8 +75,34 @@ func (manager *Manager) Dispose() {
 	})
 }
 
+// SetSessionIds makes the manager allocate the ids of its sessions from
+// ids. It must be called before the first session is created.
+func (manager *Manager) SetSessionIds(ids *SessionIds) {
+	manager.ids = ids
+}
+
+// SetSendQueueBytes sets the limit of Session.SetSendQueueBytes of the
+// sessions created from then on by the manager.
+func (manager *Manager) SetSendQueueBytes(max int) {
+	atomic.StoreInt64(&manager.queueBytes, int64(max))
+}
+
 func (manager *Manager) NewSession(codec Codec, sendChanSize int) *Session {
-	session := newSession(manager, codec, sendChanSize)
+	return manager.newSession(nil, codec, sendChanSize)
+}
+
+// NewConnSession is like the package level NewConnSession but the session
+// is managed by the manager.
+func (manager *Manager) NewConnSession(conn net.Conn, protocol Protocol, sendChanSize int) (*Session, error) {
+	return newConnSession(manager, conn, protocol, sendChanSize)
+}
+
+func (manager *Manager) newSession(conn *sessionConn, codec Codec, sendChanSize int) *Session {
+	session := newSession(manager, conn, codec, sendChanSize)
+	session.budget = manager.budget
+	if max := atomic.LoadInt64(&manager.queueBytes); max > 0 {
+		session.SetSendQueueBytes(int(max))
+	}
 	manager.putSession(session)
 	return session
 }
@@ -54,6 +116,67 @@ func (manager *Manager) GetSession(sessionID uint64) *Session {
 	return session
 }
 
+func (manager *Manager) SessionCount() int {
+	return int(atomic.LoadInt64(&manager.sessionCount))
+}
+
+// Sessions returns a snapshot of the sessions managed by the manager.
+func (manager *Manager) Sessions() []*Session {
+	sessions := make([]*Session, 0, manager.SessionCount())
+	for i := 0; i < sessionMapNum; i++ {
+		smap := &manager.sessionMaps[i]
+		smap.RLock()
+		for _, session := range smap.sessions {
+			sessions = append(sessions, session)
+		}
+		smap.RUnlock()
+	}
+	return sessions
+}
+
+// Range calls f for each session managed by the manager until f returns
+// false. Sessions created or closed meanwhile may or may not be visited,
+// and f may close sessions or create new ones.
+func (manager *Manager) Range(f func(session *Session) bool) {
+	var sessions []*Session
+	for i := 0; i < sessionMapNum; i++ {
+		smap := &manager.sessionMaps[i]
+		smap.RLock()
+		for _, session := range smap.sessions {
+			sessions = append(sessions, session)
+		}
+		smap.RUnlock()
+		for j, session := range sessions {
+			sessions[j] = nil
+			if !f(session) {
+				return
+			}
+		}
+		sessions = sessions[:0]
+	}
+}
+
+// Stats returns a snapshot of the sessions of the manager.
+func (manager *Manager) Stats() ManagerStats {
+	for i := 0; i < sessionMapNum; i++ {
+		manager.sessionMaps[i].RLock()
+		defer manager.sessionMaps[i].RUnlock()
+	}
+	manager.statsMutex.Lock()
+	stats := manager.closedStats
+	manager.statsMutex.Unlock()
+	for i := 0; i < sessionMapNum; i++ {
+		for _, session := range manager.sessionMaps[i].sessions {
+			sessionStats := session.Stats()
+			stats.add(sessionStats)
+			stats.SendQueueBytes += sessionStats.SendQueueBytes
+			stats.SessionsOpen++
+		}
+	}
+	stats.SessionsOpened += uint64(stats.SessionsOpen)
+	return stats
+}
+
 func (manager *Manager) putSession(session *Session) {
 	smap := &manager.sessionMaps[session.id%sessionMapNum]
 
@@ -66,6 +189,7 @@ func (manager *Manager) putSession(session *Session) {
 	}
 
 	smap.sessions[session.id] = session
+	atomic.AddInt64(&manager.sessionCount, 1)
 	manager.disposeWait.Add(1)
 }
 
@@ -75,6 +199,15 @@ func (manager *Manager) delSession(session *Session) {
 	smap.Lock()
 	defer smap.Unlock()
 
+	if smap.sessions[session.id] != session {
+		return
+	}
 	delete(smap.sessions, session.id)
+	manager.statsMutex.Lock()
+	manager.closedStats.SessionsOpened++
+	manager.closedStats.SessionsClosed++
+	manager.closedStats.add(session.Stats())
+	manager.statsMutex.Unlock()
+	atomic.AddInt64(&manager.sessionCount, -1)
 	manager.disposeWait.Done()
 }
@@ -0,0 +1,97 @@
+// Package metrics exports the stats of link sessions to Prometheus.
+package metrics
+
+import (
+	"time"
+
+	"github.com/funny/link"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects the stats of the sessions of a link.Manager, such as
+// the one of a server, from Server.Manager, or of a dialer, given to
+// Dialer.SetManager.
+type Collector struct {
+	manager *link.Manager
+
+	sessionsOpen     *prometheus.Desc
+	sessionsOpened   *prometheus.Desc
+	sessionsClosed   *prometheus.Desc
+	bytesSent        *prometheus.Desc
+	bytesReceived    *prometheus.Desc
+	messagesSent     *prometheus.Desc
+	messagesReceived *prometheus.Desc
+	sendQueueLen     *prometheus.Desc
+	sendQueueBytes   *prometheus.Desc
+	readErrors       *prometheus.Desc
+	sendErrors       *prometheus.Desc
+}
+
+// NewCollector returns a collector of the metrics of manager, named after
+// namespace and with labels, which tell the collectors of several
+// managers apart.
+func NewCollector(manager *link.Manager, namespace string, labels prometheus.Labels) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "link", name), help, nil, labels)
+	}
+	return &Collector{
+		manager:          manager,
+		sessionsOpen:     desc("sessions_open", "Sessions currently open."),
+		sessionsOpened:   desc("sessions_opened_total", "Sessions opened."),
+		sessionsClosed:   desc("sessions_closed_total", "Sessions closed."),
+		bytesSent:        desc("bytes_sent_total", "Bytes written to the connections."),
+		bytesReceived:    desc("bytes_received_total", "Bytes read from the connections."),
+		messagesSent:     desc("messages_sent_total", "Messages sent."),
+		messagesReceived: desc("messages_received_total", "Messages received."),
+		sendQueueLen:     desc("send_queue_length", "Messages queued to be sent."),
+		sendQueueBytes:   desc("send_queue_bytes", "Bytes queued to be sent."),
+		readErrors:       desc("read_errors_total", "Sessions closed by a read error."),
+		sendErrors:       desc("send_errors_total", "Sessions closed by a send error."),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sessionsOpen
+	ch <- c.sessionsOpened
+	ch <- c.sessionsClosed
+	ch <- c.bytesSent
+	ch <- c.bytesReceived
+	ch <- c.messagesSent
+	ch <- c.messagesReceived
+	ch <- c.sendQueueLen
+	ch <- c.sendQueueBytes
+	ch <- c.readErrors
+	ch <- c.sendErrors
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.manager.Stats()
+	gauge := func(desc *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v)
+	}
+	counter := func(desc *prometheus.Desc, v uint64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v))
+	}
+	gauge(c.sessionsOpen, float64(stats.SessionsOpen))
+	counter(c.sessionsOpened, stats.SessionsOpened)
+	counter(c.sessionsClosed, stats.SessionsClosed)
+	counter(c.bytesSent, stats.BytesSent)
+	counter(c.bytesReceived, stats.BytesReceived)
+	counter(c.messagesSent, stats.MessagesSent)
+	counter(c.messagesReceived, stats.MessagesReceived)
+	gauge(c.sendQueueLen, float64(stats.SendQueueLen))
+	gauge(c.sendQueueBytes, float64(stats.SendQueueBytes))
+	counter(c.readErrors, stats.ReadErrors)
+	counter(c.sendErrors, stats.SendErrors)
+}
+
+// ObserveBroadcasts returns a histogram of the seconds broadcasts take to
+// hand a message to every session, fed by link.SetBroadcastObserver,
+// which it replaces.
+func ObserveBroadcasts(opts prometheus.HistogramOpts) prometheus.Histogram {
+	histogram := prometheus.NewHistogram(opts)
+	link.SetBroadcastObserver(func(sessions int, d time.Duration) {
+		histogram.Observe(d.Seconds())
+	})
+	return histogram
+}
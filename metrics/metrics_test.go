@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func Test_Collector(t *testing.T) {
+	protocol := codec.FixLen(codec.Bytes(), 2, binary.BigEndian, 1024, 1024)
+	manager := link.NewManager()
+	defer manager.Dispose()
+	c1, c2 := net.Pipe()
+	s1, err := manager.NewConnSession(c1, protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := manager.NewConnSession(c2, protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan error)
+	go func() {
+		_, err := s2.Receive()
+		received <- err
+	}()
+	if err := s1.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	s1.Close()
+	for manager.Stats().SessionsClosed != 1 {
+		runtime.Gosched()
+	}
+
+	collector := NewCollector(manager, "test", prometheus.Labels{"server": "a"})
+	expected := `
+# HELP test_link_bytes_received_total Bytes read from the connections.
+# TYPE test_link_bytes_received_total counter
+test_link_bytes_received_total{server="a"} 7
+# HELP test_link_bytes_sent_total Bytes written to the connections.
+# TYPE test_link_bytes_sent_total counter
+test_link_bytes_sent_total{server="a"} 7
+# HELP test_link_sessions_closed_total Sessions closed.
+# TYPE test_link_sessions_closed_total counter
+test_link_sessions_closed_total{server="a"} 1
+# HELP test_link_sessions_open Sessions currently open.
+# TYPE test_link_sessions_open gauge
+test_link_sessions_open{server="a"} 1
+# HELP test_link_sessions_opened_total Sessions opened.
+# TYPE test_link_sessions_opened_total counter
+test_link_sessions_opened_total{server="a"} 2
+`
+	err = testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"test_link_bytes_received_total", "test_link_bytes_sent_total",
+		"test_link_sessions_closed_total", "test_link_sessions_open", "test_link_sessions_opened_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(collector); n != 11 {
+		t.Fatalf("%d metrics", n)
+	}
+}
+
+func Test_ObserveBroadcasts(t *testing.T) {
+	histogram := ObserveBroadcasts(prometheus.HistogramOpts{Name: "broadcast_seconds"})
+	defer link.SetBroadcastObserver(nil)
+	link.NewChannel().Broadcast([]byte("nobody"))
+	link.Broadcast([]byte("nobody"))
+
+	var metric dto.Metric
+	if err := histogram.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if n := metric.GetHistogram().GetSampleCount(); n != 2 {
+		t.Fatalf("%d samples", n)
+	}
+}
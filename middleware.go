@@ -0,0 +1,69 @@
+package link
+
+// Interceptor is called with every message a session receives or sends,
+// and returns the message to use instead. Returning a nil message drops
+// it.
+type Interceptor func(session *Session, msg interface{}) (interface{}, error)
+
+type interceptors struct {
+	recv []Interceptor
+	send []Interceptor
+}
+
+// AddRecvInterceptor appends interceptor to the ones called, in the order
+// they were added, with every message Receive returns. An error closes
+// the session like a read error does.
+func (session *Session) AddRecvInterceptor(interceptor Interceptor) {
+	session.addInterceptor(interceptor, true)
+}
+
+// AddSendInterceptor appends interceptor to the ones called, in the order
+// they were added, with every message given to Send and its variants, in
+// the caller's goroutine. An error is returned by the send call and
+// doesn't close the session, a dropped message is reported as sent.
+// Packets sent by SendPacket are not intercepted, see SetBeforeWrite, and
+// neither are broadcasts to sessions whose codec implements PacketCodec.
+func (session *Session) AddSendInterceptor(interceptor Interceptor) {
+	session.addInterceptor(interceptor, false)
+}
+
+func (session *Session) addInterceptor(interceptor Interceptor, recv bool) {
+	session.interceptorMutex.Lock()
+	defer session.interceptorMutex.Unlock()
+	old, _ := session.interceptors.Load().(interceptors)
+	chain := interceptors{
+		recv: append([]Interceptor(nil), old.recv...),
+		send: append([]Interceptor(nil), old.send...),
+	}
+	if recv {
+		chain.recv = append(chain.recv, interceptor)
+	} else {
+		chain.send = append(chain.send, interceptor)
+	}
+	session.interceptors.Store(chain)
+}
+
+func (session *Session) interceptRecv(msg interface{}) (interface{}, bool, error) {
+	chain, _ := session.interceptors.Load().(interceptors)
+	return session.intercept(chain.recv, msg)
+}
+
+func (session *Session) interceptSend(msg interface{}) (interface{}, bool, error) {
+	chain, _ := session.interceptors.Load().(interceptors)
+	return session.intercept(chain.send, msg)
+}
+
+// intercept returns dropped when an interceptor of chain drops msg, a nil
+// msg given to an empty chain isn't dropped.
+func (session *Session) intercept(chain []Interceptor, msg interface{}) (_ interface{}, dropped bool, err error) {
+	for _, interceptor := range chain {
+		if msg, err = interceptor(session, msg); err != nil {
+			return nil, false, err
+		}
+		if msg == nil {
+			session.debug("message dropped", "reason", "interceptor")
+			return nil, true, nil
+		}
+	}
+	return msg, false, nil
+}
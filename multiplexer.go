@@ -0,0 +1,94 @@
+package link
+
+import "sync"
+
+type SourcedMessage struct {
+	SessionID uint64
+	Msg       interface{}
+}
+
+// Multiplexer merges the messages received by a group of sessions into
+// a single channel. Sessions are removed automatically when closed.
+type Multiplexer struct {
+	mutex     sync.Mutex
+	sessions  map[uint64]*Session
+	recvChan  chan SourcedMessage
+	closeOnce sync.Once
+	closeChan chan int
+}
+
+func NewMultiplexer(recvChanSize int) *Multiplexer {
+	return &Multiplexer{
+		sessions:  make(map[uint64]*Session),
+		recvChan:  make(chan SourcedMessage, recvChanSize),
+		closeChan: make(chan int),
+	}
+}
+
+func (mux *Multiplexer) Receive() <-chan SourcedMessage {
+	return mux.recvChan
+}
+
+func (mux *Multiplexer) Len() int {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	return len(mux.sessions)
+}
+
+func (mux *Multiplexer) Add(session *Session) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+
+	if _, exists := mux.sessions[session.ID()]; exists {
+		return
+	}
+	select {
+	case <-mux.closeChan:
+		return
+	default:
+	}
+
+	mux.sessions[session.ID()] = session
+	session.AddCloseCallback(mux, nil, func() {
+		mux.remove(session)
+	})
+	if session.IsClosed() {
+		delete(mux.sessions, session.ID())
+		return
+	}
+	go mux.readLoop(session)
+}
+
+func (mux *Multiplexer) remove(session *Session) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	delete(mux.sessions, session.ID())
+}
+
+func (mux *Multiplexer) readLoop(session *Session) {
+	for {
+		msg, err := session.Receive()
+		if err != nil {
+			return
+		}
+		select {
+		case mux.recvChan <- SourcedMessage{session.ID(), msg}:
+		case <-mux.closeChan:
+			return
+		}
+	}
+}
+
+// Close stops forwarding messages. The added sessions are not closed.
+func (mux *Multiplexer) Close() {
+	mux.closeOnce.Do(func() {
+		close(mux.closeChan)
+
+		mux.mutex.Lock()
+		defer mux.mutex.Unlock()
+		for id, session := range mux.sessions {
+			session.RemoveCloseCallback(mux, nil)
+			delete(mux.sessions, id)
+		}
+	})
+}
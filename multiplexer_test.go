@@ -0,0 +1,45 @@
+package link
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/funny/utest"
+)
+
+func Test_Multiplexer(t *testing.T) {
+	mux := NewMultiplexer(10)
+	defer mux.Close()
+
+	var peers [2]*Session
+	var sessions [2]*Session
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		codec1, _ := NewTestCodec(c1)
+		codec2, _ := NewTestCodec(c2)
+		sessions[i] = NewSession(codec1, 0)
+		peers[i] = NewSession(codec2, 0)
+		mux.Add(sessions[i])
+	}
+	utest.EqualNow(t, mux.Len(), 2)
+
+	for i := 0; i < 2; i++ {
+		utest.IsNilNow(t, peers[i].Send([]byte{byte(i)}))
+	}
+
+	received := make(map[uint64]byte)
+	for i := 0; i < 2; i++ {
+		msg := <-mux.Receive()
+		received[msg.SessionID] = msg.Msg.([]byte)[0]
+	}
+	for i := 0; i < 2; i++ {
+		utest.EqualNow(t, received[sessions[i].ID()], byte(i))
+	}
+
+	peers[0].Close()
+	for mux.Len() != 1 {
+		runtime.Gosched()
+	}
+	peers[1].Close()
+}
@@ -0,0 +1,299 @@
+// Package mux carries many virtual sessions over one physical session,
+// so a gateway needs a single connection per backend. Every virtual
+// session has its own id, send queue and codec, and closing it closes
+// only its stream.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/funny/link"
+)
+
+var (
+	ErrClosed       = errors.New("Mux Closed")
+	ErrStreamClosed = errors.New("Stream Closed")
+	ErrBadFrame     = errors.New("Bad Frame")
+)
+
+const (
+	frameOpen byte = iota + 1
+	frameData
+	frameClose
+)
+
+// Backlog is how many streams opened by the peer can wait for Accept.
+const Backlog = 128
+
+// Mux runs the streams of a physical session whose codec sends and
+// receives []byte messages, such as codec.FixLen(codec.Bytes(), ...).
+// Every message is a frame of a uvarint stream id, a frame type and the
+// bytes written to the stream. The frames of all the streams are read by
+// one goroutine, so a virtual session that isn't read from holds up the
+// others once recvChanSize frames are waiting for it.
+type Mux struct {
+	session      *link.Session
+	protocol     link.Protocol
+	sendChanSize int
+	recvChanSize int
+	client       bool
+	manager      *link.Manager
+	mutex        sync.Mutex
+	nextID       uint64
+	streams      map[uint64]*stream
+	err          error
+	acceptChan   chan *link.Session
+	closeChan    chan struct{}
+}
+
+// New starts to read the frames of session. Virtual sessions get their
+// codec from protocol and their send channel size from sendChanSize, like
+// the sessions of a server. Exactly one side of session must be client, so
+// the stream ids chosen by the two sides don't collide.
+func New(session *link.Session, protocol link.Protocol, sendChanSize, recvChanSize int, client bool) *Mux {
+	mux := &Mux{
+		session:      session,
+		protocol:     protocol,
+		sendChanSize: sendChanSize,
+		recvChanSize: recvChanSize,
+		client:       client,
+		manager:      link.NewManager(),
+		streams:      make(map[uint64]*stream),
+		acceptChan:   make(chan *link.Session, Backlog),
+		closeChan:    make(chan struct{}),
+	}
+	if client {
+		mux.nextID = 1
+	} else {
+		mux.nextID = 2
+	}
+	go mux.readLoop()
+	return mux
+}
+
+// Session returns the physical session.
+func (mux *Mux) Session() *link.Session {
+	return mux.session
+}
+
+// Manager returns the manager of the virtual sessions.
+func (mux *Mux) Manager() *link.Manager {
+	return mux.manager
+}
+
+// Open opens a stream and returns its virtual session.
+func (mux *Mux) Open() (*link.Session, error) {
+	mux.mutex.Lock()
+	if mux.err != nil {
+		mux.mutex.Unlock()
+		return nil, mux.err
+	}
+	id := mux.nextID
+	mux.nextID += 2
+	s := mux.newStream(id)
+	mux.mutex.Unlock()
+
+	if err := mux.send(id, frameOpen, nil); err != nil {
+		mux.remove(id)
+		return nil, err
+	}
+	return mux.newSession(s)
+}
+
+// Accept waits for a stream opened by the peer and returns its virtual
+// session. A stream is rejected when Backlog streams are waiting already.
+func (mux *Mux) Accept() (*link.Session, error) {
+	select {
+	case session := <-mux.acceptChan:
+		return session, nil
+	case <-mux.closeChan:
+		return nil, ErrClosed
+	}
+}
+
+// Close closes the physical session and all the virtual sessions.
+func (mux *Mux) Close() error {
+	err := mux.session.Close()
+	<-mux.closeChan
+	mux.manager.Dispose()
+	return err
+}
+
+// newStream must be called with the mutex held.
+func (mux *Mux) newStream(id uint64) *stream {
+	s := &stream{
+		mux:       mux,
+		id:        id,
+		recvChan:  make(chan []byte, mux.recvChanSize),
+		closeChan: make(chan struct{}),
+	}
+	mux.streams[id] = s
+	return s
+}
+
+func (mux *Mux) newSession(s *stream) (*link.Session, error) {
+	codec, err := mux.protocol.NewCodec(s)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return mux.manager.NewSession(codec, mux.sendChanSize), nil
+}
+
+func (mux *Mux) remove(id uint64) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	delete(mux.streams, id)
+}
+
+func (mux *Mux) send(id uint64, kind byte, data []byte) error {
+	var head [binary.MaxVarintLen64 + 1]byte
+	n := binary.PutUvarint(head[:], id)
+	head[n] = kind
+	frame := make([]byte, n+1+len(data))
+	copy(frame[copy(frame, head[:n+1]):], data)
+	return mux.session.Send(frame)
+}
+
+func (mux *Mux) readLoop() {
+	var err error
+	for {
+		var msg interface{}
+		if msg, err = mux.session.Receive(); err != nil {
+			break
+		}
+		frame, ok := msg.([]byte)
+		if !ok {
+			err = link.NotBytesMessageError
+			break
+		}
+		id, n := binary.Uvarint(frame)
+		if n <= 0 || n >= len(frame) {
+			err = ErrBadFrame
+			break
+		}
+		if err = mux.dispatch(id, frame[n], frame[n+1:]); err != nil {
+			break
+		}
+	}
+	mux.session.Close()
+
+	mux.mutex.Lock()
+	mux.err = ErrClosed
+	streams := mux.streams
+	mux.streams = make(map[uint64]*stream)
+	mux.mutex.Unlock()
+	close(mux.closeChan)
+	for _, s := range streams {
+		s.remoteClose()
+	}
+}
+
+func (mux *Mux) dispatch(id uint64, kind byte, data []byte) error {
+	mux.mutex.Lock()
+	s := mux.streams[id]
+	mux.mutex.Unlock()
+
+	switch kind {
+	case frameOpen:
+		if s != nil || (id%2 == 1) == mux.client {
+			return ErrBadFrame
+		}
+		mux.mutex.Lock()
+		s = mux.newStream(id)
+		mux.mutex.Unlock()
+		session, err := mux.newSession(s)
+		if err != nil {
+			return nil
+		}
+		select {
+		case mux.acceptChan <- session:
+		default:
+			session.Close()
+		}
+	case frameData:
+		if s != nil {
+			select {
+			case s.recvChan <- data:
+			case <-s.closeChan:
+			}
+		}
+	case frameClose:
+		if s != nil {
+			mux.remove(id)
+			s.remoteClose()
+		}
+	default:
+		return ErrBadFrame
+	}
+	return nil
+}
+
+// stream is the connection of a virtual session, every Write is sent as
+// one data frame.
+type stream struct {
+	mux       *Mux
+	id        uint64
+	pending   []byte
+	recvChan  chan []byte
+	closeOnce sync.Once
+	closeChan chan struct{}
+	remote    bool
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		select {
+		case b, ok := <-s.recvChan:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.pending = b
+		case <-s.closeChan:
+			return 0, ErrStreamClosed
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	select {
+	case <-s.closeChan:
+		return 0, ErrStreamClosed
+	default:
+	}
+	if err := s.mux.send(s.id, frameData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *stream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+		s.mux.mutex.Lock()
+		remote := s.remote
+		if !remote {
+			delete(s.mux.streams, s.id)
+		}
+		s.mux.mutex.Unlock()
+		if !remote {
+			s.mux.send(s.id, frameClose, nil)
+		}
+	})
+	return nil
+}
+
+// remoteClose is called by the read loop once no more frames will come
+// for the stream, Read returns io.EOF after the frames received already.
+func (s *stream) remoteClose() {
+	s.mux.mutex.Lock()
+	s.remote = true
+	s.mux.mutex.Unlock()
+	close(s.recvChan)
+}
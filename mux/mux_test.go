@@ -0,0 +1,129 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+func newMuxes(t *testing.T) (*Mux, *Mux) {
+	protocol := codec.FixLen(codec.Bytes(), 2, binary.BigEndian, 1024, 1024)
+	s1, s2, err := link.Pipe(protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(s1, protocol, 0, 10, true), New(s2, protocol, 0, 10, false)
+}
+
+func Test_Mux(t *testing.T) {
+	client, server := newMuxes(t)
+	defer client.Close()
+	defer server.Close()
+
+	accepted := make(chan *link.Session, 3)
+	go func() {
+		for {
+			session, err := server.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- session
+			go func() {
+				for {
+					msg, err := session.Receive()
+					if err != nil {
+						return
+					}
+					if err := session.Send(msg); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	var sessions []*link.Session
+	for i := 0; i < 3; i++ {
+		session, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, session)
+	}
+	if sessions[0].ID() == sessions[1].ID() || client.Manager().SessionCount() != 3 {
+		t.Fatal("sessions not distinct")
+	}
+	for round := 0; round < 2; round++ {
+		for i, session := range sessions {
+			if err := session.Send([]byte(fmt.Sprint(i, round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, session := range sessions {
+			msg, err := session.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg.([]byte)) != fmt.Sprint(i, round) {
+				t.Fatalf("stream %d got %q", i, msg)
+			}
+		}
+	}
+
+	remote := <-accepted
+	sessions[0].Close()
+	if _, err := remote.Receive(); err == nil {
+		t.Fatal("stream not closed")
+	}
+	if err := sessions[1].Send([]byte("alive")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := sessions[1].Receive(); err != nil || string(msg.([]byte)) != "alive" {
+		t.Fatal(msg, err)
+	}
+}
+
+func Test_MuxClose(t *testing.T) {
+	client, server := newMuxes(t)
+	session, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	if _, err := session.Receive(); err == nil {
+		t.Fatal("virtual session not closed")
+	}
+	if _, err := remote.Receive(); err == nil {
+		t.Fatal("remote virtual session not closed")
+	}
+	if _, err := server.Accept(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err := client.Open(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	server.Close()
+}
+
+func Test_MuxBadFrame(t *testing.T) {
+	protocol := codec.FixLen(codec.Bytes(), 2, binary.BigEndian, 1024, 1024)
+	s1, s2, err := link.Pipe(protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(s2, protocol, 0, 10, false)
+	// The server opens even streams, a client can't open stream 2.
+	go s1.Send([]byte{2, frameOpen})
+	if _, err := server.Accept(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	s1.Close()
+}
@@ -0,0 +1,213 @@
+// Package noise runs a Noise protocol handshake, such as XX or IK, when a
+// link session is created and then encrypts everything the wrapped
+// protocol sends. It needs no PKI: each side is identified by its static
+// key, which RemoteStatic returns for authorization decisions.
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/funny/link"
+)
+
+var ErrNotNoise = errors.New("Not A Noise Session")
+
+const (
+	// MaxFrameSize is the largest frame the Noise specification allows.
+	MaxFrameSize = 65535
+	tagSize      = 16
+)
+
+// DefaultCipherSuite is used when the config has no cipher suite.
+var DefaultCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+// New runs the handshake described by config, typically with
+// noise.HandshakeXX or noise.HandshakeIK, when a codec is created, so the
+// client side's config must have Initiator set. The handshake fails if it
+// does not complete within timeout, when it's not zero and the connection
+// supports deadlines. Afterwards base's output is sent in encrypted frames
+// with a 2 bytes big endian length.
+func New(base link.Protocol, config noise.Config, timeout time.Duration) link.Protocol {
+	if config.CipherSuite == nil {
+		config.CipherSuite = DefaultCipherSuite
+	}
+	return &noiseProtocol{base, config, timeout}
+}
+
+// RemoteStatic returns the static public key the peer of session proved
+// during the handshake.
+func RemoteStatic(session *link.Session) ([]byte, error) {
+	codec, ok := session.Codec().(*noiseCodec)
+	if !ok {
+		return nil, ErrNotNoise
+	}
+	return codec.remoteStatic, nil
+}
+
+type noiseProtocol struct {
+	base    link.Protocol
+	config  noise.Config
+	timeout time.Duration
+}
+
+type deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+func (p *noiseProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
+	codec := &noiseCodec{rw: rw, sendFrame: make([]byte, 2, 64)}
+	codec.stream.codec = codec
+
+	if d, ok := rw.(deadliner); ok && p.timeout > 0 {
+		d.SetDeadline(time.Now().Add(p.timeout))
+		defer d.SetDeadline(time.Time{})
+	}
+	if err = codec.handshake(p.config); err != nil {
+		return
+	}
+
+	codec.base, err = p.base.NewCodec(&codec.stream)
+	if err != nil {
+		return
+	}
+	cc = codec
+	return
+}
+
+type noiseStream struct {
+	codec   *noiseCodec
+	plain   []byte
+	sendBuf []byte
+}
+
+func (s *noiseStream) Read(p []byte) (int, error) {
+	if len(s.plain) == 0 {
+		if err := s.codec.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *noiseStream) Write(p []byte) (int, error) {
+	s.sendBuf = append(s.sendBuf, p...)
+	return len(p), nil
+}
+
+type noiseCodec struct {
+	base         link.Codec
+	rw           io.ReadWriter
+	stream       noiseStream
+	encrypt      *noise.CipherState
+	decrypt      *noise.CipherState
+	remoteStatic []byte
+	head         [2]byte
+	recvFrame    []byte
+	recvPlain    []byte
+	sendFrame    []byte
+}
+
+func (c *noiseCodec) handshake(config noise.Config) error {
+	hs, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return err
+	}
+	var cs1, cs2 *noise.CipherState
+	for i := 0; cs1 == nil; i++ {
+		if (i%2 == 0) == config.Initiator {
+			c.sendFrame, cs1, cs2, err = hs.WriteMessage(c.sendFrame[:2], nil)
+			if err != nil {
+				return err
+			}
+			if err = c.writeFrame(c.sendFrame); err != nil {
+				return err
+			}
+		} else {
+			frame, err := c.readRaw()
+			if err != nil {
+				return err
+			}
+			if _, cs1, cs2, err = hs.ReadMessage(nil, frame); err != nil {
+				return err
+			}
+		}
+	}
+	if config.Initiator {
+		c.encrypt, c.decrypt = cs1, cs2
+	} else {
+		c.encrypt, c.decrypt = cs2, cs1
+	}
+	c.remoteStatic = hs.PeerStatic()
+	return nil
+}
+
+func (c *noiseCodec) writeFrame(frame []byte) error {
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	_, err := c.rw.Write(frame)
+	return err
+}
+
+func (c *noiseCodec) readRaw() ([]byte, error) {
+	if _, err := io.ReadFull(c.rw, c.head[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(c.head[:]))
+	if cap(c.recvFrame) < size {
+		c.recvFrame = make([]byte, size)
+	}
+	frame := c.recvFrame[:size]
+	_, err := io.ReadFull(c.rw, frame)
+	return frame, err
+}
+
+func (c *noiseCodec) readFrame() error {
+	frame, err := c.readRaw()
+	if err != nil {
+		return err
+	}
+	c.recvPlain, err = c.decrypt.Decrypt(c.recvPlain[:0], nil, frame)
+	c.stream.plain = c.recvPlain
+	return err
+}
+
+func (c *noiseCodec) Receive() (interface{}, error) {
+	return c.base.Receive()
+}
+
+func (c *noiseCodec) Send(msg interface{}) error {
+	c.stream.sendBuf = c.stream.sendBuf[:0]
+	if err := c.base.Send(msg); err != nil {
+		return err
+	}
+	plain := c.stream.sendBuf
+	maxPlain := MaxFrameSize - tagSize
+	for len(plain) > 0 {
+		n := len(plain)
+		if n > maxPlain {
+			n = maxPlain
+		}
+		var err error
+		c.sendFrame, err = c.encrypt.Encrypt(c.sendFrame[:2], nil, plain[:n])
+		if err != nil {
+			return err
+		}
+		if err = c.writeFrame(c.sendFrame); err != nil {
+			return err
+		}
+		plain = plain[n:]
+	}
+	return nil
+}
+
+func (c *noiseCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+func newSessions(t *testing.T, client, server noise.Config) (*link.Session, *link.Session, error) {
+	base := codec.FixLen(codec.Bytes(), 4, binary.BigEndian, 1<<20, 1<<20)
+	c1, c2 := net.Pipe()
+	done := make(chan *link.Session, 1)
+	go func() {
+		session, err := link.NewConnSession(c2, New(base, server, time.Second), 0)
+		if err != nil {
+			c1.Close()
+		}
+		done <- session
+	}()
+	s1, err := link.NewConnSession(c1, New(base, client, time.Second), 0)
+	s2 := <-done
+	if err != nil {
+		if s2 != nil {
+			s2.Close()
+		}
+		return nil, nil, err
+	}
+	return s1, s2, nil
+}
+
+func generateKeypair(t *testing.T) noise.DHKey {
+	key, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testSessions(t *testing.T, s1, s2 *link.Session, key1, key2 noise.DHKey) {
+	if remote, _ := RemoteStatic(s1); !bytes.Equal(remote, key2.Public) {
+		t.Fatal("server static key not match")
+	}
+	if remote, _ := RemoteStatic(s2); !bytes.Equal(remote, key1.Public) {
+		t.Fatal("client static key not match")
+	}
+	for _, msg := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("link"), 50000)} {
+		go s1.Send(msg)
+		recv, err := s2.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, recv.([]byte)) {
+			t.Fatal("message not match")
+		}
+	}
+}
+
+func Test_NoiseXX(t *testing.T) {
+	key1, key2 := generateKeypair(t), generateKeypair(t)
+	s1, s2, err := newSessions(t,
+		noise.Config{Pattern: noise.HandshakeXX, Initiator: true, StaticKeypair: key1},
+		noise.Config{Pattern: noise.HandshakeXX, StaticKeypair: key2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+	testSessions(t, s1, s2, key1, key2)
+}
+
+func Test_NoiseIK(t *testing.T) {
+	key1, key2 := generateKeypair(t), generateKeypair(t)
+	s1, s2, err := newSessions(t,
+		noise.Config{Pattern: noise.HandshakeIK, Initiator: true, StaticKeypair: key1, PeerStatic: key2.Public},
+		noise.Config{Pattern: noise.HandshakeIK, StaticKeypair: key2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+	testSessions(t, s1, s2, key1, key2)
+
+	_, _, err = newSessions(t,
+		noise.Config{Pattern: noise.HandshakeIK, Initiator: true, StaticKeypair: key1, PeerStatic: generateKeypair(t).Public},
+		noise.Config{Pattern: noise.HandshakeIK, StaticKeypair: key2},
+	)
+	if err == nil {
+		t.Fatal("handshake with wrong server key succeeded")
+	}
+}
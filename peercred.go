@@ -0,0 +1,13 @@
+package link
+
+import "errors"
+
+var NotUnixConnError = errors.New("Not Unix Conn")
+
+// Ucred holds the credentials of the process on the other end of a unix
+// socket, as returned by Session.PeerCredentials.
+type Ucred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
@@ -0,0 +1,31 @@
+package link
+
+import (
+	"net"
+	"syscall"
+)
+
+// PeerCredentials returns the credentials of the process on the other end
+// of a unix socket session.
+func (session *Session) PeerCredentials() (*Ucred, error) {
+	conn, ok := session.Conn().(*net.UnixConn)
+	if !ok {
+		return nil, NotUnixConnError
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &Ucred{cred.Pid, cred.Uid, cred.Gid}, nil
+}
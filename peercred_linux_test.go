@@ -0,0 +1,40 @@
+package link
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/funny/utest"
+)
+
+func Test_PeerCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "link")
+	utest.IsNilNow(t, err)
+	defer os.RemoveAll(dir)
+
+	uids := make(chan uint32, 1)
+	server, err := Listen("unix", filepath.Join(dir, "test.sock"), ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		cred, err := session.PeerCredentials()
+		utest.IsNilNow(t, err)
+		uids <- cred.Uid
+	}))
+	utest.IsNilNow(t, err)
+	go server.Serve()
+	defer server.Stop()
+
+	session, err := Dial("unix", server.Listener().Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	utest.EqualNow(t, <-uids, uint32(os.Getuid()))
+
+	tcpServer := EchoServer(t, 0)
+	defer tcpServer.Stop()
+	tcpSession, err := Dial("tcp", tcpServer.Listener().Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer tcpSession.Close()
+	_, err = tcpSession.PeerCredentials()
+	utest.EqualNow(t, err, NotUnixConnError)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package link
+
+import "errors"
+
+var PeerCredentialsUnsupportedError = errors.New("Peer Credentials Unsupported")
+
+// PeerCredentials is only supported on linux.
+func (session *Session) PeerCredentials() (*Ucred, error) {
+	return nil, PeerCredentialsUnsupportedError
+}
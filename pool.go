@@ -0,0 +1,197 @@
+package link
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var PoolExhaustedError = errors.New("Pool Exhausted")
+
+type PoolPolicy int32
+
+const (
+	// PoolRoundRobin hands the sessions out in turn.
+	PoolRoundRobin PoolPolicy = iota
+	// PoolLeastLoaded hands out the session with the fewest queued
+	// messages, the first one when they tie.
+	PoolLeastLoaded
+)
+
+// Pool keeps a fixed number of sessions to one address. A session that
+// closes is dialed again in the background, waiting as told by backoff
+// between failed attempts, and is skipped meanwhile.
+type Pool struct {
+	network      string
+	address      string
+	protocol     Protocol
+	sendChanSize int
+	backoff      Backoff
+	policy       int32
+
+	mutex     sync.Mutex
+	sessions  []*Session
+	next      uint32
+	closeFlag int32
+	closeChan chan int
+}
+
+// DialPool dials size sessions to address, it fails when any of them
+// can't be dialed.
+func DialPool(network, address string, protocol Protocol, sendChanSize, size int, backoff Backoff) (*Pool, error) {
+	pool := &Pool{
+		network:      network,
+		address:      address,
+		protocol:     protocol,
+		sendChanSize: sendChanSize,
+		backoff:      backoff,
+		sessions:     make([]*Session, size),
+		closeChan:    make(chan int),
+	}
+	for i := range pool.sessions {
+		session, err := Dial(network, address, protocol, sendChanSize)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		pool.sessions[i] = session
+	}
+	for i, session := range pool.sessions {
+		go pool.keep(i, session)
+	}
+	return pool, nil
+}
+
+// SetPolicy sets how Get picks a session, PoolRoundRobin by default.
+func (pool *Pool) SetPolicy(policy PoolPolicy) {
+	atomic.StoreInt32(&pool.policy, int32(policy))
+}
+
+// Get returns one of the sessions that are up, it fails with
+// PoolExhaustedError when none is.
+func (pool *Pool) Get() (*Session, error) {
+	if pool.IsClosed() {
+		return nil, SessionClosedError
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	n := len(pool.sessions)
+	if PoolPolicy(atomic.LoadInt32(&pool.policy)) == PoolLeastLoaded {
+		var best *Session
+		for _, session := range pool.sessions {
+			if session == nil || session.IsClosed() {
+				continue
+			}
+			if best == nil || session.queueLen() < best.queueLen() {
+				best = session
+			}
+		}
+		if best == nil {
+			return nil, PoolExhaustedError
+		}
+		return best, nil
+	}
+	for i := 0; i < n; i++ {
+		session := pool.sessions[pool.next%uint32(n)]
+		pool.next++
+		if session != nil && !session.IsClosed() {
+			return session, nil
+		}
+	}
+	return nil, PoolExhaustedError
+}
+
+// Sessions returns a snapshot of the sessions that are up.
+func (pool *Pool) Sessions() []*Session {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	sessions := make([]*Session, 0, len(pool.sessions))
+	for _, session := range pool.sessions {
+		if session != nil && !session.IsClosed() {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// Send sends msg on a session given by Get.
+func (pool *Pool) Send(msg interface{}) error {
+	session, err := pool.Get()
+	if err != nil {
+		return err
+	}
+	return session.Send(msg)
+}
+
+// SendPacket sends packet on a session given by Get.
+func (pool *Pool) SendPacket(packet []byte) error {
+	session, err := pool.Get()
+	if err != nil {
+		return err
+	}
+	return session.SendPacket(packet)
+}
+
+func (pool *Pool) IsClosed() bool {
+	return atomic.LoadInt32(&pool.closeFlag) == 1
+}
+
+// Close closes the pool and all its sessions.
+func (pool *Pool) Close() error {
+	if !atomic.CompareAndSwapInt32(&pool.closeFlag, 0, 1) {
+		return SessionClosedError
+	}
+	close(pool.closeChan)
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, session := range pool.sessions {
+		if session != nil {
+			session.Close()
+		}
+	}
+	return nil
+}
+
+// keep dials the i-th session again whenever it closes, until the pool
+// is closed.
+func (pool *Pool) keep(i int, session *Session) {
+	for {
+		select {
+		case <-session.closeChan:
+		case <-pool.closeChan:
+			return
+		}
+		pool.setSession(i, nil)
+		if session = pool.connect(); session == nil {
+			return
+		}
+		pool.setSession(i, session)
+		if pool.IsClosed() {
+			session.Close()
+			return
+		}
+	}
+}
+
+func (pool *Pool) setSession(i int, session *Session) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.sessions[i] = session
+}
+
+// connect dials until it succeeds, it returns nil when the pool was
+// closed meanwhile.
+func (pool *Pool) connect() *Session {
+	for attempt := 1; ; attempt++ {
+		session, err := Dial(pool.network, pool.address, pool.protocol, pool.sendChanSize)
+		if err == nil {
+			return session
+		}
+		select {
+		case <-time.After(pool.backoff(attempt)):
+		case <-pool.closeChan:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package link
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+func Test_Pool(t *testing.T) {
+	server := EchoServer(t, 0)
+	defer server.Stop()
+
+	pool, err := DialPool("tcp", server.Listener().Addr().String(), ProtocolFunc(NewTestCodec), 10, 3, ConstantBackoff(10*time.Millisecond))
+	utest.IsNilNow(t, err)
+	defer pool.Close()
+
+	var got [4]*Session
+	for i := range got {
+		got[i], err = pool.Get()
+		utest.IsNilNow(t, err)
+	}
+	utest.Assert(t, got[0] != got[1] && got[1] != got[2] && got[0] != got[2])
+	utest.Assert(t, got[3] == got[0])
+
+	for i := 0; i < 3; i++ {
+		utest.IsNilNow(t, pool.Send([]byte("hello")))
+	}
+	for _, session := range got[:3] {
+		msg, err := session.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "hello")
+	}
+
+	got[0].Close()
+	for i := 0; i < 3; i++ {
+		session, err := pool.Get()
+		utest.IsNilNow(t, err)
+		utest.Assert(t, session != got[0])
+	}
+	for {
+		sessions := pool.Sessions()
+		if len(sessions) == 3 && sessions[0] != got[0] {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	pool.SetPolicy(PoolLeastLoaded)
+	session, err := pool.Get()
+	utest.IsNilNow(t, err)
+	utest.Assert(t, !session.IsClosed())
+
+	pool.Close()
+	_, err = pool.Get()
+	utest.EqualNow(t, err, SessionClosedError)
+	for _, session := range got[1:3] {
+		utest.Assert(t, session.IsClosed())
+	}
+}
@@ -0,0 +1,87 @@
+package link
+
+// Priority selects the lane an asynchronous session queues a message on.
+// The send goroutine always writes the queued messages of a higher
+// priority lane first. Every lane holds up to sendChanSize messages.
+type Priority int
+
+const (
+	PriorityControl Priority = iota
+	PriorityNormal
+	PriorityBulk
+)
+
+// SendPriority is like Send but queues msg on the lane of priority, so
+// control messages aren't stuck behind a backlog of bulk ones. Send uses
+// PriorityNormal. Synchronous sessions write at once whatever the
+// priority.
+func (session *Session) SendPriority(msg interface{}, priority Priority) error {
+	if session.sendChan == nil || priority == PriorityNormal {
+		return session.Send(msg)
+	}
+	if err := session.checkClosing(); err != nil {
+		return err
+	}
+	msg, dropped, err := session.interceptSend(msg)
+	if dropped || err != nil {
+		return err
+	}
+	if priority == PriorityControl {
+		return session.sendAsync(session.controlChan, msg)
+	}
+	return session.sendAsync(session.bulkChan, msg)
+}
+
+// nextMsg waits for the next message to send, it returns false once the
+// session is closed.
+func (session *Session) nextMsg() (msg interface{}, ok bool) {
+	if session.mpsc != nil {
+		return session.nextQueued(session.mpsc)
+	}
+	control, normal, bulk := session.controlChan, session.sendChan, session.bulkChan
+	select {
+	case msg, ok = <-control:
+		return
+	default:
+	}
+	select {
+	case msg, ok = <-control:
+		return
+	case msg, ok = <-normal:
+		return
+	default:
+	}
+	select {
+	case msg, ok = <-control:
+	case msg, ok = <-normal:
+	case msg, ok = <-bulk:
+	case <-session.closeChan:
+	}
+	return
+}
+
+// pollMsg returns the next queued message without waiting, it returns
+// false when there is none.
+func (session *Session) pollMsg() (msg interface{}, ok bool) {
+	select {
+	case msg, ok = <-session.controlChan:
+		return
+	default:
+	}
+	if session.mpsc != nil {
+		if msg, ok = session.mpsc.pop(); ok {
+			return
+		}
+	} else {
+		select {
+		case msg, ok = <-session.sendChan:
+			return
+		default:
+		}
+	}
+	select {
+	case msg, ok = <-session.bulkChan:
+	default:
+	}
+	return
+}
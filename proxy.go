@@ -0,0 +1,161 @@
+package link
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var ProxySchemeError = errors.New("Unsupported Proxy Scheme")
+var ProxyRefusedError = errors.New("Proxy Refused")
+
+// DialProxy is like Dial but connects through the proxy at proxyURL. The
+// "socks5" and "http" schemes are supported, credentials are taken from
+// the URL's user info.
+func DialProxy(network, address string, proxyURL *url.URL, protocol Protocol, sendChanSize int) (*Session, error) {
+	conn, err := net.Dial(network, proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, address, proxyURL.User)
+	case "http":
+		err = httpConnect(conn, address, proxyURL.User)
+	default:
+		err = ProxySchemeError
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConnSession(nil, conn, protocol, sendChanSize)
+}
+
+func httpConnect(conn net.Conn, address string, user *url.Userinfo) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// Read byte by byte so nothing sent after the response is buffered.
+	rsp, err := http.ReadResponse(bufio.NewReaderSize(oneByteReader{conn}, 16), req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ProxyRefusedError, rsp.Status)
+	}
+	return nil
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r oneByteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return r.r.Read(b)
+}
+
+func socks5Connect(conn net.Conn, address string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return ProxyRefusedError
+	}
+
+	if user != nil {
+		password, _ := user.Password()
+		req := []byte{1, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return ProxyRefusedError
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return fmt.Errorf("%w: socks5 reply %d", ProxyRefusedError, head[1])
+	}
+	var addrLen int
+	switch head[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		addrLen = int(n[0])
+	default:
+		return ProxyRefusedError
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
@@ -0,0 +1,125 @@
+package link
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/funny/utest"
+)
+
+func relay(conn net.Conn, address string) {
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		return
+	}
+	go func() {
+		io.Copy(target, conn)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+}
+
+func proxyServer(t *testing.T, serve func(conn net.Conn)) net.Listener {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return lsn
+}
+
+func socks5Server(conn net.Conn) {
+	buf := make([]byte, 256)
+	io.ReadFull(conn, buf[:3])
+	if buf[2] == 2 {
+		conn.Write([]byte{5, 2})
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		password := make([]byte, buf[0])
+		io.ReadFull(conn, password)
+		if string(user) != "user" || string(password) != "pass" {
+			conn.Write([]byte{1, 1})
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{1, 0})
+	} else {
+		conn.Write([]byte{5, 0})
+	}
+	io.ReadFull(conn, buf[:4])
+	io.ReadFull(conn, buf[:4])
+	ip := net.IP(append([]byte(nil), buf[:4]...))
+	io.ReadFull(conn, buf[:2])
+	port := binary.BigEndian.Uint16(buf)
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	relay(conn, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+}
+
+func httpProxyServer(conn net.Conn) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != "CONNECT" {
+		conn.Close()
+		return
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	relay(conn, req.Host)
+}
+
+func Test_DialProxy(t *testing.T) {
+	server := EchoServer(t, 0)
+	defer server.Stop()
+	_, port, _ := net.SplitHostPort(server.Listener().Addr().String())
+	addr := net.JoinHostPort("127.0.0.1", port)
+
+	socks5 := proxyServer(t, socks5Server)
+	defer socks5.Close()
+	httpProxy := proxyServer(t, httpProxyServer)
+	defer httpProxy.Close()
+
+	for _, proxy := range []string{
+		"socks5://" + socks5.Addr().String(),
+		"socks5://user:pass@" + socks5.Addr().String(),
+		"http://user:pass@" + httpProxy.Addr().String(),
+	} {
+		proxyURL, _ := url.Parse(proxy)
+		session, err := DialProxy("tcp", addr, proxyURL, ProtocolFunc(NewTestCodec), 0)
+		utest.IsNilNow(t, err)
+		utest.IsNilNow(t, session.Send([]byte("proxied")))
+		msg, err := session.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "proxied")
+		session.Close()
+	}
+
+	proxyURL, _ := url.Parse("socks5://user:wrong@" + socks5.Addr().String())
+	_, err := DialProxy("tcp", addr, proxyURL, ProtocolFunc(NewTestCodec), 0)
+	utest.EqualNow(t, err, ProxyRefusedError)
+
+	proxyURL, _ = url.Parse("http://" + httpProxy.Addr().String())
+	_, err = DialProxy("tcp", addr, proxyURL, ProtocolFunc(NewTestCodec), 0)
+	utest.NotNilNow(t, err)
+
+	proxyURL, _ = url.Parse("ftp://" + httpProxy.Addr().String())
+	_, err = DialProxy("tcp", addr, proxyURL, ProtocolFunc(NewTestCodec), 0)
+	utest.EqualNow(t, err, ProxySchemeError)
+}
@@ -0,0 +1,86 @@
+package link
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+func Test_ProxyProtocol(t *testing.T) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	addrs := make(chan string, 1)
+	server := NewServer(NewProxyProtocolListener(lsn), ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		msg, err := session.Receive()
+		if err != nil {
+			addrs <- err.Error()
+			return
+		}
+		addrs <- session.RemoteAddr().String() + " " + string(msg.([]byte))
+	}))
+	go server.Serve()
+	defer server.Stop()
+
+	v2 := append([]byte(nil), proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 10, 0, 0, 2, 10, 0, 0, 1, 0x30, 0x39, 0, 80)
+	local := append([]byte(nil), proxyV2Signature...)
+	local = append(local, 0x20, 0x00, 0, 0)
+
+	for _, test := range []struct {
+		header string
+		expect string
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324 hello"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324 hello"},
+		{string(v2), "10.0.0.2:12345 hello"},
+		{string(local), "127.0.0.1:"},
+		{"GET / HTTP/1.1\r\n", ProxyHeaderError.Error()},
+	} {
+		conn, err := net.Dial("tcp", lsn.Addr().String())
+		utest.IsNilNow(t, err)
+		msg := []byte{5, 0, 'h', 'e', 'l', 'l', 'o'}
+		binary.LittleEndian.PutUint16(msg, 5)
+		conn.Write(append([]byte(test.header), msg...))
+		result := <-addrs
+		if test.expect == "127.0.0.1:" {
+			utest.EqualNow(t, result[:len(test.expect)], test.expect)
+		} else {
+			utest.EqualNow(t, result, test.expect)
+		}
+		conn.Close()
+	}
+}
+
+func Test_ProxyProtocolThrottle(t *testing.T) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	server := NewServer(NewProxyProtocolListener(lsn), ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		if msg, err := session.Receive(); err == nil {
+			session.Send(msg)
+		}
+	}))
+	server.SetIPThrottle(0, 0, 10, nil)
+	go server.Serve()
+	defer server.Stop()
+
+	// A client that never sends its header must not hold up the others.
+	silent, err := net.Dial("tcp", lsn.Addr().String())
+	utest.IsNilNow(t, err)
+	defer silent.Close()
+
+	conn, err := net.Dial("tcp", lsn.Addr().String())
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n\x05\x00hello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 7)
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply[2:]), "hello")
+}
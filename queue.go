@@ -0,0 +1,154 @@
+package link
+
+import (
+	"context"
+	"sync/atomic"
+	"unsafe"
+)
+
+// SendQueue selects how asynchronous sessions queue the messages of their
+// normal priority lane.
+type SendQueue int
+
+const (
+	// SendQueueChannel queues them in a buffered channel, it's the default.
+	SendQueueChannel SendQueue = iota
+	// SendQueueLockFree queues them in a lock-free multi-producer single
+	// consumer queue, so many goroutines sending to the same session don't
+	// contend on a channel lock. Each queued message costs an allocation.
+	// BackpressureDropOldest drops the newest message instead, since only
+	// the send goroutine takes messages from the queue, and the messages
+	// left when the session is closed are unqueued by the send goroutine
+	// once it exits rather than by Close.
+	SendQueueLockFree
+)
+
+// DefaultSendQueue is used by new sessions. Replace it before creating
+// any session, it's not safe to change it concurrently.
+var DefaultSendQueue = SendQueueChannel
+
+type mpscNode struct {
+	next unsafe.Pointer // *mpscNode
+	msg  interface{}
+}
+
+// mpscQueue is a bounded Vyukov queue. Any goroutine may push, only the
+// send goroutine pops.
+type mpscQueue struct {
+	head    unsafe.Pointer // *mpscNode, swapped by producers
+	tail    *mpscNode
+	size    int64
+	cap     int64
+	waiting int32
+	signal  chan struct{}
+	space   chan struct{}
+}
+
+func newMPSCQueue(size int) *mpscQueue {
+	stub := &mpscNode{}
+	return &mpscQueue{
+		head:   unsafe.Pointer(stub),
+		tail:   stub,
+		cap:    int64(size),
+		signal: make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+}
+
+func (q *mpscQueue) len() int {
+	return int(atomic.LoadInt64(&q.size))
+}
+
+// push queues msg unless the queue is full.
+func (q *mpscQueue) push(msg interface{}) bool {
+	if atomic.AddInt64(&q.size, 1) > q.cap {
+		atomic.AddInt64(&q.size, -1)
+		return false
+	}
+	node := &mpscNode{msg: msg}
+	prev := (*mpscNode)(atomic.SwapPointer(&q.head, unsafe.Pointer(node)))
+	atomic.StorePointer(&prev.next, unsafe.Pointer(node))
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pushWait waits for room to queue msg until ctx is done or closeChan is
+// closed.
+func (q *mpscQueue) pushWait(ctx context.Context, msg interface{}, closeChan chan int) error {
+	atomic.AddInt32(&q.waiting, 1)
+	defer atomic.AddInt32(&q.waiting, -1)
+	for !q.push(msg) {
+		select {
+		case <-q.space:
+		case <-closeChan:
+			return SessionClosedError
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// pop takes the oldest message. A message being pushed may not be seen
+// yet, its producer signals once it's there.
+func (q *mpscQueue) pop() (interface{}, bool) {
+	next := (*mpscNode)(atomic.LoadPointer(&q.tail.next))
+	if next == nil {
+		return nil, false
+	}
+	msg := next.msg
+	next.msg = nil
+	q.tail = next
+	atomic.AddInt64(&q.size, -1)
+	if atomic.LoadInt32(&q.waiting) > 0 {
+		select {
+		case q.space <- struct{}{}:
+		default:
+		}
+	}
+	return msg, true
+}
+
+// pushQueue is applyBackpressure for q, the caller holds the read lock
+// of sendMutex.
+func (session *Session) pushQueue(ctx context.Context, q *mpscQueue, msg interface{}) error {
+	if q.push(msg) {
+		return nil
+	}
+	bp, _ := session.backpressure.Load().(backpressure)
+	switch bp.policy {
+	case BackpressureBlock:
+		return q.pushWait(ctx, msg, session.closeChan)
+	case BackpressureDropNewest, BackpressureDropOldest:
+		session.dropped(bp, msg, MessageDroppedError)
+		return nil
+	}
+	return SessionBlockedError
+}
+
+// nextQueued is nextMsg for a session whose normal lane is q.
+func (session *Session) nextQueued(q *mpscQueue) (msg interface{}, ok bool) {
+	control, bulk := session.controlChan, session.bulkChan
+	for {
+		select {
+		case msg, ok = <-control:
+			return
+		default:
+		}
+		if msg, ok = q.pop(); ok {
+			return
+		}
+		select {
+		case msg, ok = <-control:
+			return
+		case <-q.signal:
+		case msg, ok = <-bulk:
+			return
+		case <-session.closeChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package link
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Sizer is implemented by messages that know how many bytes they hold,
+// so the send queue can account them. A []byte message and a packet sent
+// by SendPacket count their length, other messages count as zero bytes.
+type Sizer interface {
+	Size() int
+}
+
+type queueBytes struct {
+	bytes   int64
+	max     int64
+	waiting int32
+	freed   chan struct{}
+}
+
+// SetSendQueueBytes limits the bytes an asynchronous session queues to
+// max, besides the sendChanSize messages of every lane, so a few huge
+// messages can't fill the memory. A message going over the limit is
+// handled by the backpressure policy as if its lane was full, except
+// that the session is closed with QuotaExceededError instead of
+// SessionBlockedError and that dropped messages fail with it. A message
+// is always queued when it's alone, however large. Zero removes the
+// limit. See also SessionStats.SendQueueBytes and
+// Manager.SetSendQueueBytes.
+func (session *Session) SetSendQueueBytes(max int) {
+	atomic.StoreInt64(&session.queueBytes.max, int64(max))
+	session.freeBytes(0)
+}
+
+func messageSize(msg interface{}) int64 {
+	switch m := msg.(type) {
+	case []byte:
+		return int64(len(m))
+	case rawPacket:
+		return int64(len(m))
+	case *callbackMsg:
+		return messageSize(m.msg)
+	case Sizer:
+		return int64(m.Size())
+	}
+	return 0
+}
+
+// reserveBytes accounts msg in the bytes queued before it's put in lane,
+// and applies the backpressure policy when they would go over the limit.
+// It returns false when msg must not be queued, because it was dropped
+// or for the error returned. The caller holds the read lock of sendMutex.
+func (session *Session) reserveBytes(ctx context.Context, lane chan interface{}, msg interface{}) (bool, error) {
+	q := &session.queueBytes
+	size := messageSize(msg)
+	for {
+		n := session.addBytes(size)
+		max := atomic.LoadInt64(&q.max)
+		if max <= 0 || n <= max || n == size {
+			return true, nil
+		}
+		bp, _ := session.backpressure.Load().(backpressure)
+		switch bp.policy {
+		case BackpressureBlock:
+			if err := session.waitBytes(ctx, size); err != nil {
+				return false, err
+			}
+			continue
+		case BackpressureDropNewest:
+			session.dropped(bp, msg, QuotaExceededError)
+			return false, nil
+		case BackpressureDropOldest:
+			for atomic.LoadInt64(&q.bytes) > max {
+				select {
+				case old := <-lane:
+					session.dropped(bp, old, QuotaExceededError)
+					continue
+				default:
+				}
+				session.dropped(bp, msg, QuotaExceededError)
+				return false, nil
+			}
+			return true, nil
+		}
+		session.addBytes(-size)
+		return false, QuotaExceededError
+	}
+}
+
+// addBytes adds delta to the bytes queued by the session and by its
+// manager's budget, and returns the ones of the session.
+func (session *Session) addBytes(delta int64) int64 {
+	if session.budget != nil {
+		atomic.AddInt64(&session.budget.bytes, delta)
+	}
+	return atomic.AddInt64(&session.queueBytes.bytes, delta)
+}
+
+// waitBytes takes back the size bytes reserved for a message that didn't
+// fit, and waits until queued bytes are written or dropped.
+func (session *Session) waitBytes(ctx context.Context, size int64) error {
+	q := &session.queueBytes
+	atomic.AddInt32(&q.waiting, 1)
+	defer atomic.AddInt32(&q.waiting, -1)
+	n := session.addBytes(-size)
+	if n+size <= atomic.LoadInt64(&q.max) || n == 0 {
+		return nil
+	}
+	select {
+	case <-q.freed:
+		return nil
+	case <-session.closeChan:
+		return SessionClosedError
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// freeBytes removes size bytes from the bytes queued and wakes up a
+// sender waiting for room.
+func (session *Session) freeBytes(size int64) {
+	q := &session.queueBytes
+	if size != 0 {
+		session.addBytes(-size)
+	}
+	if atomic.LoadInt32(&q.waiting) > 0 {
+		select {
+		case q.freed <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Package quic runs link sessions over QUIC streams. All streams of a
+// QUIC connection share one UDP flow, and each of them is a session.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/funny/link"
+	quic "github.com/quic-go/quic-go"
+)
+
+// StreamConn adapts a QUIC stream to net.Conn.
+type StreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *StreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes both directions of the stream, the connection stays open.
+func (c *StreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// Connection returns the QUIC connection the stream belongs to.
+func (c *StreamConn) Connection() *quic.Conn {
+	return c.conn
+}
+
+// Listener is a net.Listener returning every stream opened by the peers
+// of its QUIC connections, so it can be used with link.NewServer.
+type Listener struct {
+	listener  *quic.Listener
+	streams   chan net.Conn
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func NewListener(listener *quic.Listener) *Listener {
+	l := &Listener{
+		listener:  listener,
+		streams:   make(chan net.Conn),
+		closeChan: make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *Listener) acceptStreams(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &StreamConn{stream, conn}:
+		case <-l.closeChan:
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.closeChan:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Listen accepts QUIC connections on the UDP address and serves every
+// stream of them as a session.
+func Listen(address string, config *tls.Config, protocol link.Protocol, sendChanSize int, handler link.Handler) (*link.Server, error) {
+	listener, err := quic.ListenAddr(address, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	return link.NewServer(NewListener(listener), protocol, sendChanSize, handler), nil
+}
+
+// Client is a QUIC connection that sessions are opened on.
+type Client struct {
+	conn *quic.Conn
+}
+
+func Dial(address string, config *tls.Config) (*Client, error) {
+	conn, err := quic.DialAddr(context.Background(), address, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn}, nil
+}
+
+// NewSession opens a new stream and creates a session on it. The server
+// sees the stream once the first message was sent.
+func (c *Client) NewSession(protocol link.Protocol, sendChanSize int) (*link.Session, error) {
+	stream, err := c.conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return link.NewConnSession(&StreamConn{stream, c.conn}, protocol, sendChanSize)
+}
+
+// Close closes the connection and all sessions on it.
+func (c *Client) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
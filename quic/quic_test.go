@@ -0,0 +1,102 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+func tlsConfig(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"link"},
+	}
+	client = &tls.Config{RootCAs: pool, ServerName: "localhost", NextProtos: []string{"link"}}
+	return
+}
+
+func Test_QUIC(t *testing.T) {
+	serverConfig, clientConfig := tlsConfig(t)
+	protocol := codec.FixLen(codec.Bytes(), 2, binary.LittleEndian, 4096, 4096)
+	server, err := Listen("127.0.0.1:0", serverConfig, protocol, 0, link.HandlerFunc(func(session *link.Session) {
+		defer session.Close()
+		for {
+			msg, err := session.Receive()
+			if err != nil || session.Send(msg) != nil {
+				return
+			}
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	client, err := Dial(server.Listener().Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sessions := make([]*link.Session, 3)
+	for i := range sessions {
+		if sessions[i], err = client.NewSession(protocol, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		for j, session := range sessions {
+			msg := bytes.Repeat([]byte{byte(j)}, i*50+1)
+			if err := session.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+			recv, err := session.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg, recv.([]byte)) {
+				t.Fatalf("message not match on stream %d", j)
+			}
+		}
+	}
+	if n := server.SessionCount(); n != 3 {
+		t.Fatalf("unexpected session count: %d", n)
+	}
+
+	// Closing a session closes its stream only.
+	sessions[0].Close()
+	if err := sessions[1].Send([]byte("still open")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions[1].Receive(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+package link
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var RateLimitUnsupportedError = errors.New("Rate Limit Unsupported")
+
+// tokenBucket lets through rate bytes per second with bursts of up to
+// burst bytes. A zero rate lets everything through.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) set(rate, burst int, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rate = float64(rate)
+	b.burst = float64(burst)
+	b.tokens = b.burst
+	b.last = now
+}
+
+// take takes n tokens and returns how long to wait for the bucket to get
+// out of debt.
+func (b *tokenBucket) take(n int, clock Clock) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	now := clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// SetSendRate limits the bytes written to the session's connection to
+// rate per second, with bursts of up to burst bytes. Writes wait for
+// their turn rather than fail. Zero rate removes the limit.
+func (session *Session) SetSendRate(rate, burst int) error {
+	if session.conn == nil {
+		return RateLimitUnsupportedError
+	}
+	session.conn.sendLimit.set(rate, burst, session.getClock().Now())
+	return nil
+}
+
+// SetRecvRate is like SetSendRate for the bytes read from the session's
+// connection. A peer sending faster than rate is slowed down by TCP flow
+// control.
+func (session *Session) SetRecvRate(rate, burst int) error {
+	if session.conn == nil {
+		return RateLimitUnsupportedError
+	}
+	session.conn.recvLimit.set(rate, burst, session.getClock().Now())
+	return nil
+}
@@ -0,0 +1,191 @@
+package link
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReconnectSession is a client session that dials again whenever its
+// connection fails, until it's closed. Messages are queued and sent on
+// whichever connection is up, a message whose send failed is sent again
+// after reconnecting, so the peer may receive it twice. A failure is
+// noticed by the next Send or Receive, so an idle connection needs a
+// pending Receive, or a heartbeat, to be replaced.
+type ReconnectSession struct {
+	network     string
+	address     string
+	protocol    Protocol
+	backoff     Backoff
+	onConnected func(*Session) error
+
+	sendChan  chan interface{}
+	mutex     sync.Mutex
+	session   *Session
+	ready     chan int
+	connects  uint64
+	closeFlag int32
+	closeChan chan int
+}
+
+// DialReconnect returns at once and dials in the background, waiting as
+// told by backoff between failed attempts, such as
+// Jitter(ExponentialBackoff(...)). When onConnected is not nil it's called
+// on every new connection before queued messages are sent, typically to
+// log in again, and a connection failing it is closed and dialed again.
+// Up to sendChanSize messages are queued.
+func DialReconnect(network, address string, protocol Protocol, sendChanSize int, backoff Backoff, onConnected func(*Session) error) *ReconnectSession {
+	r := &ReconnectSession{
+		network:     network,
+		address:     address,
+		protocol:    protocol,
+		backoff:     backoff,
+		onConnected: onConnected,
+		sendChan:    make(chan interface{}, sendChanSize),
+		ready:       make(chan int),
+		closeChan:   make(chan int),
+	}
+	go r.loop()
+	return r
+}
+
+// Session returns the current connection's session, nil when it's
+// reconnecting.
+func (r *ReconnectSession) Session() *Session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.session
+}
+
+// Connects returns how many times a connection was established.
+func (r *ReconnectSession) Connects() uint64 {
+	return atomic.LoadUint64(&r.connects)
+}
+
+func (r *ReconnectSession) IsClosed() bool {
+	return atomic.LoadInt32(&r.closeFlag) == 1
+}
+
+func (r *ReconnectSession) Close() error {
+	if !atomic.CompareAndSwapInt32(&r.closeFlag, 0, 1) {
+		return SessionClosedError
+	}
+	close(r.closeChan)
+	if session := r.Session(); session != nil {
+		session.Close()
+	}
+	return nil
+}
+
+// Send queues msg, it fails with SessionBlockedError when the queue is
+// full.
+func (r *ReconnectSession) Send(msg interface{}) error {
+	if r.IsClosed() {
+		return SessionClosedError
+	}
+	select {
+	case r.sendChan <- msg:
+		return nil
+	default:
+		return SessionBlockedError
+	}
+}
+
+// Receive receives from the current connection, waiting for a new one
+// when it fails. It only fails once the session is closed.
+func (r *ReconnectSession) Receive() (interface{}, error) {
+	for {
+		r.mutex.Lock()
+		session, ready := r.session, r.ready
+		r.mutex.Unlock()
+		if session == nil {
+			select {
+			case <-ready:
+				continue
+			case <-r.closeChan:
+				return nil, SessionClosedError
+			}
+		}
+		msg, err := session.Receive()
+		if err == nil {
+			return msg, nil
+		}
+		if r.IsClosed() {
+			return nil, SessionClosedError
+		}
+		session.Close()
+		r.setSession(session, nil)
+	}
+}
+
+// setSession replaces old with session, it does nothing if old is no
+// longer the current one.
+func (r *ReconnectSession) setSession(old, session *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.session != old {
+		return
+	}
+	r.session = session
+	if session != nil {
+		close(r.ready)
+	} else {
+		r.ready = make(chan int)
+	}
+}
+
+func (r *ReconnectSession) loop() {
+	var pending interface{}
+	var hasPending bool
+	for {
+		session := r.connect()
+		if session == nil {
+			return
+		}
+		atomic.AddUint64(&r.connects, 1)
+		r.setSession(nil, session)
+		if r.IsClosed() {
+			session.Close()
+			return
+		}
+
+	pump:
+		for {
+			if !hasPending {
+				select {
+				case pending = <-r.sendChan:
+					hasPending = true
+				case <-session.closeChan:
+					break pump
+				case <-r.closeChan:
+					return
+				}
+			}
+			if session.Send(pending) != nil {
+				break pump
+			}
+			pending, hasPending = nil, false
+		}
+		session.Close()
+		r.setSession(session, nil)
+	}
+}
+
+// connect dials until it succeeds, it returns nil when the session was
+// closed meanwhile.
+func (r *ReconnectSession) connect() *Session {
+	for attempt := 1; ; attempt++ {
+		session, err := Dial(r.network, r.address, r.protocol, 0)
+		if err == nil {
+			if r.onConnected == nil || r.onConnected(session) == nil {
+				return session
+			}
+			session.Close()
+		}
+		select {
+		case <-time.After(r.backoff(attempt)):
+		case <-r.closeChan:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package link
+
+import (
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+func Test_DialReconnect(t *testing.T) {
+	server := EchoServer(t, 0)
+	defer server.Stop()
+
+	var connected []*Session
+	session := DialReconnect("tcp", server.Listener().Addr().String(), ProtocolFunc(NewTestCodec), 10,
+		Jitter(ConstantBackoff(10*time.Millisecond)),
+		func(session *Session) error {
+			connected = append(connected, session)
+			return session.Send([]byte("hello"))
+		},
+	)
+	defer session.Close()
+
+	for _, msg := range []string{"hello", "a"} {
+		if msg == "a" {
+			utest.IsNilNow(t, session.Send([]byte(msg)))
+		}
+		recv, err := session.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(recv.([]byte)), msg)
+	}
+
+	// Receive notices the failure and waits for the new connection.
+	for _, s := range server.Sessions() {
+		s.Close()
+	}
+	recv, err := session.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(recv.([]byte)), "hello")
+
+	utest.IsNilNow(t, session.Send([]byte("b")))
+	recv, err = session.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(recv.([]byte)), "b")
+	utest.EqualNow(t, len(connected), 2)
+	utest.EqualNow(t, session.Connects(), uint64(2))
+	utest.Assert(t, session.Session() == connected[1])
+
+	session.Close()
+	_, err = session.Receive()
+	utest.EqualNow(t, err, SessionClosedError)
+	utest.EqualNow(t, session.Send([]byte("c")), SessionClosedError)
+
+	backoff := Jitter(ConstantBackoff(100 * time.Millisecond))
+	for i := 0; i < 100; i++ {
+		d := backoff(1)
+		utest.Assert(t, d >= 50*time.Millisecond && d <= 100*time.Millisecond, d)
+	}
+}
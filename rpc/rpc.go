@@ -0,0 +1,281 @@
+// Package rpc runs calls over a link session: every request carries an id
+// that its response carries back, so concurrent calls share the session.
+// The session's protocol must be able to send *Frame, with its Body
+// holding the requests and responses, for example codec.Gob() once Frame
+// and the body types are registered.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/funny/link"
+)
+
+var ErrClosed = errors.New("Client Closed")
+
+const (
+	KindRequest uint8 = iota + 1
+	KindResponse
+	KindError
+	KindCancel
+	KindStreamRequest
+	KindStream
+	KindEnd
+)
+
+// Frame is the message the client and the server exchange.
+type Frame struct {
+	ID    uint64
+	Kind  uint8
+	Body  interface{}
+	Error string
+}
+
+// RemoteError is the error a handler returned to the server.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// Client sends requests on a session and matches the responses to them.
+// It receives from the session itself, other messages are dropped.
+type Client struct {
+	session *link.Session
+	mutex   sync.Mutex
+	nextID  uint64
+	pending map[uint64]*link.Future
+	streams map[uint64]*Stream
+	err     error
+	cancels int32
+}
+
+func NewClient(session *link.Session) *Client {
+	client := &Client{
+		session: session,
+		pending: make(map[uint64]*link.Future),
+		streams: make(map[uint64]*Stream),
+	}
+	go client.receiveLoop()
+	return client
+}
+
+func (client *Client) Session() *link.Session {
+	return client.session
+}
+
+// Call sends req and waits for its response. An error returned by the
+// handler is a *RemoteError.
+func (client *Client) Call(req interface{}) (interface{}, error) {
+	return client.Go(req).Wait(0)
+}
+
+// CallContext is like Call but gives up once ctx is done and returns
+// ctx.Err(), after sending a cancel frame when SetCancelFrames enabled it.
+func (client *Client) CallContext(ctx context.Context, req interface{}) (interface{}, error) {
+	id, future := client.goID(req)
+	select {
+	case <-future.Done():
+		return future.Wait(0)
+	case <-ctx.Done():
+	}
+	client.mutex.Lock()
+	_, pending := client.pending[id]
+	delete(client.pending, id)
+	client.mutex.Unlock()
+	if !pending {
+		return future.Wait(0)
+	}
+	if atomic.LoadInt32(&client.cancels) == 1 {
+		client.session.Send(&Frame{ID: id, Kind: KindCancel})
+	}
+	future.Complete(nil, ctx.Err())
+	return nil, ctx.Err()
+}
+
+// SetCancelFrames makes CallContext tell the server about the calls it
+// gave up on, so Serve cancels the context of their handlers.
+func (client *Client) SetCancelFrames(enable bool) {
+	if enable {
+		atomic.StoreInt32(&client.cancels, 1)
+	} else {
+		atomic.StoreInt32(&client.cancels, 0)
+	}
+}
+
+// Go sends req and returns a future completed with its response, or with
+// the error Call would return.
+func (client *Client) Go(req interface{}) *link.Future {
+	_, future := client.goID(req)
+	return future
+}
+
+func (client *Client) goID(req interface{}) (uint64, *link.Future) {
+	future := link.NewFuture()
+	client.mutex.Lock()
+	if client.err != nil {
+		client.mutex.Unlock()
+		future.Complete(nil, client.err)
+		return 0, future
+	}
+	client.nextID++
+	id := client.nextID
+	client.pending[id] = future
+	client.mutex.Unlock()
+
+	if err := client.session.Send(&Frame{ID: id, Kind: KindRequest, Body: req}); err != nil {
+		client.mutex.Lock()
+		delete(client.pending, id)
+		client.mutex.Unlock()
+		future.Complete(nil, err)
+	}
+	return id, future
+}
+
+// Err returns the error the client failed with, nil while it works.
+func (client *Client) Err() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.err
+}
+
+// Close closes the session, the pending calls fail with ErrClosed.
+func (client *Client) Close() error {
+	client.fail(ErrClosed)
+	return client.session.Close()
+}
+
+func (client *Client) receiveLoop() {
+	for {
+		msg, err := client.session.Receive()
+		if err != nil {
+			client.fail(err)
+			return
+		}
+		frame, ok := msg.(*Frame)
+		if !ok || frame.Kind == KindRequest {
+			continue
+		}
+		if client.receiveStream(frame) {
+			continue
+		}
+		client.mutex.Lock()
+		future, ok := client.pending[frame.ID]
+		delete(client.pending, frame.ID)
+		client.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		if frame.Kind == KindError {
+			future.Complete(nil, &RemoteError{frame.Error})
+		} else {
+			future.Complete(frame.Body, nil)
+		}
+	}
+}
+
+// fail makes the pending and future calls fail with err.
+func (client *Client) fail(err error) {
+	client.mutex.Lock()
+	if client.err != nil {
+		client.mutex.Unlock()
+		return
+	}
+	client.err = err
+	pending, streams := client.pending, client.streams
+	client.pending = make(map[uint64]*link.Future)
+	client.streams = make(map[uint64]*Stream)
+	client.mutex.Unlock()
+	for _, future := range pending {
+		future.Complete(nil, err)
+	}
+	for _, stream := range streams {
+		stream.end(err)
+	}
+}
+
+// Handler handles a request and returns its response. ctx is canceled
+// once the session is closed, or the client gave up on the call and sent
+// a cancel frame.
+type Handler func(ctx context.Context, session *link.Session, req interface{}) (interface{}, error)
+
+// Serve receives requests from session until it fails, handling each one
+// in its own goroutine, and returns the error of the session. Other
+// messages are dropped, streaming requests fail with
+// ErrStreamUnsupported.
+func Serve(session *link.Session, handler Handler) error {
+	return ServeStreams(session, handler, nil)
+}
+
+// ServeStreams is like Serve but streaming requests are handled by
+// stream.
+func ServeStreams(session *link.Session, handler Handler, stream StreamHandler) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mutex sync.Mutex
+	cancels := make(map[uint64]context.CancelFunc)
+	for {
+		msg, err := session.Receive()
+		if err != nil {
+			return err
+		}
+		frame, ok := msg.(*Frame)
+		if !ok {
+			continue
+		}
+		switch frame.Kind {
+		case KindRequest, KindStreamRequest:
+		case KindCancel:
+			mutex.Lock()
+			if cancel, ok := cancels[frame.ID]; ok {
+				cancel()
+			}
+			mutex.Unlock()
+			continue
+		default:
+			continue
+		}
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		mutex.Lock()
+		cancels[frame.ID] = reqCancel
+		mutex.Unlock()
+		go func() {
+			defer func() {
+				mutex.Lock()
+				delete(cancels, frame.ID)
+				mutex.Unlock()
+				reqCancel()
+			}()
+			var resp interface{}
+			var err error
+			if frame.Kind == KindRequest {
+				resp, err = handler(reqCtx, session, frame.Body)
+			} else if stream == nil {
+				err = ErrStreamUnsupported
+			} else {
+				err = stream(reqCtx, session, frame.Body, func(resp interface{}) error {
+					if err := reqCtx.Err(); err != nil {
+						return err
+					}
+					return session.Send(&Frame{ID: frame.ID, Kind: KindStream, Body: resp})
+				})
+			}
+			if reqCtx.Err() != nil {
+				return
+			}
+			switch {
+			case err != nil:
+				session.Send(&Frame{ID: frame.ID, Kind: KindError, Error: err.Error()})
+			case frame.Kind == KindRequest:
+				session.Send(&Frame{ID: frame.ID, Kind: KindResponse, Body: resp})
+			default:
+				session.Send(&Frame{ID: frame.ID, Kind: KindEnd})
+			}
+		}()
+	}
+}
@@ -0,0 +1,138 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+func newPair(t *testing.T, handler Handler) (*Client, *link.Session) {
+	protocol := codec.Gob()
+	protocol.Register(&Frame{})
+	s1, s2, err := link.Pipe(protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Serve(s2, handler)
+	return NewClient(s1), s2
+}
+
+func Test_Call(t *testing.T) {
+	client, _ := newPair(t, func(ctx context.Context, session *link.Session, req interface{}) (interface{}, error) {
+		n := req.(int)
+		if n < 0 {
+			return nil, errors.New("negative")
+		}
+		return n * 2, nil
+	})
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := client.Call(i)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.(int) != i*2 {
+				t.Errorf("response of %d is %d", i, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, err := client.Call(-1)
+	if remote, ok := err.(*RemoteError); !ok || remote.Message != "negative" {
+		t.Fatal(err)
+	}
+}
+
+func Test_CallClosed(t *testing.T) {
+	block := make(chan int)
+	defer close(block)
+	client, server := newPair(t, func(ctx context.Context, session *link.Session, req interface{}) (interface{}, error) {
+		<-block
+		return nil, nil
+	})
+	defer client.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Call(1)
+		done <- err
+	}()
+	server.Close()
+	if err := <-done; err == nil {
+		t.Fatal("call succeeded on a closed session")
+	}
+	for client.Err() == nil {
+		runtime.Gosched()
+	}
+	if _, err := client.Call(2); err != client.Err() {
+		t.Fatal(err)
+	}
+	client.Close()
+	if _, err := client.Call(3); err == nil {
+		t.Fatal("call succeeded on a closed client")
+	}
+}
+
+func Test_Go(t *testing.T) {
+	client, _ := newPair(t, func(ctx context.Context, session *link.Session, req interface{}) (interface{}, error) {
+		return req.(int) + 1, nil
+	})
+	defer client.Close()
+
+	future := client.Go(1)
+	results := make(chan interface{}, 1)
+	future.Then(func(value interface{}, err error) {
+		results <- value
+	})
+	resp, err := future.Wait(time.Second)
+	if err != nil || resp.(int) != 2 || !future.IsDone() {
+		t.Fatal(resp, err)
+	}
+	if value := <-results; value.(int) != 2 {
+		t.Fatal(value)
+	}
+}
+
+func Test_CallContext(t *testing.T) {
+	canceled := make(chan error, 1)
+	client, _ := newPair(t, func(ctx context.Context, session *link.Session, req interface{}) (interface{}, error) {
+		if req.(int) == 0 {
+			return 0, nil
+		}
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	defer client.Close()
+	client.SetCancelFrames(true)
+
+	resp, err := client.CallContext(context.Background(), 0)
+	if err != nil || resp.(int) != 0 {
+		t.Fatal(resp, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.CallContext(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if err := <-canceled; err != context.Canceled {
+		t.Fatal(err)
+	}
+	if resp, err := client.Call(0); err != nil || resp.(int) != 0 {
+		t.Fatal(resp, err)
+	}
+}
@@ -0,0 +1,137 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/funny/link"
+)
+
+var ErrStreamClosed = errors.New("Stream Closed")
+var ErrStreamUnsupported = errors.New("Stream Unsupported")
+
+// StreamHandler handles a streaming request, calling send for every
+// response. The stream ends when it returns, with its error if any.
+type StreamHandler func(ctx context.Context, session *link.Session, req interface{}, send func(resp interface{}) error) error
+
+// Stream receives the responses of a streaming call.
+type Stream struct {
+	client *Client
+	id     uint64
+	mutex  sync.Mutex
+	queue  []interface{}
+	err    error
+	ready  chan struct{}
+}
+
+// Stream sends req to the stream handler of the server, the responses
+// are queued until Recv takes them.
+func (client *Client) Stream(req interface{}) (*Stream, error) {
+	stream := &Stream{client: client, ready: make(chan struct{}, 1)}
+	client.mutex.Lock()
+	if client.err != nil {
+		client.mutex.Unlock()
+		return nil, client.err
+	}
+	client.nextID++
+	stream.id = client.nextID
+	client.streams[stream.id] = stream
+	client.mutex.Unlock()
+
+	if err := client.session.Send(&Frame{ID: stream.id, Kind: KindStreamRequest, Body: req}); err != nil {
+		client.mutex.Lock()
+		delete(client.streams, stream.id)
+		client.mutex.Unlock()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Recv returns the next response, io.EOF once the stream ended, or the
+// error it ended with, such as a *RemoteError.
+func (stream *Stream) Recv() (interface{}, error) {
+	for {
+		stream.mutex.Lock()
+		if len(stream.queue) > 0 {
+			resp := stream.queue[0]
+			stream.queue[0] = nil
+			stream.queue = stream.queue[1:]
+			stream.mutex.Unlock()
+			return resp, nil
+		}
+		err := stream.err
+		stream.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		<-stream.ready
+	}
+}
+
+// Close gives up on the stream, sending a cancel frame when
+// SetCancelFrames enabled it and the stream didn't end yet. Responses
+// queued already can still be received.
+func (stream *Stream) Close() error {
+	client := stream.client
+	client.mutex.Lock()
+	_, pending := client.streams[stream.id]
+	delete(client.streams, stream.id)
+	client.mutex.Unlock()
+	if !pending {
+		return nil
+	}
+	stream.end(ErrStreamClosed)
+	if atomic.LoadInt32(&client.cancels) == 1 {
+		return client.session.Send(&Frame{ID: stream.id, Kind: KindCancel})
+	}
+	return nil
+}
+
+func (stream *Stream) push(resp interface{}) {
+	stream.mutex.Lock()
+	stream.queue = append(stream.queue, resp)
+	stream.mutex.Unlock()
+	stream.notify()
+}
+
+func (stream *Stream) end(err error) {
+	stream.mutex.Lock()
+	if stream.err == nil {
+		stream.err = err
+	}
+	stream.mutex.Unlock()
+	stream.notify()
+}
+
+func (stream *Stream) notify() {
+	select {
+	case stream.ready <- struct{}{}:
+	default:
+	}
+}
+
+// receiveStream hands frame to its stream, it reports false when the
+// frame belongs to no stream.
+func (client *Client) receiveStream(frame *Frame) bool {
+	client.mutex.Lock()
+	stream, ok := client.streams[frame.ID]
+	if ok && frame.Kind != KindStream {
+		delete(client.streams, frame.ID)
+	}
+	client.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	switch frame.Kind {
+	case KindStream:
+		stream.push(frame.Body)
+	case KindError:
+		stream.end(&RemoteError{frame.Error})
+	default:
+		stream.end(io.EOF)
+	}
+	return true
+}
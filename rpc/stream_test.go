@@ -0,0 +1,95 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+func newStreamPair(t *testing.T, stream StreamHandler) *Client {
+	protocol := codec.Gob()
+	protocol.Register(&Frame{})
+	s1, s2, err := link.Pipe(protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeStreams(s2, nil, stream)
+	return NewClient(s1)
+}
+
+func Test_Stream(t *testing.T) {
+	canceled := make(chan error, 1)
+	client := newStreamPair(t, func(ctx context.Context, session *link.Session, req interface{}, send func(interface{}) error) error {
+		n := req.(int)
+		if n < 0 {
+			for send(n) == nil {
+			}
+			canceled <- ctx.Err()
+			return nil
+		}
+		for i := 0; i < n; i++ {
+			if err := send(i); err != nil {
+				return err
+			}
+		}
+		if n == 3 {
+			return errors.New("three")
+		}
+		return nil
+	})
+	defer client.Close()
+	client.SetCancelFrames(true)
+
+	stream, err := client.Stream(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		resp, err := stream.Recv()
+		if err != nil || resp.(int) != i {
+			t.Fatal(resp, err)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatal(err)
+	}
+
+	stream, err = client.Stream(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		stream.Recv()
+	}
+	if _, err := stream.Recv(); err == nil || err.Error() != "three" {
+		t.Fatal(err)
+	}
+
+	stream, err = client.Stream(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if err := <-canceled; err != context.Canceled {
+		t.Fatal(err)
+	}
+}
+
+func Test_StreamUnsupported(t *testing.T) {
+	client, _ := newPair(t, nil)
+	defer client.Close()
+	stream, err := client.Stream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err == nil || err.Error() != ErrStreamUnsupported.Error() {
+		t.Fatal(err)
+	}
+}
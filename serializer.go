@@ -0,0 +1,55 @@
+package link
+
+import "encoding/json"
+
+func (session *Session) SetSerializer(serializer Serializer) {
+	session.serializer.Store(&serializer)
+}
+
+func (session *Session) getSerializer() Serializer {
+	if serializer, ok := session.serializer.Load().(*Serializer); ok {
+		return *serializer
+	}
+	return nil
+}
+
+// SendValue marshals v with the session's serializer and sends the result.
+func (session *Session) SendValue(v interface{}) error {
+	serializer := session.getSerializer()
+	if serializer == nil {
+		return SerializerRequiredError
+	}
+	data, err := serializer.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return session.Send(data)
+}
+
+// ReadValue receives a message and unmarshals it into v with the
+// session's serializer.
+func (session *Session) ReadValue(v interface{}) error {
+	serializer := session.getSerializer()
+	if serializer == nil {
+		return SerializerRequiredError
+	}
+	msg, err := session.Receive()
+	if err != nil {
+		return err
+	}
+	data, ok := msg.([]byte)
+	if !ok {
+		return NotBytesMessageError
+	}
+	return serializer.Unmarshal(data, v)
+}
+
+type JsonSerializer struct{}
+
+func (JsonSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JsonSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
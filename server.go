@@ -1,6 +1,11 @@
 package link
 
-import "net"
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+)
 
 type Server struct {
 	manager      *Manager
@@ -8,6 +13,36 @@ type Server struct {
 	protocol     Protocol
 	handler      Handler
 	sendChanSize int
+	recvChain    []Interceptor
+	sendChain    []Interceptor
+	onError      func(*Session, error)
+	recoverPanic bool
+	slots        chan struct{}
+	waitSlot     bool
+	onLimit      func(net.Conn)
+	throttle     *ipThrottle
+	stopMutex    sync.Mutex
+	stopping     bool
+	handlers     sync.WaitGroup
+	extra        []serverListener
+	logger       Logger
+}
+
+type serverListener struct {
+	listener     net.Listener
+	protocol     Protocol
+	sendChanSize int
+}
+
+// HandlerPanicError is the close reason of a session whose handler
+// panicked, when the server recovers panics.
+type HandlerPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *HandlerPanicError) Error() string {
+	return fmt.Sprintf("Handler Panic: %v", e.Value)
 }
 
 type Handler interface {
@@ -36,30 +71,259 @@ func (server *Server) Listener() net.Listener {
 	return server.listener
 }
 
+// SetSessionIds makes the server allocate the ids of accepted sessions
+// from ids. It must be called before Serve.
+func (server *Server) SetSessionIds(ids *SessionIds) {
+	server.manager.SetSessionIds(ids)
+}
+
+// SetSendQueueBytes limits the bytes every session accepted by the server
+// may queue, see Session.SetSendQueueBytes.
+func (server *Server) SetSendQueueBytes(max int) {
+	server.manager.SetSendQueueBytes(max)
+}
+
+// AddRecvInterceptor adds interceptor to every session accepted by the
+// server before its handler is called. It must be called before Serve.
+func (server *Server) AddRecvInterceptor(interceptor Interceptor) {
+	server.recvChain = append(server.recvChain, interceptor)
+}
+
+// AddSendInterceptor adds interceptor to every session accepted by the
+// server before its handler is called. It must be called before Serve.
+func (server *Server) AddSendInterceptor(interceptor Interceptor) {
+	server.sendChain = append(server.sendChain, interceptor)
+}
+
+// SetErrorHandler sets a function called once the handler of an accepted
+// session returns, with the reason the session was closed for, when it
+// was closed with one: a read or write error, a timeout or a recovered
+// panic. It must be called before Serve.
+func (server *Server) SetErrorHandler(onError func(session *Session, err error)) {
+	server.onError = onError
+}
+
+// SetRecoverPanic makes the server recover the panics of its handler, and
+// close the session with a HandlerPanicError instead of crashing the
+// process. It must be called before Serve.
+func (server *Server) SetRecoverPanic(recoverPanic bool) {
+	server.recoverPanic = recoverPanic
+}
+
+// SetMaxSessions limits the number of sessions the server serves at once
+// to max. A connection accepted past the limit is given to onLimit, when
+// it's not nil, then it's closed, or when wait is true it waits for a
+// session to close while the server stops accepting. Zero removes the
+// limit. It must be called before Serve.
+func (server *Server) SetMaxSessions(max int, wait bool, onLimit func(conn net.Conn)) {
+	server.slots = nil
+	if max > 0 {
+		server.slots = make(chan struct{}, max)
+	}
+	server.waitSlot = wait
+	server.onLimit = onLimit
+}
+
+func (server *Server) acquireSlot(conn net.Conn) bool {
+	select {
+	case server.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if server.onLimit != nil {
+		server.onLimit(conn)
+	}
+	if !server.waitSlot {
+		conn.Close()
+		return false
+	}
+	server.slots <- struct{}{}
+	return true
+}
+
+func (server *Server) releaseSlot() {
+	<-server.slots
+}
+
+// admit reports whether the IP of conn may be served, or closes conn and
+// releases its slot when the IP is throttled. It runs in the goroutine of
+// conn, since the address of a PROXY protocol connection is only known
+// once its header is read.
+func (server *Server) admit(conn net.Conn) bool {
+	if server.throttle == nil || server.throttle.admit(conn) {
+		return true
+	}
+	server.debug("connection throttled", "remote", conn.RemoteAddr())
+	if server.slots != nil {
+		server.releaseSlot()
+	}
+	return false
+}
+
+// leave releases what admit counted for conn.
+func (server *Server) leave(conn net.Conn) {
+	if server.slots != nil {
+		server.releaseSlot()
+	}
+	if server.throttle != nil {
+		server.throttle.leave(conn)
+	}
+}
+
+// AddListener makes the server also accept connections from listener,
+// with their own protocol and send channel size but the same handler,
+// options and sessions. It must be called before Serve.
+func (server *Server) AddListener(listener net.Listener, protocol Protocol, sendChanSize int) {
+	server.extra = append(server.extra, serverListener{listener, protocol, sendChanSize})
+}
+
+// Listeners returns the listener given to NewServer followed by the ones
+// added by AddListener.
+func (server *Server) Listeners() []net.Listener {
+	listeners := []net.Listener{server.listener}
+	for _, l := range server.extra {
+		listeners = append(listeners, l.listener)
+	}
+	return listeners
+}
+
+func (server *Server) closeListeners() {
+	server.listener.Close()
+	for _, l := range server.extra {
+		l.listener.Close()
+	}
+}
+
+// Serve accepts connections from every listener of the server until one
+// of them fails, then closes the others and returns the first error.
 func (server *Server) Serve() error {
+	first := serverListener{server.listener, server.protocol, server.sendChanSize}
+	if len(server.extra) == 0 {
+		return server.serve(first)
+	}
+	listeners := append([]serverListener{first}, server.extra...)
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l serverListener) {
+			errs <- server.serve(l)
+		}(l)
+	}
+	err := <-errs
+	server.closeListeners()
+	for i := 1; i < len(listeners); i++ {
+		<-errs
+	}
+	return err
+}
+
+func (server *Server) serve(l serverListener) error {
 	for {
-		conn, err := Accept(server.listener)
+		conn, err := Accept(l.listener)
 		if err != nil {
 			return err
 		}
+		if server.slots != nil && !server.acquireSlot(conn) {
+			server.debug("connection over limit")
+			continue
+		}
+		limited := server.slots != nil || server.throttle != nil
+
+		server.stopMutex.Lock()
+		if server.stopping {
+			server.stopMutex.Unlock()
+			conn.Close()
+			if server.slots != nil {
+				server.releaseSlot()
+			}
+			return ServerStoppedError
+		}
+		server.handlers.Add(1)
+		server.stopMutex.Unlock()
 
 		go func() {
-			codec, err := server.protocol.NewCodec(conn)
+			defer server.handlers.Done()
+			if !server.admit(conn) {
+				return
+			}
+			session, err := newConnSession(server.manager, conn, l.protocol, l.sendChanSize)
 			if err != nil {
-				conn.Close()
+				server.debug("session not created", "remote", conn.RemoteAddr(), "error", err)
+				if limited {
+					server.leave(conn)
+				}
 				return
 			}
-			session := server.manager.NewSession(codec, server.sendChanSize)
-			server.handler.HandleSession(session)
+			server.stopMutex.Lock()
+			stopping := server.stopping
+			server.stopMutex.Unlock()
+			if server.logger != nil {
+				session.SetLogger(server.logger)
+			}
+			session.debug("session accepted", "remote", conn.RemoteAddr())
+			if stopping {
+				session.Close()
+				if limited {
+					server.leave(conn)
+				}
+				return
+			}
+			if limited {
+				leave := func() { server.leave(conn) }
+				if token := session.AddCloseCallback(server, nil, leave); token.callback == nil {
+					leave()
+				}
+			}
+			for _, interceptor := range server.recvChain {
+				session.AddRecvInterceptor(interceptor)
+			}
+			for _, interceptor := range server.sendChain {
+				session.AddSendInterceptor(interceptor)
+			}
+			server.handle(session)
 		}()
 	}
 }
 
+func (server *Server) handle(session *Session) {
+	if server.recoverPanic || server.onError != nil {
+		defer func() {
+			if server.recoverPanic {
+				if v := recover(); v != nil {
+					session.debug("handler panicked", "panic", v)
+					session.close(&HandlerPanicError{v, debug.Stack()})
+				}
+			}
+			if server.onError != nil {
+				if err := session.CloseReason(); err != nil {
+					server.onError(session, err)
+				}
+			}
+		}()
+	}
+	server.handler.HandleSession(session)
+}
+
+// Manager returns the manager that tracks the sessions accepted by the
+// server.
+func (server *Server) Manager() *Manager {
+	return server.manager
+}
+
 func (server *Server) GetSession(sessionID uint64) *Session {
 	return server.manager.GetSession(sessionID)
 }
 
+func (server *Server) SessionCount() int {
+	return server.manager.SessionCount()
+}
+
+// Sessions returns a snapshot of the sessions accepted by the server that
+// are not closed yet.
+func (server *Server) Sessions() []*Session {
+	return server.manager.Sessions()
+}
+
 func (server *Server) Stop() {
-	server.listener.Close()
+	server.closeListeners()
 	server.manager.Dispose()
 }
@@ -0,0 +1,455 @@
+package link
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+func Test_ServerSessions(t *testing.T) {
+	server := EchoServer(t, 0)
+	defer server.Stop()
+
+	addr := server.Listener().Addr().String()
+	clients := make([]*Session, 5)
+	for i := range clients {
+		client, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+		utest.IsNilNow(t, err)
+		utest.IsNilNow(t, client.Send([]byte("hello")))
+		_, err = client.Receive()
+		utest.IsNilNow(t, err)
+		clients[i] = client
+	}
+
+	utest.EqualNow(t, server.SessionCount(), 5)
+	utest.EqualNow(t, len(server.Sessions()), 5)
+
+	clients[0].Close()
+	clients[1].Close()
+	for server.SessionCount() != 3 {
+		runtime.Gosched()
+	}
+	utest.EqualNow(t, len(server.Sessions()), 3)
+
+	for _, client := range clients[2:] {
+		client.Close()
+	}
+}
+
+func Test_SessionIds(t *testing.T) {
+	server := newEchoServer(t, 0)
+	defer server.Stop()
+	serverIds := NewSessionIds(1)
+	server.SetSessionIds(serverIds)
+	go server.Serve()
+
+	clients := NewManager()
+	defer clients.Dispose()
+	clientIds := NewSessionIds(2)
+	clients.SetSessionIds(clientIds)
+
+	addr := server.Listener().Addr().String()
+	ids := make(map[uint64]bool)
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", addr)
+		utest.IsNilNow(t, err)
+		client := clients.NewSession(&TestCodec{conn}, 0)
+		utest.IsNilNow(t, client.Send([]byte("hello")))
+		_, err = client.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, SessionIdNamespace(client.ID()), uint16(2))
+		ids[client.ID()] = true
+	}
+	for _, session := range server.Sessions() {
+		utest.EqualNow(t, SessionIdNamespace(session.ID()), uint16(1))
+		ids[session.ID()] = true
+	}
+	utest.EqualNow(t, len(ids), 20)
+	utest.EqualNow(t, serverIds.Count(), uint64(10))
+	utest.EqualNow(t, clientIds.Count(), uint64(10))
+}
+
+func Test_ServerInterceptor(t *testing.T) {
+	server, err := Listen("tcp", "127.0.0.1:0", ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		msg, err := session.Receive()
+		if err == nil {
+			session.Send(msg)
+		}
+	}))
+	utest.IsNilNow(t, err)
+	server.AddRecvInterceptor(func(_ *Session, msg interface{}) (interface{}, error) {
+		return append([]byte("recv "), msg.([]byte)...), nil
+	})
+	server.AddSendInterceptor(func(_ *Session, msg interface{}) (interface{}, error) {
+		return append([]byte("send "), msg.([]byte)...), nil
+	})
+	go server.Serve()
+	defer server.Stop()
+
+	client, err := Dial("tcp", server.Listener().Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer client.Close()
+	utest.IsNilNow(t, client.Send([]byte("hello")))
+	msg, err := client.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "send recv hello")
+}
+
+func Test_HalfClose(t *testing.T) {
+	for _, sendChanSize := range []int{0, 10} {
+		lsn, err := net.Listen("tcp", "127.0.0.1:0")
+		utest.IsNilNow(t, err)
+		go func() {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			codec := &TestCodec{conn}
+			var count int
+			for {
+				if _, err := codec.Receive(); err != nil {
+					break
+				}
+				count++
+			}
+			codec.Send([]byte{byte(count)})
+		}()
+
+		client, err := Dial("tcp", lsn.Addr().String(), ProtocolFunc(NewTestCodec), sendChanSize)
+		utest.IsNilNow(t, err)
+		for i := 0; i < 3; i++ {
+			utest.IsNilNow(t, client.Send([]byte("request")))
+		}
+		utest.IsNilNow(t, client.CloseWrite())
+		utest.EqualNow(t, client.Send([]byte("late")), SessionClosingError)
+		msg, err := client.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, msg.([]byte), []byte{3})
+		client.Close()
+		lsn.Close()
+	}
+
+	session, peer, err := Pipe(ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	defer peer.Close()
+	utest.EqualNow(t, session.CloseWrite(), HalfCloseUnsupportedError)
+	utest.EqualNow(t, session.CloseRead(), HalfCloseUnsupportedError)
+}
+
+func Test_ServerErrorHandler(t *testing.T) {
+	server, err := Listen("tcp", "127.0.0.1:0", ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		msg, err := session.Receive()
+		if err != nil {
+			return
+		}
+		if string(msg.([]byte)) == "panic" {
+			panic("boom")
+		}
+	}))
+	utest.IsNilNow(t, err)
+	errs := make(chan error, 2)
+	server.SetErrorHandler(func(session *Session, err error) {
+		errs <- err
+	})
+	server.SetRecoverPanic(true)
+	logger := &recordLogger{}
+	server.SetLogger(logger)
+	go server.Serve()
+	defer server.Stop()
+
+	addr := server.Listener().Addr().String()
+	client, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	utest.IsNilNow(t, client.Send([]byte("panic")))
+	panicErr, ok := (<-errs).(*HandlerPanicError)
+	utest.Assert(t, ok)
+	utest.EqualNow(t, panicErr.Value, "boom")
+	utest.Assert(t, logger.find("session accepted"))
+	utest.Assert(t, logger.find("handler panicked"))
+	_, err = client.Receive()
+	utest.NotNilNow(t, err)
+
+	client, err = Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	client.Close()
+	utest.EqualNow(t, <-errs, io.EOF)
+}
+
+func Test_ManagerRange(t *testing.T) {
+	manager := NewManager()
+	for i := 0; i < 100; i++ {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		manager.NewSession(&TestCodec{c1}, 0)
+	}
+	visited := make(map[uint64]bool)
+	manager.Range(func(session *Session) bool {
+		visited[session.ID()] = true
+		utest.Assert(t, manager.GetSession(session.ID()) == session)
+		return true
+	})
+	utest.EqualNow(t, len(visited), 100)
+
+	var count int
+	manager.Range(func(session *Session) bool {
+		count++
+		return count < 10
+	})
+	utest.EqualNow(t, count, 10)
+
+	manager.Range(func(session *Session) bool {
+		session.Close()
+		return true
+	})
+	for manager.SessionCount() != 0 {
+		runtime.Gosched()
+	}
+	manager.Dispose()
+}
+
+func Test_MaxSessions(t *testing.T) {
+	for _, wait := range []bool{false, true} {
+		server, err := Listen("tcp", "127.0.0.1:0", ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+			defer session.Close()
+			for {
+				msg, err := session.Receive()
+				if err != nil || session.Send(msg) != nil {
+					return
+				}
+			}
+		}))
+		utest.IsNilNow(t, err)
+		limited := make(chan bool, 10)
+		server.SetMaxSessions(1, wait, func(conn net.Conn) {
+			limited <- true
+		})
+		go server.Serve()
+
+		addr := server.Listener().Addr().String()
+		client1, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+		utest.IsNilNow(t, err)
+		utest.IsNilNow(t, client1.Send([]byte("one")))
+		_, err = client1.Receive()
+		utest.IsNilNow(t, err)
+
+		client2, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+		utest.IsNilNow(t, err)
+		<-limited
+		if wait {
+			utest.IsNilNow(t, client2.Send([]byte("two")))
+			client1.Close()
+			msg, err := client2.Receive()
+			utest.IsNilNow(t, err)
+			utest.EqualNow(t, string(msg.([]byte)), "two")
+		} else {
+			_, err = client2.Receive()
+			utest.NotNilNow(t, err)
+			client1.Close()
+		}
+		client2.Close()
+		server.Stop()
+	}
+}
+
+func Test_IPThrottleBurst(t *testing.T) {
+	server := NewServer(nil, ProtocolFunc(NewTestCodec), 0, nil)
+	server.SetIPThrottle(2, 0, 0, nil)
+	utest.Assert(t, server.throttle.take("192.0.2.1"))
+	utest.Assert(t, server.throttle.take("192.0.2.1"))
+	utest.Assert(t, !server.throttle.take("192.0.2.1"))
+}
+
+func Test_IPThrottle(t *testing.T) {
+	for _, limits := range [][3]int{{0, 0, 1}, {1, 1, 0}} {
+		throttled := make(chan bool, 10)
+		server, err := Listen("tcp", "127.0.0.1:0", ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+			defer session.Close()
+			for {
+				msg, err := session.Receive()
+				if err != nil || session.Send(msg) != nil {
+					return
+				}
+			}
+		}))
+		utest.IsNilNow(t, err)
+		server.SetIPThrottle(limits[0], limits[1], limits[2], func(conn net.Conn) {
+			throttled <- true
+		})
+		go server.Serve()
+
+		addr := server.Listener().Addr().String()
+		client1, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+		utest.IsNilNow(t, err)
+		utest.IsNilNow(t, client1.Send([]byte("one")))
+		_, err = client1.Receive()
+		utest.IsNilNow(t, err)
+
+		client2, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+		utest.IsNilNow(t, err)
+		<-throttled
+		_, err = client2.Receive()
+		utest.NotNilNow(t, err)
+		client1.Close()
+		client2.Close()
+		if limits[2] > 0 {
+			for server.SessionCount() != 0 {
+				runtime.Gosched()
+			}
+			client3, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+			utest.IsNilNow(t, err)
+			utest.IsNilNow(t, client3.Send([]byte("three")))
+			_, err = client3.Receive()
+			utest.IsNilNow(t, err)
+			client3.Close()
+		}
+		server.Stop()
+	}
+}
+
+func Test_Shutdown(t *testing.T) {
+	server := EchoServer(t, 10)
+	addr := server.Listener().Addr().String()
+	client, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer client.Close()
+	utest.IsNilNow(t, client.Send([]byte("hello")))
+	msg, err := client.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "hello")
+
+	utest.IsNilNow(t, server.Shutdown(context.Background(), []byte("bye")))
+	msg, err = client.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "bye")
+	_, err = client.Receive()
+	utest.NotNilNow(t, err)
+	_, err = Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.NotNilNow(t, err)
+
+	block := make(chan int)
+	defer close(block)
+	server, err = Listen("tcp", "127.0.0.1:0", ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		<-block
+	}))
+	utest.IsNilNow(t, err)
+	go server.Serve()
+	client, err = Dial("tcp", server.Listener().Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer client.Close()
+	for server.SessionCount() != 1 {
+		runtime.Gosched()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	utest.EqualNow(t, server.Shutdown(ctx, nil), context.DeadlineExceeded)
+	utest.EqualNow(t, server.SessionCount(), 0)
+}
+
+func Test_ShutdownReleasesSlots(t *testing.T) {
+	server, err := Listen("tcp", "127.0.0.1:0", ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {}))
+	utest.IsNilNow(t, err)
+	server.SetMaxSessions(1, false, nil)
+	server.stopping = true
+	client, err := net.Dial("tcp", server.Listener().Addr().String())
+	utest.IsNilNow(t, err)
+	defer client.Close()
+	utest.EqualNow(t, server.Serve(), ServerStoppedError)
+	utest.EqualNow(t, len(server.slots), 0)
+	server.Stop()
+}
+
+func Test_MultiListener(t *testing.T) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	lsn1, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	server := NewServer(lsn1, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.CloseGracefully(time.Second)
+		msg, err := session.Receive()
+		if err == nil {
+			session.Send(msg)
+		}
+	}))
+	server.AddListener(lsn, ProtocolFunc(NewTestCodec), 10)
+	utest.EqualNow(t, len(server.Listeners()), 2)
+	served := make(chan error)
+	go func() {
+		served <- server.Serve()
+	}()
+
+	for _, l := range server.Listeners() {
+		client, err := Dial("tcp", l.Addr().String(), ProtocolFunc(NewTestCodec), 0)
+		utest.IsNilNow(t, err)
+		utest.IsNilNow(t, client.Send([]byte("hello")))
+		msg, err := client.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "hello")
+		client.Close()
+	}
+	server.Stop()
+	utest.NotNilNow(t, <-served)
+	_, err = Dial("tcp", lsn.Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.NotNilNow(t, err)
+}
+
+func Test_PublishExpvar(t *testing.T) {
+	server := EchoServer(t, 0)
+	defer server.Stop()
+	name := fmt.Sprintf("link_test_server_%d", time.Now().UnixNano())
+	server.Manager().PublishExpvar(name)
+
+	client, err := Dial("tcp", server.Listener().Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer client.Close()
+	utest.IsNilNow(t, client.Send([]byte("hello")))
+	_, err = client.Receive()
+	utest.IsNilNow(t, err)
+
+	var stats ManagerStats
+	utest.IsNilNow(t, json.Unmarshal([]byte(expvar.Get(name).String()), &stats))
+	utest.EqualNow(t, stats.SessionsOpen, 1)
+	utest.EqualNow(t, stats.MessagesReceived, uint64(1))
+	utest.EqualNow(t, stats.BytesReceived, uint64(7))
+}
+
+func Test_SendBudget(t *testing.T) {
+	manager := NewManager()
+	defer manager.Dispose()
+	manager.SetSendBudget(100)
+
+	sessions := make([]*Session, 3)
+	for i := range sessions {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		sessions[i] = manager.NewSession(&TestCodec{c1}, 10)
+		// The first message blocks the send goroutine as nobody reads.
+		utest.IsNilNow(t, sessions[i].Send([]byte("0")))
+		for sessions[i].Stats().SendQueueLen != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	utest.IsNilNow(t, sessions[0].Send(make([]byte, 30)))
+	utest.IsNilNow(t, sessions[1].Send(make([]byte, 60)))
+	utest.EqualNow(t, manager.SendBudgetBytes(), int64(90))
+	utest.EqualNow(t, manager.Stats().SendQueueBytes, int64(90))
+
+	utest.IsNilNow(t, sessions[2].Send(make([]byte, 20)))
+	WaitClosed(t, sessions[1])
+	utest.EqualNow(t, sessions[1].CloseReason(), BudgetExceededError)
+	utest.Assert(t, !sessions[0].IsClosed())
+	utest.Assert(t, !sessions[2].IsClosed())
+	for manager.SendBudgetBytes() != 50 {
+		time.Sleep(time.Millisecond)
+	}
+}
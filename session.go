@@ -1,48 +1,130 @@
 package link
 
 import (
+	"context"
 	"errors"
+	"io"
+	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var SessionClosedError = errors.New("Session Closed")
 var SessionBlockedError = errors.New("Session Blocked")
-
-var globalSessionId uint64
+var SessionClosingError = errors.New("Session Closing")
+var MaxLifetimeExceededError = errors.New("Max Lifetime Exceeded")
+var PacketUnsupportedError = errors.New("Packet Unsupported")
+var RoutingUnsupportedError = errors.New("Routing Unsupported")
+var DrainTimeoutError = errors.New("Drain Timeout")
+var SerializerRequiredError = errors.New("Serializer Required")
+var NotBytesMessageError = errors.New("Not Bytes Message")
+var WouldBlockError = errors.New("Would Block")
+var ReaderUnsupportedError = errors.New("Reader Unsupported")
+var HeartbeatTimeoutError = errors.New("Heartbeat Timeout")
+var HeartbeatUnsupportedError = errors.New("Heartbeat Unsupported")
+var IdleTimeoutError = errors.New("Idle Timeout")
+var MessageDroppedError = errors.New("Message Dropped")
+var QuotaExceededError = errors.New("Quota Exceeded")
+
+const retryDelay = 10 * time.Millisecond
 
 type Session struct {
-	id        uint64
-	codec     Codec
-	manager   *Manager
-	sendChan  chan interface{}
-	recvMutex sync.Mutex
-	sendMutex sync.RWMutex
-
+	id         uint64
+	conn       *sessionConn
+	codec      Codec
+	manager    *Manager
+	sendChan   chan interface{}
+	recvMutex  sync.Mutex
+	sendMutex  sync.RWMutex
+	interleave int32
+	packetSize int32
+	nonBlock   int32
+	scratch    []byte
+	hookBuf    []byte
+
+	controlChan chan interface{}
+	bulkChan    chan interface{}
+	mpsc        *mpscQueue
+
+	readTimeout   int64
+	writeTimeout  int64
+	writeDeadline int64
+	lastActive    int64
+	counters      sessionCounters
+	queueBytes    queueBytes
+	budget        *sendBudget
+	slow          slowCounters
+	writeBatch    int32
+	interrupted   int32
+
+	batchCallbacks []func(error)
+
+	pendingMutex     sync.Mutex
+	interceptorMutex sync.Mutex
+	pendingRecv      chan recvResult
+
+	beforeWrite  atomic.Value
+	shouldClose  atomic.Value
+	writeRetry   atomic.Value
+	backpressure atomic.Value
+	slowConsumer atomic.Value
+	interceptors atomic.Value
+	serializer   atomic.Value
+	goroutines   int32
+	clock        atomic.Value
+	logger       atomic.Value
+	timers       sessionTimers
+
+	closing            int32
 	closeFlag          int32
 	closeChan          chan int
+	closeReason        error
 	closeMutex         sync.Mutex
 	firstCloseCallback *closeCallback
 	lastCloseCallback  *closeCallback
 
-	State interface{}
+	// State is free for the application to use, see also StateOf and
+	// SetState which guard it with stateMutex.
+	State      interface{}
+	stateMutex sync.Mutex
 }
 
 func NewSession(codec Codec, sendChanSize int) *Session {
-	return newSession(nil, codec, sendChanSize)
+	return newSession(nil, nil, codec, sendChanSize)
 }
 
-func newSession(manager *Manager, codec Codec, sendChanSize int) *Session {
+func newSession(manager *Manager, conn *sessionConn, codec Codec, sendChanSize int) *Session {
 	session := &Session{
+		conn:      conn,
 		codec:     codec,
 		manager:   manager,
 		closeChan: make(chan int),
-		id:        atomic.AddUint64(&globalSessionId, 1),
 	}
+	if manager != nil {
+		session.id = manager.ids.next()
+	} else {
+		session.id = DefaultSessionIds.next()
+	}
+	session.clock.Store(clockHolder{DefaultClock, DefaultClock.Now()})
+	if conn != nil {
+		conn.closeChan = session.closeChan
+		conn.clock = &session.clock
+	}
+	session.logger.Store(loggerHolder{DefaultLogger})
 	if sendChanSize > 0 {
-		session.sendChan = make(chan interface{}, sendChanSize)
-		go session.sendLoop()
+		if DefaultSendQueue == SendQueueLockFree {
+			session.mpsc = newMPSCQueue(sendChanSize)
+			session.sendChan = make(chan interface{})
+		} else {
+			session.sendChan = make(chan interface{}, sendChanSize)
+		}
+		session.controlChan = make(chan interface{}, sendChanSize)
+		session.bulkChan = make(chan interface{}, sendChanSize)
+		session.queueBytes.freed = make(chan struct{}, 1)
+		session.goFunc(session.sendLoop)
 	}
+	session.debug("session opened")
 	return session
 }
 
@@ -50,21 +132,51 @@ func (session *Session) ID() uint64 {
 	return session.id
 }
 
+// GoroutineCount returns the number of goroutines currently run by the
+// session itself, for diagnostics.
+func (session *Session) GoroutineCount() int {
+	return int(atomic.LoadInt32(&session.goroutines))
+}
+
+func (session *Session) goFunc(f func()) {
+	atomic.AddInt32(&session.goroutines, 1)
+	go func() {
+		defer atomic.AddInt32(&session.goroutines, -1)
+		f()
+	}()
+}
+
+func (session *Session) ConnectedAt() time.Time {
+	return session.clock.Load().(clockHolder).connectedAt
+}
+
 func (session *Session) IsClosed() bool {
 	return atomic.LoadInt32(&session.closeFlag) == 1
 }
 
+// CloseReason returns the error that caused the session to close,
+// or nil if the session is still open or was closed by Close().
+func (session *Session) CloseReason() error {
+	select {
+	case <-session.closeChan:
+		return session.closeReason
+	default:
+		return nil
+	}
+}
+
 func (session *Session) Close() error {
+	return session.close(nil)
+}
+
+func (session *Session) close(reason error) error {
 	if atomic.CompareAndSwapInt32(&session.closeFlag, 0, 1) {
+		session.closeReason = reason
 		close(session.closeChan)
+		session.debug("session closed", "reason", reason)
 
-		if session.sendChan != nil {
-			session.sendMutex.Lock()
-			close(session.sendChan)
-			if clear, ok := session.codec.(ClearSendChan); ok {
-				clear.ClearSendChan(session.sendChan)
-			}
-			session.sendMutex.Unlock()
+		if session.sendChan != nil && session.mpsc == nil {
+			session.clearSendChan(nil)
 		}
 
 		err := session.codec.Close()
@@ -81,66 +193,725 @@ func (session *Session) Close() error {
 	return SessionClosedError
 }
 
+// CloseAfterDrain stops sending and keeps receiving, discarding every
+// message, until the peer closes the connection or timeout expires, then
+// closes the session. Draining avoids the peer seeing a reset caused by
+// unread data. It returns nil when the peer closed the connection first.
+func (session *Session) CloseAfterDrain(timeout time.Duration) error {
+	atomic.StoreInt32(&session.closing, 1)
+
+	var timedOut int32
+	drained := make(chan int)
+	defer close(drained)
+	go func() {
+		select {
+		case <-session.getClock().After(timeout):
+			atomic.StoreInt32(&timedOut, 1)
+			session.close(DrainTimeoutError)
+		case <-drained:
+		}
+	}()
+
+	var err error
+	for err == nil {
+		_, err = session.Receive()
+	}
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return DrainTimeoutError
+	}
+	session.Close()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// CloseGracefully refuses new sends, waits until the messages already
+// queued are written and then closes the session, so a last message such
+// as the reason of a kick reaches the peer. When timeout expires first
+// the session is closed with DrainTimeoutError, which is returned, and
+// the messages left are dropped as by Close.
+func (session *Session) CloseGracefully(timeout time.Duration) error {
+	timer := session.getClock().After(timeout)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-timer:
+			close(stop)
+		case <-session.closeChan:
+		}
+	}()
+	return session.closeGracefully(stop)
+}
+
+// closeGracefully is CloseGracefully until stop is closed.
+func (session *Session) closeGracefully(stop <-chan struct{}) error {
+	atomic.StoreInt32(&session.closing, 1)
+	if session.IsClosed() {
+		return SessionClosedError
+	}
+
+	var done chan struct{}
+	if session.sendChan == nil {
+		done = make(chan struct{})
+		go func() {
+			session.sendMutex.Lock()
+			session.sendMutex.Unlock()
+			close(done)
+		}()
+	} else {
+		var err error
+		if done, err = session.queueFlush(stop); err != nil {
+			if err == DrainTimeoutError {
+				session.close(err)
+			}
+			return err
+		}
+	}
+
+	select {
+	case <-done:
+		return session.Close()
+	case <-session.closeChan:
+		return SessionClosedError
+	case <-stop:
+		session.close(DrainTimeoutError)
+		return DrainTimeoutError
+	}
+}
+
+// queueFlush queues a flushMsg behind the messages pending on an
+// asynchronous session, and returns the channel closed once they're
+// written. It fails with DrainTimeoutError when stop is closed first.
+func (session *Session) queueFlush(stop <-chan struct{}) (chan struct{}, error) {
+	session.sendMutex.RLock()
+	defer session.sendMutex.RUnlock()
+	if session.IsClosed() {
+		return nil, SessionClosedError
+	}
+	done := make(chan struct{})
+	select {
+	case session.bulkChan <- flushMsg(done):
+		return done, nil
+	case <-session.closeChan:
+		return nil, SessionClosedError
+	case <-stop:
+		return nil, DrainTimeoutError
+	}
+}
+
+// isClosing reports whether a graceful close has begun. Sends are refused
+// with SessionClosingError from then on, while the session is still open.
+func (session *Session) isClosing() bool {
+	return atomic.LoadInt32(&session.closing) == 1
+}
+
+func (session *Session) checkClosing() error {
+	if !session.isClosing() {
+		return nil
+	}
+	if session.IsClosed() {
+		return SessionClosedError
+	}
+	return SessionClosingError
+}
+
+// Conn returns the connection the session was created on, or nil when
+// the session was created by NewSession.
+func (session *Session) Conn() net.Conn {
+	if session.conn == nil {
+		return nil
+	}
+	return session.conn.Conn
+}
+
+// RemoteAddr returns the address of the peer, or nil when the session was
+// not created on a connection.
+func (session *Session) RemoteAddr() net.Addr {
+	if session.conn == nil {
+		return nil
+	}
+	return session.conn.RemoteAddr()
+}
+
 func (session *Session) Codec() Codec {
 	return session.codec
 }
 
 func (session *Session) Receive() (interface{}, error) {
+	if pending := session.takePendingRecv(); pending != nil {
+		result := <-pending
+		return result.msg, result.err
+	}
+	return session.receive()
+}
+
+func (session *Session) receive() (interface{}, error) {
 	session.recvMutex.Lock()
 	defer session.recvMutex.Unlock()
 
-	msg, err := session.codec.Receive()
-	if err != nil {
-		session.Close()
+	for {
+		var read uint64
+		if session.conn != nil {
+			read = session.conn.BytesRead()
+		}
+		session.extendReadDeadline()
+		msg, err := session.codec.Receive()
+		if err == nil {
+			session.received()
+			var dropped bool
+			if msg, dropped, err = session.interceptRecv(msg); err != nil {
+				session.debug("receive interceptor failed", "error", err)
+				session.close(err)
+				return nil, err
+			}
+			if dropped {
+				continue
+			}
+			return msg, nil
+		}
+		if session.wouldBlock(err) {
+			return nil, WouldBlockError
+		}
+		if session.retry(err, session.conn != nil && session.conn.BytesRead() != read) {
+			continue
+		}
+		if !session.IsClosed() {
+			atomic.AddUint64(&session.counters.readErrors, 1)
+			session.debug("receive failed", "error", err)
+		}
+		session.close(err)
+		return nil, err
 	}
-	return msg, err
 }
 
 func (session *Session) sendLoop() {
-	defer session.Close()
+	if session.mpsc != nil {
+		defer session.clearSendChan(session.mpsc)
+	}
+	var msg interface{}
 	for {
-		select {
-		case msg, ok := <-session.sendChan:
-			if !ok || session.codec.Send(msg) != nil {
+		if msg == nil {
+			var ok bool
+			if msg, ok = session.nextMsg(); !ok {
+				session.Close()
 				return
 			}
-		case <-session.closeChan:
+			session.dequeued(msg)
+		}
+		var err error
+		if n := session.batchSize(msg); n > 1 {
+			msg, err = session.sendBatch(msg, n)
+		} else {
+			err, msg = session.send(msg), nil
+		}
+		if err != nil {
+			atomic.AddUint64(&session.counters.sendErrors, 1)
+			session.debug("send failed", "error", err)
+			session.close(err)
 			return
 		}
 	}
 }
 
+// RouteFirst receives the next message and extracts its routing key, so
+// the caller can hand the session and the message over to a shard.
+func (session *Session) RouteFirst() (uint64, interface{}, error) {
+	codec, ok := session.codec.(RoutingCodec)
+	if !ok {
+		return 0, nil, RoutingUnsupportedError
+	}
+	msg, err := session.Receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	key, err := codec.RoutingKey(msg)
+	return key, msg, err
+}
+
+type rawPacket []byte
+
+// flushMsg is queued by CloseGracefully behind the pending messages, it's
+// closed once they're written.
+type flushMsg chan struct{}
+
+type readerMsg struct {
+	r    io.Reader
+	size int
+	done chan error
+}
+
+func isInternal(msg interface{}) bool {
+	switch msg.(type) {
+	case rawPacket, *readerMsg, *callbackMsg, flushMsg:
+		return true
+	}
+	return false
+}
+
+// unqueue fails the completion of a queued message that won't be sent
+// with err, and returns it as the caller of Send or SendPacket gave it.
+func unqueue(msg interface{}, err error) interface{} {
+	switch m := msg.(type) {
+	case rawPacket:
+		return []byte(m)
+	case *readerMsg:
+		m.done <- err
+		return m.r
+	case *callbackMsg:
+		m.callback(err)
+		return unqueue(m.msg, err)
+	}
+	return msg
+}
+
+// clearSendChan closes the lanes of a closed session and unqueues the
+// messages left in them, and in q when it's not nil. They're handed to one
+// ClearSendChan call when the codec implements it.
+func (session *Session) clearSendChan(q *mpscQueue) {
+	session.sendMutex.Lock()
+	defer session.sendMutex.Unlock()
+	var msgs []interface{}
+	for _, lane := range []chan interface{}{session.controlChan, session.sendChan, session.bulkChan} {
+		close(lane)
+		for msg := range lane {
+			msgs = append(msgs, msg)
+		}
+		if q != nil && lane == session.sendChan {
+			for msg, ok := q.pop(); ok; msg, ok = q.pop() {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+
+	clear, _ := session.codec.(ClearSendChan)
+	var rest chan interface{}
+	if clear != nil {
+		rest = make(chan interface{}, len(msgs))
+	}
+	dropped := 0
+	for _, msg := range msgs {
+		if _, ok := msg.(flushMsg); ok {
+			continue
+		}
+		session.freeBytes(messageSize(msg))
+		dropped++
+		msg = unqueue(msg, SessionClosedError)
+		if rest != nil {
+			rest <- msg
+		}
+	}
+	if dropped > 0 {
+		session.debug("messages dropped", "reason", "closed", "count", dropped)
+	}
+	if rest != nil {
+		close(rest)
+		clear.ClearSendChan(rest)
+	}
+}
+
+func (session *Session) send(msg interface{}) error {
+	switch m := msg.(type) {
+	case rawPacket:
+		return session.sendPacket(m)
+	case flushMsg:
+		close(m)
+		return nil
+	case *readerMsg:
+		if session.conn != nil {
+			session.extendWriteDeadline()
+		}
+		err := session.codec.(ReaderCodec).SendReader(m.r, m.size)
+		if err == nil {
+			session.sent()
+		}
+		m.done <- err
+		return err
+	case *callbackMsg:
+		err := session.send(m.msg)
+		if err == nil && session.conn != nil && session.conn.isBatching() {
+			session.batchCallbacks = append(session.batchCallbacks, m.callback)
+		} else {
+			m.callback(err)
+		}
+		return err
+	}
+	if codec, ok := session.codec.(PacketCodec); ok && session.getBeforeWrite() != nil {
+		buf, err := session.packet(codec, msg)
+		if err != nil {
+			return err
+		}
+		defer buf.Release()
+		return session.sendPacket(buf.Data)
+	}
+	return session.write(func() error {
+		return session.codec.Send(msg)
+	})
+}
+
+func (session *Session) sendPacket(packet []byte) error {
+	codec := session.codec.(PacketCodec)
+	if beforeWrite := session.getBeforeWrite(); beforeWrite != nil {
+		var err error
+		session.hookBuf = append(session.hookBuf[:0], packet...)
+		if packet, err = beforeWrite(session, session.hookBuf); err != nil {
+			return err
+		}
+		session.hookBuf = packet[:0]
+	}
+	return session.write(func() error {
+		return codec.SendPacket(packet)
+	})
+}
+
+func (session *Session) write(send func() error) error {
+	return session.timeWrite(func() error {
+		return session.retryingWrite(send)
+	})
+}
+
+func (session *Session) retryingWrite(send func() error) error {
+	for attempt := 1; ; attempt++ {
+		var written uint64
+		if session.conn != nil {
+			written = session.conn.Written()
+			session.extendWriteDeadline()
+		}
+		err := send()
+		if err == nil {
+			session.sent()
+			return nil
+		}
+		if !session.retryWrite(err, attempt, written) && !session.retry(err, session.conn != nil && session.conn.Written() != written) {
+			return err
+		}
+	}
+}
+
 func (session *Session) Send(msg interface{}) error {
+	if err := session.checkClosing(); err != nil {
+		return err
+	}
+	msg, dropped, err := session.interceptSend(msg)
+	if dropped || err != nil {
+		return err
+	}
 	if session.sendChan == nil {
 		if session.IsClosed() {
 			return SessionClosedError
 		}
 
-		session.sendMutex.Lock()
-		defer session.sendMutex.Unlock()
+		if codec, ok := session.codec.(PacketCodec); ok && atomic.LoadInt32(&session.interleave) == 1 {
+			return session.sendInterleave(codec, msg)
+		}
 
-		err := session.codec.Send(msg)
-		if err != nil {
-			session.Close()
+		return session.sendSync(msg)
+	}
+	return session.sendAsync(session.sendChan, msg)
+}
+
+// SendPacket sends a packet encoded by the codec's Packet method. The
+// packet is not modified, so it can be shared between sessions that use
+// the same protocol.
+func (session *Session) SendPacket(packet []byte) error {
+	if _, ok := session.codec.(PacketCodec); !ok {
+		return PacketUnsupportedError
+	}
+	if err := session.checkClosing(); err != nil {
+		return err
+	}
+	if session.sendChan == nil {
+		if session.IsClosed() {
+			return SessionClosedError
 		}
+		return session.sendSync(rawPacket(packet))
+	}
+	return session.sendAsync(session.sendChan, rawPacket(packet))
+}
+
+// SendReader sends one message of exactly size bytes read from r. The
+// bytes are streamed to the connection through a fixed size buffer, so
+// the codec must implement ReaderCodec. It returns once the message has
+// been written, also on asynchronous sessions.
+func (session *Session) SendReader(r io.Reader, size int) error {
+	if _, ok := session.codec.(ReaderCodec); !ok {
+		return ReaderUnsupportedError
+	}
+	if err := session.checkClosing(); err != nil {
 		return err
 	}
+	if session.IsClosed() {
+		return SessionClosedError
+	}
+	msg := &readerMsg{r, size, make(chan error, 1)}
+	if session.sendChan == nil {
+		return session.sendSync(msg)
+	}
+	if err := session.sendAsync(session.sendChan, msg); err != nil {
+		return err
+	}
+	select {
+	case err := <-msg.done:
+		return err
+	case <-session.closeChan:
+		return SessionClosedError
+	}
+}
+
+// SetSendScratch makes Send on a synchronous session encode messages into
+// a reused buffer of size bytes instead of a new one, when the codec
+// implements PacketCodec. Larger messages still get a fresh buffer.
+// Zero disables the scratch buffer.
+func (session *Session) SetSendScratch(size int) {
+	if _, ok := session.codec.(PacketCodec); !ok {
+		return
+	}
+	session.sendMutex.Lock()
+	defer session.sendMutex.Unlock()
+	if size > 0 {
+		session.scratch = make([]byte, 0, size)
+	} else {
+		session.scratch = nil
+	}
+}
+
+// SetRecvScratch is SetSendScratch for Receive, when the codec implements
+// RecvScratchCodec. Message bodies are read into a reused buffer of size
+// bytes, larger ones into a fresh buffer that isn't kept. Zero lets the
+// buffer grow to the largest message received.
+func (session *Session) SetRecvScratch(size int) {
+	codec, ok := session.codec.(RecvScratchCodec)
+	if !ok {
+		return
+	}
+	session.recvMutex.Lock()
+	defer session.recvMutex.Unlock()
+	codec.SetRecvScratch(size)
+}
+
+func (session *Session) sendSync(msg interface{}) error {
+	return session.sendSyncContext(context.Background(), msg)
+}
 
+// sendSyncContext is sendSync interrupting the write once ctx is done, see
+// SendContext.
+func (session *Session) sendSyncContext(ctx context.Context, msg interface{}) (err error) {
+	session.sendMutex.Lock()
+	defer session.sendMutex.Unlock()
+
+	if ctx.Done() != nil && session.conn != nil {
+		stop := session.interruptWrite(ctx)
+		defer func() {
+			if stop() && err != nil {
+				err = ctx.Err()
+			}
+		}()
+	}
+	if session.scratch == nil || isInternal(msg) {
+		err = session.send(msg)
+	} else {
+		var packet []byte
+		packet, err = session.codec.(PacketCodec).Packet(session.scratch[:0], msg)
+		if err != nil {
+			return err
+		}
+		err = session.sendPacket(packet)
+	}
+	if err != nil {
+		return session.sendFailed(err)
+	}
+	return nil
+}
+
+func (session *Session) sendFailed(err error) error {
+	if session.wouldBlock(err) {
+		return WouldBlockError
+	}
+	atomic.AddUint64(&session.counters.sendErrors, 1)
+	session.debug("send failed", "error", err)
+	session.close(err)
+	return err
+}
+
+func (session *Session) sendAsync(lane chan interface{}, msg interface{}) error {
+	return session.sendAsyncContext(context.Background(), lane, msg)
+}
+
+func (session *Session) sendAsyncContext(ctx context.Context, lane chan interface{}, msg interface{}) error {
 	session.sendMutex.RLock()
 	if session.IsClosed() {
 		session.sendMutex.RUnlock()
 		return SessionClosedError
 	}
 
-	select {
-	case session.sendChan <- msg:
+	ok, err := session.reserveBytes(ctx, lane, msg)
+	if !ok {
 		session.sendMutex.RUnlock()
-		return nil
-	default:
-		session.sendMutex.RUnlock()
-		session.Close()
-		return SessionBlockedError
+		if err == QuotaExceededError {
+			session.close(err)
+		}
+		return err
+	}
+
+	if session.mpsc != nil && lane == session.sendChan {
+		err = session.pushQueue(ctx, session.mpsc, msg)
+	} else {
+		select {
+		case lane <- msg:
+		default:
+			err = session.applyBackpressure(ctx, lane, msg)
+		}
+	}
+	session.sendMutex.RUnlock()
+	if err != nil {
+		session.freeBytes(messageSize(msg))
+	} else {
+		session.queued()
+		if session.budget != nil {
+			session.budget.check()
+		}
+	}
+	if err == SessionBlockedError {
+		session.close(err)
+	}
+	return err
+}
+
+// BeforeWriteFunc may change an encoded packet right before it is
+// written, and returns the packet to write instead.
+type BeforeWriteFunc func(session *Session, packet []byte) ([]byte, error)
+
+// SetBeforeWrite sets a hook called for every packet the session writes.
+// It only takes effect for codecs that implement PacketCodec, whose
+// messages are then always encoded with Packet first. The hook gets a
+// private copy of the packet and is called by one sender at a time, so
+// it may append to or modify it freely. An error fails the send like a
+// write error does.
+func (session *Session) SetBeforeWrite(beforeWrite BeforeWriteFunc) {
+	session.beforeWrite.Store(beforeWrite)
+}
+
+func (session *Session) getBeforeWrite() BeforeWriteFunc {
+	beforeWrite, _ := session.beforeWrite.Load().(BeforeWriteFunc)
+	return beforeWrite
+}
+
+// SetShouldClose sets the predicate consulted before an I/O error closes
+// the session. When it returns false, the failed receive or send is
+// retried after a short delay. By default every error closes the session.
+//
+// A receive or send that read or wrote part of a message is never
+// retried, since that would break the framing. Sessions created by
+// NewSession can't tell, so their codec must not consume or write part of
+// a message when it fails with an error the predicate accepts.
+func (session *Session) SetShouldClose(shouldClose func(error) bool) {
+	session.shouldClose.Store(shouldClose)
+}
+
+// retry reports whether to attempt a failed receive or send again.
+// Progressed tells whether it read or wrote some bytes.
+func (session *Session) retry(err error, progressed bool) bool {
+	if progressed {
+		return false
+	}
+	shouldClose, _ := session.shouldClose.Load().(func(error) bool)
+	if shouldClose == nil || shouldClose(err) {
+		return false
+	}
+	return session.sleep(retryDelay)
+}
+
+type writeRetry struct {
+	attempts int
+	backoff  Backoff
+}
+
+// SetWriteRetry makes a send that failed with a temporary network error be
+// attempted again, up to attempts times in total, waiting between attempts
+// as told by backoff. A send is only retried when nothing was written to
+// the connection, since a partial write would break the framing, so this
+// has no effect on sessions created by NewSession.
+func (session *Session) SetWriteRetry(attempts int, backoff Backoff) {
+	session.writeRetry.Store(&writeRetry{attempts, backoff})
+}
+
+func (session *Session) retryWrite(err error, attempt int, written uint64) bool {
+	policy, _ := session.writeRetry.Load().(*writeRetry)
+	if policy == nil || attempt >= policy.attempts || session.conn == nil {
+		return false
+	}
+	if !isTemporary(err) || session.conn.Written() != written {
+		return false
+	}
+	return session.sleep(policy.backoff(attempt))
+}
+
+// sleep waits for d and reports whether the session is still open.
+func (session *Session) sleep(d time.Duration) bool {
+	select {
+	case <-session.getClock().After(d):
+		return true
+	case <-session.closeChan:
+		return false
+	}
+}
+
+// SetNonBlocking is for sessions on a non-blocking connection driven by an
+// external poller. When enabled, Receive and synchronous sends return
+// WouldBlockError instead of closing the session if the connection reports
+// a temporary or timeout error, and the call can be made again once the
+// connection is ready. The codec must not consume a partial message in
+// that case, or the framing is lost.
+func (session *Session) SetNonBlocking(enable bool) {
+	if enable {
+		atomic.StoreInt32(&session.nonBlock, 1)
+	} else {
+		atomic.StoreInt32(&session.nonBlock, 0)
+	}
+}
+
+func (session *Session) wouldBlock(err error) bool {
+	if atomic.LoadInt32(&session.nonBlock) == 0 {
+		return false
 	}
+	ne, ok := err.(net.Error)
+	return ok && (ne.Temporary() || ne.Timeout())
+}
+
+// SetInterleave enables frame interleaving on synchronous sessions whose
+// codec implements PacketCodec. Send then encodes the message without
+// holding the send lock and only holds it while the packet is written, so
+// concurrent senders are not blocked by each other's encoding.
+//
+// This requires that Packet is safe for concurrent use and that SendPacket
+// writes one complete frame. Messages sent concurrently may reach the peer
+// in any order. Asynchronous sessions are not affected.
+func (session *Session) SetInterleave(enable bool) {
+	if enable {
+		atomic.StoreInt32(&session.interleave, 1)
+	} else {
+		atomic.StoreInt32(&session.interleave, 0)
+	}
+}
+
+func (session *Session) sendInterleave(codec PacketCodec, msg interface{}) error {
+	buf, err := session.packet(codec, msg)
+	if err != nil {
+		return err
+	}
+	defer buf.Release()
+
+	session.sendMutex.Lock()
+	defer session.sendMutex.Unlock()
+
+	if session.IsClosed() {
+		return SessionClosedError
+	}
+	err = session.sendPacket(buf.Data)
+	if err != nil {
+		return session.sendFailed(err)
+	}
+	return nil
 }
 
 type closeCallback struct {
@@ -150,9 +921,16 @@ type closeCallback struct {
 	Next    *closeCallback
 }
 
-func (session *Session) AddCloseCallback(handler, key interface{}, callback func()) {
+// CloseCallbackToken identifies a single registration made by
+// AddCloseCallback, so the same handler and key can be registered more
+// than once and removed one at a time.
+type CloseCallbackToken struct {
+	callback *closeCallback
+}
+
+func (session *Session) AddCloseCallback(handler, key interface{}, callback func()) CloseCallbackToken {
 	if session.IsClosed() {
-		return
+		return CloseCallbackToken{}
 	}
 
 	session.closeMutex.Lock()
@@ -166,11 +944,27 @@ func (session *Session) AddCloseCallback(handler, key interface{}, callback func
 		session.lastCloseCallback.Next = newItem
 	}
 	session.lastCloseCallback = newItem
+	return CloseCallbackToken{newItem}
 }
 
 func (session *Session) RemoveCloseCallback(handler, key interface{}) {
+	session.removeCloseCallback(func(callback *closeCallback) bool {
+		return callback.Handler == handler && callback.Key == key
+	})
+}
+
+func (session *Session) RemoveCloseCallbackByToken(token CloseCallbackToken) bool {
+	if token.callback == nil {
+		return false
+	}
+	return session.removeCloseCallback(func(callback *closeCallback) bool {
+		return callback == token.callback
+	})
+}
+
+func (session *Session) removeCloseCallback(match func(*closeCallback) bool) bool {
 	if session.IsClosed() {
-		return
+		return false
 	}
 
 	session.closeMutex.Lock()
@@ -178,7 +972,7 @@ func (session *Session) RemoveCloseCallback(handler, key interface{}) {
 
 	var prev *closeCallback
 	for callback := session.firstCloseCallback; callback != nil; prev, callback = callback, callback.Next {
-		if callback.Handler == handler && callback.Key == key {
+		if match(callback) {
 			if session.firstCloseCallback == callback {
 				session.firstCloseCallback = callback.Next
 			} else {
@@ -187,9 +981,10 @@ func (session *Session) RemoveCloseCallback(handler, key interface{}) {
 			if session.lastCloseCallback == callback {
 				session.lastCloseCallback = prev
 			}
-			return
+			return true
 		}
 	}
+	return false
 }
 
 func (session *Session) invokeCloseCallbacks() {
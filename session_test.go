@@ -2,10 +2,17 @@ package link
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"math/rand"
+	"net"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -55,6 +62,24 @@ func (c *TestCodec) Receive() (interface{}, error) {
 	return buf, nil
 }
 
+func (c *TestCodec) Packet(dst []byte, msg interface{}) ([]byte, error) {
+	return append(dst, msg.([]byte)...), nil
+}
+
+func (c *TestCodec) SendPacket(packet []byte) error {
+	return c.Send(packet)
+}
+
+func (c *TestCodec) SendReader(r io.Reader, size int) error {
+	var head [2]byte
+	binary.LittleEndian.PutUint16(head[:], uint16(size))
+	if _, err := c.rw.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := io.CopyN(c.rw, r, int64(size))
+	return err
+}
+
 func (c *TestCodec) Close() error {
 	return c.rw.Close()
 }
@@ -108,6 +133,31 @@ func SessionTest(t *testing.T, sendChanSize int, test func(*testing.T, *Session)
 	server.Stop()
 }
 
+func EchoServer(t *testing.T, sendChanSize int) *Server {
+	server := newEchoServer(t, sendChanSize)
+	go server.Serve()
+	return server
+}
+
+// newEchoServer is like EchoServer but doesn't start serving, so options
+// can be set before Serve.
+func newEchoServer(t *testing.T, sendChanSize int) *Server {
+	server, err := Listen("tcp", "0.0.0.0:0", ProtocolFunc(NewTestCodec), sendChanSize, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if session.Send(msg) != nil {
+				return
+			}
+		}
+	}))
+	utest.IsNilNow(t, err)
+	return server
+}
+
 func BytesTest(t *testing.T, session *Session) {
 	for i := 0; i < 2000; i++ {
 		msg1 := RandBytes(512)
@@ -121,7 +171,7 @@ func BytesTest(t *testing.T, session *Session) {
 }
 
 func Test_CloseCallback(t *testing.T) {
-	session := newSession(nil, nil, 0)
+	session := newSession(nil, nil, nil, 0)
 
 	c := make(chan int, 10)
 	for i := 0; i < 10; i++ {
@@ -143,6 +193,519 @@ func Test_CloseCallback(t *testing.T) {
 	}
 }
 
+func Test_CloseCallbackToken(t *testing.T) {
+	session := newSession(nil, nil, nil, 0)
+
+	var count int
+	callback := func() {
+		count++
+	}
+	token1 := session.AddCloseCallback(nil, nil, callback)
+	token2 := session.AddCloseCallback(nil, nil, callback)
+
+	utest.Assert(t, session.RemoveCloseCallbackByToken(token1))
+	utest.Assert(t, !session.RemoveCloseCallbackByToken(token1))
+
+	session.invokeCloseCallbacks()
+	utest.EqualNow(t, count, 1)
+
+	utest.Assert(t, session.RemoveCloseCallbackByToken(token2))
+	utest.Assert(t, !session.RemoveCloseCallbackByToken(CloseCallbackToken{}))
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+type flakyConn struct {
+	net.Conn
+	readFails  int32
+	writeFails int32
+	writes     int32
+}
+
+func (c *flakyConn) Read(p []byte) (int, error) {
+	if atomic.AddInt32(&c.readFails, -1) >= 0 {
+		return 0, temporaryError{}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *flakyConn) Write(p []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	if atomic.AddInt32(&c.writeFails, -1) >= 0 {
+		return 0, temporaryError{}
+	}
+	return c.Conn.Write(p)
+}
+
+func Test_ShouldClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	codec1, _ := NewTestCodec(&flakyConn{Conn: c1, readFails: 1, writeFails: 1})
+	codec2, _ := NewTestCodec(c2)
+	session := NewSession(codec1, 10)
+	peer := NewSession(codec2, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	session.SetShouldClose(func(err error) bool {
+		return !isTemporary(err)
+	})
+
+	go peer.Send([]byte("ping"))
+	msg, err := session.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "ping")
+
+	utest.IsNilNow(t, session.Send([]byte("pong")))
+	msg, err = peer.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "pong")
+
+	utest.Assert(t, !session.IsClosed())
+}
+
+// headOnlyConn fails every write after the first one.
+type headOnlyConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *headOnlyConn) Write(p []byte) (int, error) {
+	if atomic.AddInt32(&c.writes, 1) > 1 {
+		return 0, temporaryError{}
+	}
+	return c.Conn.Write(p)
+}
+
+func Test_ShouldCloseAfterPartialWrite(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go io.Copy(io.Discard, c2)
+	defer c2.Close()
+	session, err := newConnSession(nil, &headOnlyConn{Conn: c1}, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	session.SetShouldClose(func(err error) bool {
+		return !isTemporary(err)
+	})
+
+	utest.NotNilNow(t, session.Send([]byte("half")))
+	utest.Assert(t, session.IsClosed())
+}
+
+func Test_WriteRetry(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session, err := newConnSession(nil, &flakyConn{Conn: c1, writeFails: 2}, ProtocolFunc(NewTestCodec), 10)
+	utest.IsNilNow(t, err)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	session.SetWriteRetry(3, ConstantBackoff(time.Millisecond))
+	utest.IsNilNow(t, session.Send([]byte("retry")))
+
+	msg, err := peer.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "retry")
+	utest.Assert(t, !session.IsClosed())
+
+	backoff := ExponentialBackoff(time.Millisecond, 5*time.Millisecond)
+	utest.EqualNow(t, backoff(1), time.Millisecond)
+	utest.EqualNow(t, backoff(3), 4*time.Millisecond)
+	utest.EqualNow(t, backoff(10), 5*time.Millisecond)
+}
+
+func Test_Deadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session, err := NewConnSession(c1, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	peer, err := NewConnSession(c2, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer peer.Close()
+
+	utest.IsNilNow(t, session.SetReadTimeout(20*time.Millisecond))
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		peer.Send([]byte("ping"))
+	}()
+	msg, err := session.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "ping")
+
+	_, err = session.Receive()
+	ne, ok := err.(net.Error)
+	utest.Assert(t, ok && ne.Timeout())
+	utest.Assert(t, session.IsClosed())
+
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	session, err = NewConnSession(c3, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	utest.IsNilNow(t, session.SetWriteDeadline(time.Now().Add(10*time.Millisecond)))
+	ne, ok = session.Send([]byte("pong")).(net.Error)
+	utest.Assert(t, ok && ne.Timeout())
+	utest.Assert(t, session.IsClosed())
+
+	utest.EqualNow(t, NewSession(&TestCodec{c1}, 0).SetReadTimeout(time.Second), DeadlineUnsupportedError)
+}
+
+func Test_RateLimit(t *testing.T) {
+	session, peer, err := Pipe(ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	defer peer.Close()
+	go func() {
+		for {
+			if _, err := peer.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	msg := make([]byte, 1000)
+	send := func(n int) time.Duration {
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			utest.IsNilNow(t, session.Send(msg))
+		}
+		return time.Since(start)
+	}
+
+	utest.IsNilNow(t, session.SetSendRate(10000, 1000))
+	elapsed := send(5)
+	utest.Assert(t, elapsed >= 350*time.Millisecond && elapsed < time.Second, elapsed)
+
+	utest.IsNilNow(t, session.SetSendRate(0, 0))
+	elapsed = send(100)
+	utest.Assert(t, elapsed < 200*time.Millisecond, elapsed)
+
+	utest.EqualNow(t, NewSession(&TestCodec{}, 0).SetRecvRate(1, 1), RateLimitUnsupportedError)
+}
+
+func Test_Stats(t *testing.T) {
+	session, peer, err := Pipe(ProtocolFunc(NewTestCodec), 10)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	defer peer.Close()
+
+	utest.IsNilNow(t, session.Send([]byte("first")))
+	for len(session.sendChan) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, session.Send([]byte("second")))
+	utest.IsNilNow(t, session.SendPriority([]byte("third"), PriorityBulk))
+	utest.EqualNow(t, session.Stats().SendQueueLen, 2)
+
+	for i := 0; i < 3; i++ {
+		_, err := peer.Receive()
+		utest.IsNilNow(t, err)
+	}
+	for session.Stats().MessagesSent != 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	sent, received := session.Stats(), peer.Stats()
+	utest.EqualNow(t, sent.SendQueueLen, 0)
+	utest.EqualNow(t, received.MessagesReceived, uint64(3))
+	utest.EqualNow(t, received.MessagesSent, uint64(0))
+	utest.Assert(t, sent.BytesSent > 0)
+	utest.EqualNow(t, received.BytesReceived, sent.BytesSent)
+	utest.Assert(t, !sent.LastSent.IsZero() && sent.LastReceived.IsZero())
+	utest.Assert(t, !received.LastReceived.IsZero())
+}
+
+func Test_Context(t *testing.T) {
+	session, peer, err := Pipe(ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	defer peer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = session.ReceiveContext(ctx)
+	utest.EqualNow(t, err, context.DeadlineExceeded)
+	utest.Assert(t, !session.IsClosed())
+
+	go peer.Send([]byte("ping"))
+	msg, err := session.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "ping")
+
+	go peer.Send([]byte("pong"))
+	msg, err = session.ReceiveContext(context.Background())
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "pong")
+
+	// Nobody reads, the write gets interrupted.
+	err = session.SendContext(ctx, []byte("x"))
+	utest.EqualNow(t, err, context.DeadlineExceeded)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	utest.EqualNow(t, session.SendContext(ctx, []byte("x")), context.DeadlineExceeded)
+	utest.Assert(t, session.IsClosed())
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	async := NewSession(&TestCodec{c1}, 1)
+	defer async.Close()
+	async.SetBackpressure(BackpressureBlock, nil)
+	utest.IsNilNow(t, async.Send([]byte("0")))
+	for len(async.sendChan) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, async.Send([]byte("1")))
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	utest.EqualNow(t, async.SendContext(ctx, []byte("2")), context.DeadlineExceeded)
+	utest.Assert(t, !async.IsClosed())
+}
+
+// stallConn blocks the first write until a past write deadline is set,
+// and lets it succeed then.
+type stallConn struct {
+	net.Conn
+	cancel   func()
+	once     sync.Once
+	release  chan struct{}
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	c.once.Do(func() {
+		c.cancel()
+		<-c.release
+	})
+	return len(p), nil
+}
+
+func (c *stallConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if t.Before(time.Now()) && c.deadline.After(time.Now()) {
+		close(c.release)
+	}
+	c.deadline = t
+	return nil
+}
+
+func Test_SendContextDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &stallConn{Conn: c1, cancel: cancel, release: make(chan struct{})}
+	session, err := newConnSession(nil, conn, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+
+	deadline := time.Now().Add(time.Hour)
+	utest.IsNilNow(t, session.SetWriteDeadline(deadline))
+	utest.IsNilNow(t, session.SendContext(ctx, []byte("x")))
+	utest.Assert(t, !session.IsClosed())
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	utest.Assert(t, conn.deadline.Equal(deadline))
+}
+
+func Test_SendCallback(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := NewSession(&TestCodec{c1}, 10)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer peer.Close()
+
+	results := make(chan error, 10)
+	callback := func(err error) {
+		results <- err
+	}
+	utest.IsNilNow(t, session.SendCallback([]byte("first"), callback))
+	select {
+	case <-results:
+		t.Fatal("callback called before the write")
+	case <-time.After(10 * time.Millisecond):
+	}
+	msg, err := peer.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "first")
+	utest.IsNilNow(t, <-results)
+
+	// Queued messages fail once the session is closed.
+	utest.IsNilNow(t, session.SendCallback([]byte("second"), callback))
+	for len(session.sendChan) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, session.SendCallback([]byte("third"), callback))
+	session.Close()
+	err1, err2 := <-results, <-results
+	utest.Assert(t, err1 != nil && err2 != nil)
+	utest.Assert(t, err1 == SessionClosedError || err2 == SessionClosedError)
+	utest.EqualNow(t, session.SendCallback([]byte("fourth"), callback), SessionClosedError)
+
+	sync, peer2, err := Pipe(ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer sync.Close()
+	defer peer2.Close()
+	go peer2.Receive()
+	utest.IsNilNow(t, sync.SendCallback([]byte("sync"), callback))
+	utest.IsNilNow(t, <-results)
+}
+
+func Test_SendFuture(t *testing.T) {
+	session, peer, err := Pipe(ProtocolFunc(NewTestCodec), 10)
+	utest.IsNilNow(t, err)
+	defer peer.Close()
+
+	future := session.SendFuture([]byte("hello"))
+	_, err = future.Wait(10 * time.Millisecond)
+	utest.EqualNow(t, err, FutureTimeoutError)
+	utest.Assert(t, !future.IsDone())
+	called := make(chan error, 1)
+	future.Then(func(value interface{}, err error) {
+		called <- err
+	})
+	msg, err := peer.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "hello")
+	_, err = future.Wait(0)
+	utest.IsNilNow(t, err)
+	utest.IsNilNow(t, <-called)
+	utest.Assert(t, !future.Complete(nil, nil))
+
+	session.Close()
+	_, err = session.SendFuture([]byte("closed")).Wait(0)
+	utest.EqualNow(t, err, SessionClosedError)
+}
+
+func Test_WriteBatch(t *testing.T) {
+	c1, c2 := net.Pipe()
+	conn := &flakyConn{Conn: c1}
+	session, err := newConnSession(nil, conn, ProtocolFunc(NewTestCodec), 100)
+	utest.IsNilNow(t, err)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+	session.SetWriteBatch(16)
+
+	// The first batch blocks the send goroutine until the peer reads.
+	utest.IsNilNow(t, session.Send([]byte{0}))
+	for len(session.sendChan) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	results := make(chan error, 100)
+	for i := 1; i < 100; i++ {
+		utest.IsNilNow(t, session.SendCallback([]byte{byte(i)}, func(err error) {
+			results <- err
+		}))
+	}
+	for i := 0; i < 100; i++ {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, msg.([]byte)[0], byte(i))
+	}
+	for i := 1; i < 100; i++ {
+		utest.IsNilNow(t, <-results)
+	}
+	// 2 writes per message without batching.
+	writes := atomic.LoadInt32(&conn.writes)
+	utest.Assert(t, writes <= 8, writes)
+	utest.EqualNow(t, session.Stats().BytesSent, uint64(300))
+}
+
+func Test_Interceptor(t *testing.T) {
+	session, peer, err := Pipe(ProtocolFunc(NewTestCodec), 10)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	defer peer.Close()
+
+	denyErr := errors.New("denied")
+	var order []string
+	session.AddSendInterceptor(func(_ *Session, msg interface{}) (interface{}, error) {
+		order = append(order, "first")
+		switch string(msg.([]byte)) {
+		case "drop":
+			return nil, nil
+		case "deny":
+			return nil, denyErr
+		}
+		return append([]byte("<"), msg.([]byte)...), nil
+	})
+	session.AddSendInterceptor(func(_ *Session, msg interface{}) (interface{}, error) {
+		order = append(order, "second")
+		return append(msg.([]byte), '>'), nil
+	})
+	utest.IsNilNow(t, session.Send([]byte("drop")))
+	utest.EqualNow(t, session.Send([]byte("deny")), denyErr)
+	utest.IsNilNow(t, session.Send([]byte("hello")))
+	utest.EqualNow(t, order, []string{"first", "first", "first", "second"})
+	msg, err := peer.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "<hello>")
+	utest.Assert(t, !session.IsClosed())
+
+	peer.AddRecvInterceptor(func(_ *Session, msg interface{}) (interface{}, error) {
+		switch string(msg.([]byte)) {
+		case "<skip>":
+			return nil, nil
+		case "<bad>":
+			return nil, denyErr
+		}
+		return msg, nil
+	})
+	utest.IsNilNow(t, session.Send([]byte("skip")))
+	utest.IsNilNow(t, session.Send([]byte("next")))
+	msg, err = peer.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "<next>")
+	utest.IsNilNow(t, session.Send([]byte("bad")))
+	_, err = peer.Receive()
+	utest.EqualNow(t, err, denyErr)
+	utest.Assert(t, peer.IsClosed())
+}
+
+type nilCodec struct {
+	*TestCodec
+	sent int
+}
+
+func (c *nilCodec) Send(msg interface{}) error {
+	c.sent++
+	return nil
+}
+
+func Test_InterceptorSendNil(t *testing.T) {
+	c1, _ := net.Pipe()
+	codec := &nilCodec{TestCodec: &TestCodec{c1}}
+	session := NewSession(codec, 0)
+	defer session.Close()
+
+	utest.IsNilNow(t, session.Send(nil))
+	utest.EqualNow(t, codec.sent, 1)
+	session.AddSendInterceptor(func(_ *Session, msg interface{}) (interface{}, error) {
+		return msg, nil
+	})
+	utest.IsNilNow(t, session.Send(nil))
+	utest.EqualNow(t, codec.sent, 1)
+}
+
+func Test_NonBlocking(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := NewSession(&TestCodec{&flakyConn{Conn: c1, readFails: 1, writeFails: 1}}, 0)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+	session.SetNonBlocking(true)
+
+	_, err := session.Receive()
+	utest.EqualNow(t, err, WouldBlockError)
+	utest.EqualNow(t, session.Send([]byte("x")), WouldBlockError)
+	utest.Assert(t, !session.IsClosed())
+
+	go peer.Send([]byte("ping"))
+	msg, err := session.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "ping")
+}
+
 func Test_Sync(t *testing.T) {
 	SessionTest(t, 0, BytesTest)
 }
@@ -220,6 +783,578 @@ func Test_Channel(t *testing.T) {
 	server.Stop()
 }
 
+func Test_MaxLifetime(t *testing.T) {
+	server := EchoServer(t, 0)
+	defer server.Stop()
+
+	session, err := Dial("tcp", server.Listener().Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	session.SetMaxLifetime(200 * time.Millisecond)
+
+	for {
+		if session.Send(RandBytes(512)) != nil {
+			break
+		}
+		if _, err := session.Receive(); err != nil {
+			break
+		}
+	}
+	elapsed := time.Since(session.ConnectedAt())
+
+	utest.Assert(t, session.IsClosed())
+	utest.EqualNow(t, session.CloseReason(), MaxLifetimeExceededError)
+	utest.Assert(t, elapsed >= 200*time.Millisecond && elapsed < time.Second, elapsed)
+}
+
+func Test_Interleave(t *testing.T) {
+	c1, c2 := net.Pipe()
+	codec1, _ := NewTestCodec(c1)
+	codec2, _ := NewTestCodec(c2)
+	session := NewSession(codec1, 0)
+	peer := NewSession(codec2, 0)
+	session.SetInterleave(true)
+	defer session.Close()
+	defer peer.Close()
+
+	const n = 1000
+	for i := 1; i <= 2; i++ {
+		go func(b byte) {
+			for j := 0; j < n; j++ {
+				msg := bytes.Repeat([]byte{b}, rand.Intn(512)+1)
+				if session.Send(msg) != nil {
+					return
+				}
+			}
+		}(byte(i))
+	}
+
+	var counts [3]int
+	for i := 0; i < 2*n; i++ {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		b := msg.([]byte)
+		utest.Assert(t, bytes.Equal(b, bytes.Repeat(b[:1], len(b))))
+		counts[b[0]]++
+	}
+	utest.EqualNow(t, counts[1], n)
+	utest.EqualNow(t, counts[2], n)
+}
+
+type countingCodec struct {
+	*TestCodec
+	packets *int32
+}
+
+func (c countingCodec) Packet(dst []byte, msg interface{}) ([]byte, error) {
+	atomic.AddInt32(c.packets, 1)
+	return c.TestCodec.Packet(dst, msg)
+}
+
+func Test_Broadcast(t *testing.T) {
+	var packets int32
+	var sessions, peers [3]*Session
+	for i := range sessions {
+		c1, c2 := net.Pipe()
+		sessions[i] = NewSession(countingCodec{&TestCodec{c1}, &packets}, 10)
+		peers[i] = NewSession(&TestCodec{c2}, 0)
+		defer sessions[i].Close()
+		defer peers[i].Close()
+	}
+	utest.IsNilNow(t, Broadcast([]byte("hello"), sessions[:]...))
+	utest.EqualNow(t, atomic.LoadInt32(&packets), int32(1))
+	for _, peer := range peers {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "hello")
+	}
+}
+
+func Test_ChannelJoin(t *testing.T) {
+	channel := NewChannel()
+	var sessions, peers [3]*Session
+	for i := range sessions {
+		c1, c2 := net.Pipe()
+		sessions[i] = NewSession(&TestCodec{c1}, 10)
+		peers[i] = NewSession(&TestCodec{c2}, 0)
+		defer peers[i].Close()
+		channel.Join(sessions[i])
+	}
+	utest.EqualNow(t, channel.Len(), 3)
+	utest.Assert(t, channel.Leave(sessions[0]))
+	utest.Assert(t, !channel.Leave(sessions[0]))
+	utest.EqualNow(t, channel.Len(), 2)
+
+	utest.IsNilNow(t, channel.Broadcast([]byte("hello")))
+	for _, peer := range peers[1:] {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "hello")
+	}
+
+	sessions[0].Close()
+	sessions[1].Close()
+	for channel.Len() != 1 {
+		runtime.Gosched()
+	}
+	utest.Assert(t, channel.Get(sessions[2].ID()) == sessions[2])
+	sessions[2].Close()
+}
+
+func Test_BroadcastFilter(t *testing.T) {
+	channel := NewChannel()
+
+	var peers [3]*Session
+	for i := 0; i < 3; i++ {
+		c1, c2 := net.Pipe()
+		codec1, _ := NewTestCodec(c1)
+		codec2, _ := NewTestCodec(c2)
+		session := NewSession(codec1, 10)
+		peers[i] = NewSession(codec2, 0)
+		channel.Put(i, session)
+		defer session.Close()
+		defer peers[i].Close()
+	}
+
+	excluded := channel.Get(0)
+	err := channel.BroadcastFilter([]byte("filtered"), func(session *Session) bool {
+		return session != excluded
+	})
+	utest.IsNilNow(t, err)
+	utest.IsNilNow(t, channel.BroadcastFilter([]byte("all"), nil))
+
+	msg, err := peers[0].Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "all")
+
+	for i := 1; i < 3; i++ {
+		msg, err := peers[i].Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "filtered")
+		msg, err = peers[i].Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "all")
+	}
+}
+
+func Test_GoroutineCount(t *testing.T) {
+	c1, c2 := net.Pipe()
+	codec1, _ := NewTestCodec(c1)
+	session := NewSession(codec1, 10)
+	defer c2.Close()
+	utest.EqualNow(t, session.GoroutineCount(), 1)
+
+	session.SetMaxLifetime(time.Hour)
+	session.SetMaxLifetime(2 * time.Hour)
+	utest.EqualNow(t, session.GoroutineCount(), 2)
+
+	session.Close()
+	for session.GoroutineCount() != 0 {
+		runtime.Gosched()
+	}
+}
+
+type RoutingTestCodec struct {
+	TestCodec
+}
+
+func (c *RoutingTestCodec) RoutingKey(msg interface{}) (uint64, error) {
+	return binary.LittleEndian.Uint64(msg.([]byte)), nil
+}
+
+func Test_RouteFirst(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := NewSession(&RoutingTestCodec{TestCodec{c1}}, 0)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	_, _, err := peer.RouteFirst()
+	utest.EqualNow(t, err, RoutingUnsupportedError)
+
+	frame := make([]byte, 12)
+	binary.LittleEndian.PutUint64(frame, 1234)
+	copy(frame[8:], "room")
+	go peer.Send(frame)
+
+	key, msg, err := session.RouteFirst()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, key, uint64(1234))
+	utest.Assert(t, bytes.Equal(msg.([]byte), frame))
+}
+
+func Test_CloseGracefully(t *testing.T) {
+	for _, batch := range []int{0, 4} {
+		c1, c2 := net.Pipe()
+		session := NewSession(&TestCodec{c1}, 10)
+		session.SetWriteBatch(batch)
+		peer := NewSession(&TestCodec{c2}, 0)
+		for i := 0; i < 5; i++ {
+			utest.IsNilNow(t, session.Send([]byte{byte(i)}))
+		}
+		utest.IsNilNow(t, session.SendPriority([]byte{5}, PriorityBulk))
+
+		closed := make(chan error)
+		go func() {
+			closed <- session.CloseGracefully(time.Second)
+		}()
+		for !session.isClosing() {
+			runtime.Gosched()
+		}
+		utest.EqualNow(t, session.Send([]byte("late")), SessionClosingError)
+		for i := 0; i < 6; i++ {
+			msg, err := peer.Receive()
+			utest.IsNilNow(t, err)
+			utest.EqualNow(t, msg.([]byte), []byte{byte(i)})
+		}
+		utest.IsNilNow(t, <-closed)
+		utest.Assert(t, session.IsClosed())
+		utest.IsNilNow(t, session.CloseReason())
+		peer.Close()
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := NewSession(&TestCodec{c1}, 10)
+	utest.IsNilNow(t, session.Send([]byte("stuck")))
+	utest.EqualNow(t, session.CloseGracefully(50*time.Millisecond), DrainTimeoutError)
+	utest.EqualNow(t, session.CloseReason(), DrainTimeoutError)
+	utest.EqualNow(t, session.CloseGracefully(time.Second), SessionClosedError)
+}
+
+func Test_CloseAfterDrain(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := NewSession(&TestCodec{c1}, 0)
+	peer := NewSession(&TestCodec{c2}, 0)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			peer.Send([]byte("trailing"))
+		}
+		peer.Close()
+	}()
+
+	drained := make(chan error)
+	go func() {
+		drained <- session.CloseAfterDrain(time.Second)
+	}()
+	utest.IsNilNow(t, <-drained)
+	utest.Assert(t, session.IsClosed())
+
+	c1, c2 = net.Pipe()
+	session = NewSession(&TestCodec{c1}, 0)
+	defer c2.Close()
+	go func() {
+		drained <- session.CloseAfterDrain(50 * time.Millisecond)
+	}()
+	for !session.isClosing() {
+		runtime.Gosched()
+	}
+	utest.EqualNow(t, session.Send([]byte("x")), SessionClosingError)
+	utest.EqualNow(t, session.SendPacket([]byte("x")), SessionClosingError)
+	utest.Assert(t, !session.IsClosed())
+	utest.EqualNow(t, <-drained, DrainTimeoutError)
+	utest.EqualNow(t, session.Send([]byte("x")), SessionClosedError)
+	utest.EqualNow(t, session.CloseReason(), DrainTimeoutError)
+}
+
+func Test_SendScratch(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := NewSession(&TestCodec{c1}, 0)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	session.SetSendScratch(64)
+	for _, size := range []int{1, 63, 64, 65, 1000} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		go session.Send(msg)
+		recv, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.Assert(t, bytes.Equal(msg, recv.([]byte)), size)
+	}
+	utest.EqualNow(t, cap(session.scratch), 64)
+}
+
+func Test_SendValue(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+
+	c1, c2 := net.Pipe()
+	session := NewSession(&TestCodec{c1}, 0)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	var p point
+	utest.EqualNow(t, session.SendValue(point{1, 2}), SerializerRequiredError)
+
+	session.SetSerializer(JsonSerializer{})
+	peer.SetSerializer(JsonSerializer{})
+	go session.SendValue(point{1, 2})
+	utest.IsNilNow(t, peer.ReadValue(&p))
+	utest.EqualNow(t, p, point{1, 2})
+}
+
+func Test_SendReader(t *testing.T) {
+	for _, sendChanSize := range []int{0, 10} {
+		c1, c2 := net.Pipe()
+		session := NewSession(&TestCodec{c1}, sendChanSize)
+		peer := NewSession(&TestCodec{c2}, 0)
+
+		msg := bytes.Repeat([]byte("link"), 15000)
+		sent := make(chan error, 1)
+		go func() {
+			sent <- session.SendReader(bytes.NewReader(msg), len(msg))
+		}()
+		recv, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.Assert(t, bytes.Equal(msg, recv.([]byte)), sendChanSize)
+		utest.IsNilNow(t, <-sent)
+
+		session.Close()
+		peer.Close()
+	}
+}
+
+func Test_BeforeWrite(t *testing.T) {
+	for _, sendChanSize := range []int{0, 10} {
+		c1, c2 := net.Pipe()
+		session := NewSession(&TestCodec{c1}, sendChanSize)
+		peer := NewSession(&TestCodec{c2}, 0)
+
+		session.SetBeforeWrite(func(_ *Session, packet []byte) ([]byte, error) {
+			return append(packet, '!'), nil
+		})
+		packet := []byte("packet")
+		go func() {
+			session.Send([]byte("message"))
+			session.SendPacket(packet)
+		}()
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "message!")
+		msg, err = peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), "packet!")
+		utest.EqualNow(t, string(packet), "packet")
+
+		hookErr := errors.New("hook failed")
+		session.SetBeforeWrite(func(_ *Session, packet []byte) ([]byte, error) {
+			return nil, hookErr
+		})
+		if sendChanSize == 0 {
+			utest.EqualNow(t, session.Send([]byte("message")), hookErr)
+		} else {
+			session.Send([]byte("message"))
+			WaitClosed(t, session)
+			utest.EqualNow(t, session.CloseReason(), hookErr)
+		}
+
+		session.Close()
+		peer.Close()
+	}
+}
+
+func Test_SendFrozen(t *testing.T) {
+	packet, err := FreezePacket([]byte("frozen"), ProtocolFunc(NewTestCodec))
+	utest.IsNilNow(t, err)
+
+	const n = 20
+	sessions := make([]*Session, n)
+	wait := new(sync.WaitGroup)
+	for i := range sessions {
+		c1, c2 := net.Pipe()
+		sessions[i] = NewSession(&TestCodec{c1}, 100)
+		peer := NewSession(&TestCodec{c2}, 0)
+
+		// Hooks modifying their copy must not affect other sessions.
+		expect := "frozen"
+		if i%2 == 0 {
+			expect = "Frozen"
+			sessions[i].SetBeforeWrite(func(_ *Session, packet []byte) ([]byte, error) {
+				packet[0] = 'F'
+				return packet, nil
+			})
+		}
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			defer peer.Close()
+			for j := 0; j < n; j++ {
+				msg, err := peer.Receive()
+				utest.IsNilNow(t, err)
+				utest.EqualNow(t, string(msg.([]byte)), expect)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		go func() {
+			for _, session := range sessions {
+				utest.IsNil(t, session.SendFrozen(packet))
+			}
+		}()
+	}
+	wait.Wait()
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+func Test_SendOrder(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := NewSession(&TestCodec{c1}, 1000)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	// Messages and packets share the send channel, so they are written in
+	// the order they were queued.
+	for i := 0; i < 1000; i++ {
+		msg := []byte{byte(i), byte(i >> 8)}
+		if i%2 == 0 {
+			utest.IsNilNow(t, session.Send(msg))
+		} else {
+			utest.IsNilNow(t, session.SendPacket(msg))
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, int(msg.([]byte)[0])|int(msg.([]byte)[1])<<8, i)
+	}
+}
+
+func Test_SendPriority(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := NewSession(&TestCodec{c1}, 10)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	// The first message blocks the send goroutine until the peer reads.
+	utest.IsNilNow(t, session.Send([]byte("first")))
+	for len(session.sendChan) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, session.SendPriority([]byte("bulk1"), PriorityBulk))
+	utest.IsNilNow(t, session.Send([]byte("normal")))
+	utest.IsNilNow(t, session.SendPriority([]byte("bulk2"), PriorityBulk))
+	utest.IsNilNow(t, session.SendPriority([]byte("control"), PriorityControl))
+
+	for _, expect := range []string{"first", "control", "normal", "bulk1", "bulk2"} {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), expect)
+	}
+}
+
+func Test_Backpressure(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := NewSession(&TestCodec{c1}, 2)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	var dropped []string
+	onDrop := func(s *Session, msg interface{}) {
+		utest.Assert(t, s == session)
+		dropped = append(dropped, string(msg.([]byte)))
+	}
+
+	// The first message blocks the send goroutine until the peer reads.
+	utest.IsNilNow(t, session.Send([]byte("0")))
+	for len(session.sendChan) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, session.Send([]byte("1")))
+	utest.IsNilNow(t, session.SendPacket([]byte("2")))
+
+	session.SetBackpressure(BackpressureDropNewest, onDrop)
+	utest.IsNilNow(t, session.Send([]byte("3")))
+	session.SetBackpressure(BackpressureDropOldest, onDrop)
+	utest.IsNilNow(t, session.Send([]byte("4")))
+	utest.EqualNow(t, dropped, []string{"3", "1"})
+
+	session.SetBackpressure(BackpressureBlock, onDrop)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- session.Send([]byte("5"))
+	}()
+	for _, expect := range []string{"0", "2", "4", "5"} {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), expect)
+	}
+	utest.IsNilNow(t, <-sent)
+
+	session.SetBackpressure(BackpressureClose, nil)
+	var err error
+	for err == nil {
+		err = session.Send([]byte("x"))
+	}
+	utest.EqualNow(t, err, SessionBlockedError)
+	utest.Assert(t, session.IsClosed())
+}
+
+func Test_BackpressureFlush(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := NewSession(&TestCodec{c1}, 1)
+	defer session.Close()
+	session.SetBackpressure(BackpressureDropOldest, func(*Session, interface{}) {
+		t.Fatal("flush given to onDrop")
+	})
+
+	done := make(chan struct{})
+	lane := make(chan interface{}, 1)
+	lane <- flushMsg(done)
+	utest.IsNilNow(t, session.applyBackpressure(context.Background(), lane, []byte("x")))
+	<-done
+}
+
+type clearCodec struct {
+	*TestCodec
+	cleared chan []string
+}
+
+func (c clearCodec) ClearSendChan(ch <-chan interface{}) {
+	var msgs []string
+	for msg := range ch {
+		msgs = append(msgs, string(msg.([]byte)))
+	}
+	c.cleared <- msgs
+}
+
+func Test_ClearSendChan(t *testing.T) {
+	for _, queue := range []SendQueue{SendQueueChannel, SendQueueLockFree} {
+		DefaultSendQueue = queue
+		c1, c2 := net.Pipe()
+		codec := clearCodec{&TestCodec{c1}, make(chan []string, 2)}
+		session := NewSession(codec, 2)
+		DefaultSendQueue = SendQueueChannel
+
+		// The first message blocks the send goroutine, nobody reads.
+		utest.IsNilNow(t, session.Send([]byte("0")))
+		for session.queueLen() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		utest.IsNilNow(t, session.SendPriority([]byte("bulk"), PriorityBulk))
+		utest.IsNilNow(t, session.Send([]byte("normal")))
+		utest.IsNilNow(t, session.SendPriority([]byte("control"), PriorityControl))
+		session.Close()
+		c2.Close()
+		utest.EqualNow(t, <-codec.cleared, []string{"control", "normal", "bulk"})
+		select {
+		case msgs := <-codec.cleared:
+			t.Fatal("ClearSendChan called again", msgs)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 func Benchmark_BytesToInterface(b *testing.B) {
 	var a = []byte{}
 	var x interface{}
@@ -255,3 +1390,371 @@ func Benchmark_InterfaceToPointer(b *testing.B) {
 	}
 	_ = a
 }
+
+type discardConn struct{}
+
+func (discardConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+func (discardConn) Close() error                { return nil }
+
+type recordLogger struct {
+	sync.Mutex
+	logs []string
+}
+
+func (l *recordLogger) Debug(msg string, keyvals ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.logs = append(l.logs, fmt.Sprintln(append([]interface{}{msg}, keyvals...)...))
+}
+
+func (l *recordLogger) find(msg string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, log := range l.logs {
+		if strings.HasPrefix(log, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_Logger(t *testing.T) {
+	session, peer, err := Pipe(ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+
+	logger := &recordLogger{}
+	session.SetLogger(logger)
+	session.AddSendInterceptor(func(_ *Session, msg interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	utest.IsNilNow(t, session.Send([]byte("drop")))
+	utest.Assert(t, logger.find("message dropped"))
+
+	peer.Close()
+	_, err = session.Receive()
+	utest.NotNilNow(t, err)
+	utest.Assert(t, logger.find("receive failed"))
+	utest.Assert(t, logger.find("session closed"))
+	logger.Lock()
+	first := logger.logs[0]
+	logger.Unlock()
+	utest.Assert(t, strings.Contains(first, fmt.Sprintf(" session %d ", session.ID())))
+}
+
+func Test_Capture(t *testing.T) {
+	session, peer, err := Pipe(ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	defer peer.Close()
+	go func() {
+		for {
+			if _, err := peer.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var binBuf bytes.Buffer
+	utest.IsNilNow(t, session.SetCapture(&binBuf, CaptureBinary))
+	utest.IsNilNow(t, session.Send([]byte("hello")))
+	var data []byte
+	for {
+		record, err := ReadCapture(&binBuf)
+		if err == io.EOF {
+			break
+		}
+		utest.IsNilNow(t, err)
+		utest.Assert(t, record.Sent)
+		utest.Assert(t, !record.Time.IsZero())
+		data = append(data, record.Data...)
+	}
+	utest.EqualNow(t, string(data), "\x05\x00hello")
+
+	var hexBuf bytes.Buffer
+	utest.IsNilNow(t, session.SetCapture(&hexBuf, CaptureHexDump))
+	utest.IsNilNow(t, session.Send([]byte("world")))
+	dump := hexBuf.String()
+	utest.Assert(t, strings.Contains(dump, fmt.Sprintf("session %d send 5 bytes", session.ID())))
+	utest.Assert(t, strings.Contains(dump, "77 6f 72 6c 64"))
+
+	utest.IsNilNow(t, session.SetCapture(nil, CaptureHexDump))
+	utest.IsNilNow(t, session.Send([]byte("quiet")))
+	utest.EqualNow(t, hexBuf.String(), dump)
+	utest.EqualNow(t, binBuf.Len(), 0)
+
+	utest.EqualNow(t, NewSession(&TestCodec{}, 0).SetCapture(&hexBuf, CaptureBinary), CaptureUnsupportedError)
+}
+
+func Test_WriteBuffers(t *testing.T) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer lsn.Close()
+	go func() {
+		conn, err := lsn.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", lsn.Addr().String())
+	utest.IsNilNow(t, err)
+	session, err := NewConnSession(conn, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+
+	var capture bytes.Buffer
+	utest.IsNilNow(t, session.SetCapture(&capture, CaptureBinary))
+	w := session.conn
+	utest.IsNilNow(t, WriteBuffers(w, []byte("ab"), []byte("cd")))
+	w.startBatch()
+	utest.IsNilNow(t, WriteBuffers(w, []byte("ef"), []byte("gh")))
+	utest.IsNilNow(t, w.flush())
+
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(conn, buf)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(buf), "abcdefgh")
+	utest.EqualNow(t, w.Written(), uint64(8))
+	for _, want := range []string{"abcd", "efgh"} {
+		record, err := ReadCapture(&capture)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(record.Data), want)
+	}
+}
+
+func newLockFreeSession(codec Codec, sendChanSize int) *Session {
+	DefaultSendQueue = SendQueueLockFree
+	defer func() { DefaultSendQueue = SendQueueChannel }()
+	return NewSession(codec, sendChanSize)
+}
+
+func Test_LockFreeQueue(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := newLockFreeSession(&TestCodec{c1}, 1000)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	const producers, count = 10, 100
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				utest.IsNilNow(t, session.Send([]byte{byte(p), byte(i)}))
+			}
+		}(p)
+	}
+	next := make([]int, producers)
+	for i := 0; i < producers*count; i++ {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		p, n := msg.([]byte)[0], msg.([]byte)[1]
+		utest.EqualNow(t, int(n), next[p])
+		next[p]++
+	}
+	wg.Wait()
+	utest.EqualNow(t, session.Stats().SendQueueLen, 0)
+
+	// The first message blocks the send goroutine until the peer reads.
+	utest.IsNilNow(t, session.Send([]byte("first")))
+	for session.Stats().SendQueueLen != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, session.SendPriority([]byte("bulk"), PriorityBulk))
+	utest.IsNilNow(t, session.Send([]byte("normal")))
+	utest.IsNilNow(t, session.SendPriority([]byte("control"), PriorityControl))
+	for _, expect := range []string{"first", "control", "normal", "bulk"} {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), expect)
+	}
+}
+
+func Test_LockFreeBackpressure(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := newLockFreeSession(&TestCodec{c1}, 2)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+
+	var dropped []string
+	session.SetBackpressure(BackpressureDropNewest, func(_ *Session, msg interface{}) {
+		dropped = append(dropped, string(msg.([]byte)))
+	})
+	utest.IsNilNow(t, session.Send([]byte("0")))
+	for session.Stats().SendQueueLen != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, session.Send([]byte("1")))
+	utest.IsNilNow(t, session.Send([]byte("2")))
+	utest.IsNilNow(t, session.Send([]byte("3")))
+	utest.EqualNow(t, dropped, []string{"3"})
+
+	session.SetBackpressure(BackpressureBlock, nil)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- session.Send([]byte("4"))
+	}()
+	for _, expect := range []string{"0", "1", "2", "4"} {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), expect)
+	}
+	utest.IsNilNow(t, <-sent)
+
+	session.SetBackpressure(BackpressureClose, nil)
+	var err error
+	for err == nil {
+		err = session.Send([]byte("x"))
+	}
+	utest.EqualNow(t, err, SessionBlockedError)
+	utest.Assert(t, session.IsClosed())
+}
+
+func Test_LockFreeClear(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := newLockFreeSession(&TestCodec{c1}, 10)
+	var failed int32
+	for i := 0; i < 5; i++ {
+		utest.IsNilNow(t, session.SendCallback([]byte("x"), func(err error) {
+			if err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+		}))
+	}
+	session.Close()
+	for atomic.LoadInt32(&failed) != 5 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.EqualNow(t, session.Stats().SendQueueLen, 0)
+}
+
+func benchmarkParallelSend(b *testing.B, session *Session) {
+	defer session.Close()
+	session.SetBackpressure(BackpressureBlock, nil)
+	var msg interface{} = make([]byte, 32)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			session.Send(msg)
+		}
+	})
+}
+
+func Benchmark_ChannelSend(b *testing.B) {
+	benchmarkParallelSend(b, NewSession(&TestCodec{discardConn{}}, 1024))
+}
+
+func Benchmark_LockFreeSend(b *testing.B) {
+	benchmarkParallelSend(b, newLockFreeSession(&TestCodec{discardConn{}}, 1024))
+}
+
+func Test_SendQueueBytes(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session := NewSession(&TestCodec{c1}, 10)
+	peer := NewSession(&TestCodec{c2}, 0)
+	defer session.Close()
+	defer peer.Close()
+	session.SetSendQueueBytes(10)
+
+	var dropped []string
+	onDrop := func(_ *Session, msg interface{}) {
+		dropped = append(dropped, string(msg.([]byte)))
+	}
+
+	// The first message blocks the send goroutine until the peer reads.
+	utest.IsNilNow(t, session.Send([]byte("0")))
+	for session.Stats().SendQueueLen != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, session.Send([]byte("aaaa")))
+	utest.IsNilNow(t, session.SendPacket([]byte("bbbb")))
+	utest.IsNilNow(t, session.Send([]byte("cc")))
+	utest.EqualNow(t, session.Stats().SendQueueBytes, int64(10))
+
+	session.SetBackpressure(BackpressureDropNewest, onDrop)
+	utest.IsNilNow(t, session.Send([]byte("d")))
+	dropErr := make(chan error, 1)
+	utest.IsNilNow(t, session.SendCallback([]byte("d"), func(err error) {
+		dropErr <- err
+	}))
+	utest.EqualNow(t, <-dropErr, QuotaExceededError)
+	session.SetBackpressure(BackpressureDropOldest, onDrop)
+	utest.IsNilNow(t, session.Send([]byte("eeee")))
+	utest.EqualNow(t, dropped, []string{"d", "d", "aaaa"})
+	utest.EqualNow(t, session.Stats().SendQueueBytes, int64(10))
+
+	session.SetBackpressure(BackpressureBlock, nil)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- session.Send([]byte("ff"))
+	}()
+	for _, expect := range []string{"0", "bbbb", "cc", "eeee", "ff"} {
+		msg, err := peer.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(msg.([]byte)), expect)
+	}
+	utest.IsNilNow(t, <-sent)
+	utest.EqualNow(t, session.Stats().SendQueueBytes, int64(0))
+
+	session.SetBackpressure(BackpressureClose, nil)
+	utest.IsNilNow(t, session.Send(make([]byte, 100)))
+	var err error
+	for err == nil {
+		err = session.Send([]byte("x"))
+	}
+	utest.EqualNow(t, err, QuotaExceededError)
+	utest.EqualNow(t, session.CloseReason(), QuotaExceededError)
+	utest.Assert(t, session.IsClosed())
+}
+
+func Test_ManagerSendQueueBytes(t *testing.T) {
+	manager := NewManager()
+	defer manager.Dispose()
+	manager.SetSendQueueBytes(1024)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	session := manager.NewSession(&TestCodec{c1}, 10)
+	utest.EqualNow(t, atomic.LoadInt64(&session.queueBytes.max), int64(1024))
+}
+
+func Test_StreamConn(t *testing.T) {
+	s1, s2, err := Pipe(ProtocolFunc(NewTestCodec), 10)
+	utest.IsNilNow(t, err)
+	s1.SetBackpressure(BackpressureBlock, nil)
+	c1, c2 := NewStreamConn(s1, 4), NewStreamConn(s2, 0)
+	defer c1.Close()
+	defer c2.Close()
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+	go func() {
+		c1.Write(data[:10])
+		c1.Write(data[10:])
+	}()
+	buf := make([]byte, len(data))
+	for read := 0; read < len(buf); {
+		n, err := c2.Read(buf[read:min(read+7, len(buf))])
+		utest.IsNilNow(t, err)
+		read += n
+	}
+	utest.Assert(t, bytes.Equal(buf, data))
+
+	go io.Copy(c2, c2)
+	msg := []byte("hello, stream")
+	n, err := c1.Write(msg)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, n, len(msg))
+	echo := make([]byte, len(msg))
+	_, err = io.ReadFull(c1, echo)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(echo), string(msg))
+
+	utest.Assert(t, c1.RemoteAddr() != nil)
+	utest.EqualNow(t, NewStreamConn(NewSession(&TestCodec{}, 0), 0).LocalAddr().Network(), "link")
+}
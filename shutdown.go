@@ -0,0 +1,44 @@
+package link
+
+import (
+	"context"
+	"errors"
+)
+
+var ServerStoppedError = errors.New("Server Stopped")
+
+// Shutdown stops accepting connections, then sends goodbye, when it's not
+// nil, to every session and closes it once the messages queued for it
+// are written. It returns nil once every handler has returned. When ctx
+// is done first the sessions left are closed at once and ctx.Err() is
+// returned.
+func (server *Server) Shutdown(ctx context.Context, goodbye interface{}) error {
+	server.stopMutex.Lock()
+	server.stopping = true
+	server.stopMutex.Unlock()
+	server.closeListeners()
+
+	for _, session := range server.manager.Sessions() {
+		go func(session *Session) {
+			if goodbye != nil {
+				session.Send(goodbye)
+			}
+			session.closeGracefully(ctx.Done())
+		}(session)
+	}
+
+	handlersDone := make(chan struct{})
+	go func() {
+		server.handlers.Wait()
+		close(handlersDone)
+	}()
+
+	var err error
+	select {
+	case <-handlersDone:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	server.manager.Dispose()
+	return err
+}
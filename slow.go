@@ -0,0 +1,131 @@
+package link
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var SlowConsumerError = errors.New("Slow Consumer")
+
+// SlowConsumerPolicy tells a session what to do once it's found to be a
+// slow consumer.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerClose closes the session with SlowConsumerError.
+	SlowConsumerClose SlowConsumerPolicy = iota
+	// SlowConsumerReport only calls the onSlow function, once per episode.
+	SlowConsumerReport
+)
+
+type slowConsumer struct {
+	queueLen int
+	d        time.Duration
+	policy   SlowConsumerPolicy
+	onSlow   func(*Session)
+}
+
+type slowCounters struct {
+	backlogSince int64
+	writeSince   int64
+	reported     int64
+}
+
+// SetSlowConsumer makes the session a slow consumer once its send queue
+// has held more than queueLen messages for longer than d, or once one
+// write to the connection has blocked for longer than d. Then onSlow is
+// called with the session when it's not nil, and the session is closed or
+// not as told by policy. A negative queueLen only watches the writes.
+// Zero d disables the detection. See also SessionStats.BackloggedFor and
+// SessionStats.WriteBlockedFor.
+func (session *Session) SetSlowConsumer(queueLen int, d time.Duration, policy SlowConsumerPolicy, onSlow func(session *Session)) {
+	atomic.StoreInt64(&session.slow.backlogSince, 0)
+	atomic.StoreInt64(&session.slow.writeSince, 0)
+	session.slowConsumer.Store(slowConsumer{queueLen, d, policy, onSlow})
+	session.startTimers()
+}
+
+func (session *Session) getSlowConsumer() slowConsumer {
+	slow, _ := session.slowConsumer.Load().(slowConsumer)
+	return slow
+}
+
+// queued starts the backlog of the slow consumer detection when the send
+// queue grew past its limit.
+func (session *Session) queued() {
+	slow := session.getSlowConsumer()
+	if slow.d <= 0 || slow.queueLen < 0 || atomic.LoadInt64(&session.slow.backlogSince) != 0 {
+		return
+	}
+	if session.queueLen() > slow.queueLen {
+		atomic.CompareAndSwapInt64(&session.slow.backlogSince, 0, session.getClock().Now().UnixNano())
+	}
+}
+
+// dequeued frees the bytes of msg taken from the send queue, and ends the
+// backlog once the queue is back within its limit.
+func (session *Session) dequeued(msg interface{}) {
+	session.freeBytes(messageSize(msg))
+	if atomic.LoadInt64(&session.slow.backlogSince) == 0 {
+		return
+	}
+	if session.queueLen() <= session.getSlowConsumer().queueLen {
+		atomic.StoreInt64(&session.slow.backlogSince, 0)
+	}
+}
+
+// timeWrite calls write and records how long it blocks when the slow
+// consumer detection is enabled.
+func (session *Session) timeWrite(write func() error) error {
+	if session.getSlowConsumer().d <= 0 {
+		return write()
+	}
+	atomic.StoreInt64(&session.slow.writeSince, session.getClock().Now().UnixNano())
+	err := write()
+	atomic.StoreInt64(&session.slow.writeSince, 0)
+	return err
+}
+
+func since(now time.Time, nsec int64) time.Duration {
+	if nsec == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, nsec))
+}
+
+// checkSlowConsumer reports or closes a slow consumer, otherwise it
+// returns the next time the session needs to be checked.
+func (session *Session) checkSlowConsumer(now, next time.Time) time.Time {
+	slow := session.getSlowConsumer()
+	if slow.d <= 0 {
+		return next
+	}
+	var start int64
+	for _, at := range []int64{
+		atomic.LoadInt64(&session.slow.backlogSince),
+		atomic.LoadInt64(&session.slow.writeSince),
+	} {
+		if at == 0 {
+			continue
+		}
+		deadline := time.Unix(0, at).Add(slow.d)
+		if now.Before(deadline) {
+			next = earliest(next, deadline)
+		} else if start == 0 {
+			start = at
+		}
+	}
+	if start != 0 && atomic.SwapInt64(&session.slow.reported, start) != start {
+		session.debug("slow consumer")
+		if slow.onSlow != nil {
+			slow.onSlow(session)
+		}
+		if slow.policy == SlowConsumerClose {
+			session.close(SlowConsumerError)
+			return next
+		}
+	}
+	// A backlog or a write starting from now on can't be late before d.
+	return earliest(next, now.Add(slow.d))
+}
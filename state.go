@@ -0,0 +1,32 @@
+//go:build go1.18
+// +build go1.18
+
+package link
+
+// StateOf returns session.State as a T, the second result is false when
+// the state is unset or holds another type.
+func StateOf[T any](session *Session) (T, bool) {
+	session.stateMutex.Lock()
+	defer session.stateMutex.Unlock()
+	state, ok := session.State.(T)
+	return state, ok
+}
+
+// SetState sets session.State to state.
+func SetState[T any](session *Session, state T) {
+	session.stateMutex.Lock()
+	defer session.stateMutex.Unlock()
+	session.State = state
+}
+
+// UpdateState replaces session.State with the result of update, which is
+// called with the current state as by StateOf while no other StateOf,
+// SetState or UpdateState call can run on the session.
+func UpdateState[T any](session *Session, update func(state T, ok bool) T) T {
+	session.stateMutex.Lock()
+	defer session.stateMutex.Unlock()
+	state, ok := session.State.(T)
+	state = update(state, ok)
+	session.State = state
+	return state
+}
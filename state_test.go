@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package link
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/funny/utest"
+)
+
+type testState struct {
+	User string
+}
+
+func Test_State(t *testing.T) {
+	session := NewSession(&TestCodec{}, 0)
+
+	_, ok := StateOf[*testState](session)
+	utest.Assert(t, !ok)
+
+	SetState(session, &testState{User: "alice"})
+	state, ok := StateOf[*testState](session)
+	utest.Assert(t, ok)
+	utest.EqualNow(t, state.User, "alice")
+	_, ok = StateOf[string](session)
+	utest.Assert(t, !ok)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			UpdateState(session, func(state int, ok bool) int {
+				return state + 1
+			})
+		}()
+	}
+	wg.Wait()
+	count, ok := StateOf[int](session)
+	utest.Assert(t, ok)
+	utest.EqualNow(t, count, 100)
+}
@@ -0,0 +1,97 @@
+package link
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats is a snapshot of a session's traffic. Byte counts are
+// zero for sessions created by NewSession, which have no connection.
+// ReadErrors and SendErrors count the failures that closed the session.
+// BackloggedFor and WriteBlockedFor tell for how long the send queue has
+// been over the limit of SetSlowConsumer and the current write has been
+// blocking, they're zero when the detection is disabled.
+// SuspiciousFrames is reported by codecs implementing FramingStats.
+type SessionStats struct {
+	BytesSent        uint64
+	BytesReceived    uint64
+	MessagesSent     uint64
+	MessagesReceived uint64
+	LastSent         time.Time
+	LastReceived     time.Time
+	SendQueueLen     int
+	SendQueueBytes   int64
+	ReadErrors       uint64
+	SendErrors       uint64
+	BackloggedFor    time.Duration
+	WriteBlockedFor  time.Duration
+	SuspiciousFrames uint64
+}
+
+type sessionCounters struct {
+	messagesSent     uint64
+	messagesReceived uint64
+	lastSent         int64
+	lastReceived     int64
+	readErrors       uint64
+	sendErrors       uint64
+}
+
+func (session *Session) Stats() SessionStats {
+	counters := &session.counters
+	stats := SessionStats{
+		MessagesSent:     atomic.LoadUint64(&counters.messagesSent),
+		MessagesReceived: atomic.LoadUint64(&counters.messagesReceived),
+		LastSent:         unixTime(atomic.LoadInt64(&counters.lastSent)),
+		LastReceived:     unixTime(atomic.LoadInt64(&counters.lastReceived)),
+		ReadErrors:       atomic.LoadUint64(&counters.readErrors),
+		SendErrors:       atomic.LoadUint64(&counters.sendErrors),
+	}
+	if session.conn != nil {
+		stats.BytesSent = session.conn.Written()
+		stats.BytesReceived = session.conn.BytesRead()
+	}
+	if codec, ok := session.codec.(FramingStats); ok {
+		stats.SuspiciousFrames = codec.SuspiciousFrames()
+	}
+	stats.SendQueueLen = session.queueLen()
+	stats.SendQueueBytes = atomic.LoadInt64(&session.queueBytes.bytes)
+	now := session.getClock().Now()
+	stats.BackloggedFor = since(now, atomic.LoadInt64(&session.slow.backlogSince))
+	stats.WriteBlockedFor = since(now, atomic.LoadInt64(&session.slow.writeSince))
+	return stats
+}
+
+func (session *Session) queueLen() int {
+	if session.sendChan == nil {
+		return 0
+	}
+	n := len(session.controlChan) + len(session.sendChan) + len(session.bulkChan)
+	if session.mpsc != nil {
+		n += session.mpsc.len()
+	}
+	return n
+}
+
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// sent records that a message was sent.
+func (session *Session) sent() {
+	now := session.getClock().Now().UnixNano()
+	atomic.AddUint64(&session.counters.messagesSent, 1)
+	atomic.StoreInt64(&session.counters.lastSent, now)
+	atomic.StoreInt64(&session.lastActive, now)
+}
+
+// received records that a message was received.
+func (session *Session) received() {
+	now := session.getClock().Now().UnixNano()
+	atomic.AddUint64(&session.counters.messagesReceived, 1)
+	atomic.StoreInt64(&session.counters.lastReceived, now)
+	atomic.StoreInt64(&session.lastActive, now)
+}
@@ -0,0 +1,124 @@
+package link
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var _ net.Conn = (*StreamConn)(nil)
+
+// StreamConn is a net.Conn view of a session whose codec sends and
+// receives []byte messages, such as codec.FixLen(codec.Bytes(), ...), so
+// code written for a byte stream, such as yamux or SSH, can run over
+// link protocols. Every Write is sent as one message, or as several of at
+// most maxPacket bytes, and Read returns the bytes of the received
+// messages in order, keeping what doesn't fit in p for the next Read.
+// Asynchronous sessions should use BackpressureBlock so that writes
+// wait for room in the send queue like on a connection.
+type StreamConn struct {
+	session   *Session
+	maxPacket int
+	readMutex sync.Mutex
+	pending   []byte
+}
+
+// NewStreamConn returns a net.Conn view of session that splits writes in
+// messages of at most maxPacket bytes, or doesn't split them when it's
+// zero. The session must not be used directly meanwhile.
+func NewStreamConn(session *Session, maxPacket int) *StreamConn {
+	return &StreamConn{session: session, maxPacket: maxPacket}
+}
+
+// Session returns the session the conn reads and writes.
+func (c *StreamConn) Session() *Session {
+	return c.session
+}
+
+func (c *StreamConn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	for len(c.pending) == 0 {
+		msg, err := c.session.Receive()
+		if err != nil {
+			return 0, err
+		}
+		b, ok := msg.([]byte)
+		if !ok {
+			return 0, NotBytesMessageError
+		}
+		c.pending = b
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends p, asynchronous sessions queue a copy of it.
+func (c *StreamConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		packet := p
+		if c.maxPacket > 0 && len(packet) > c.maxPacket {
+			packet = packet[:c.maxPacket]
+		}
+		if c.session.sendChan != nil {
+			packet = append([]byte(nil), packet...)
+		}
+		if err := c.session.Send(packet); err != nil {
+			return written, err
+		}
+		written += len(packet)
+		p = p[len(packet):]
+	}
+	return written, nil
+}
+
+func (c *StreamConn) Close() error {
+	return c.session.Close()
+}
+
+type sessionAddr uint64
+
+func (a sessionAddr) Network() string {
+	return "link"
+}
+
+func (a sessionAddr) String() string {
+	return fmt.Sprintf("session %d", uint64(a))
+}
+
+// LocalAddr returns the local address of the session's connection, or an
+// address naming the session when it has none.
+func (c *StreamConn) LocalAddr() net.Addr {
+	if conn := c.session.Conn(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return sessionAddr(c.session.ID())
+}
+
+// RemoteAddr is like LocalAddr for the address of the peer.
+func (c *StreamConn) RemoteAddr() net.Addr {
+	if addr := c.session.RemoteAddr(); addr != nil {
+		return addr
+	}
+	return sessionAddr(c.session.ID())
+}
+
+// SetDeadline sets the read and write deadlines of the session. A read
+// timing out closes the session, as a Receive does.
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	if err := c.session.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.session.SetWriteDeadline(t)
+}
+
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	return c.session.SetReadDeadline(t)
+}
+
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	return c.session.SetWriteDeadline(t)
+}
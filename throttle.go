@@ -0,0 +1,123 @@
+package link
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ipThrottle limits the connections accepted from each remote IP.
+type ipThrottle struct {
+	mutex      sync.Mutex
+	rate       float64
+	burst      float64
+	max        int
+	onThrottle func(net.Conn)
+	ips        map[string]*ipState
+	lastSweep  time.Time
+}
+
+type ipState struct {
+	tokens   float64
+	last     time.Time
+	sessions int
+}
+
+// SetIPThrottle limits each remote IP to rate new connections per second,
+// with bursts of up to burst, and to max sessions at once. A throttled
+// connection is given to onThrottle, when it's not nil, and closed before
+// any session is created for it. Zero rate or max removes that limit, a
+// burst below 1 defaults to rate. It must be called before Serve.
+func (server *Server) SetIPThrottle(rate, burst, max int, onThrottle func(conn net.Conn)) {
+	server.throttle = nil
+	if burst < 1 {
+		burst = rate
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	if rate > 0 || max > 0 {
+		server.throttle = &ipThrottle{
+			rate:       float64(rate),
+			burst:      float64(burst),
+			max:        max,
+			onThrottle: onThrottle,
+			ips:        make(map[string]*ipState),
+			lastSweep:  time.Now(),
+		}
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// admit counts a new session of the IP of conn, or gives conn to
+// onThrottle and closes it when the IP is over its limits.
+func (t *ipThrottle) admit(conn net.Conn) bool {
+	if t.take(remoteIP(conn)) {
+		return true
+	}
+	if t.onThrottle != nil {
+		t.onThrottle(conn)
+	}
+	conn.Close()
+	return false
+}
+
+func (t *ipThrottle) take(ip string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(t.lastSweep) > time.Minute {
+		t.sweep(now)
+	}
+	state, ok := t.ips[ip]
+	if !ok {
+		state = &ipState{tokens: t.burst, last: now}
+		t.ips[ip] = state
+	}
+	if t.max > 0 && state.sessions >= t.max {
+		return false
+	}
+	if t.rate > 0 {
+		state.refill(now, t.rate, t.burst)
+		if state.tokens < 1 {
+			return false
+		}
+		state.tokens--
+	}
+	state.sessions++
+	return true
+}
+
+func (t *ipThrottle) leave(conn net.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if state, ok := t.ips[remoteIP(conn)]; ok {
+		state.sessions--
+	}
+}
+
+// sweep forgets the IPs without sessions whose rate limit has recovered.
+func (t *ipThrottle) sweep(now time.Time) {
+	t.lastSweep = now
+	for ip, state := range t.ips {
+		state.refill(now, t.rate, t.burst)
+		if state.sessions == 0 && state.tokens >= t.burst {
+			delete(t.ips, ip)
+		}
+	}
+}
+
+func (state *ipState) refill(now time.Time, rate, burst float64) {
+	state.tokens += now.Sub(state.last).Seconds() * rate
+	if state.tokens > burst {
+		state.tokens = burst
+	}
+	state.last = now
+}
@@ -0,0 +1,200 @@
+package link
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionTimers holds the settings of the time based session features.
+// They are all served by one goroutine per session, started the first
+// time one of them is enabled.
+type sessionTimers struct {
+	mutex    sync.Mutex
+	started  bool
+	wakeChan chan int
+
+	maxLifetime time.Duration
+	idleTimeout time.Duration
+
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	lastPing          time.Time
+	pongsAtPing       uint64
+	waitingPong       bool
+}
+
+// SetMaxLifetime closes the session with MaxLifetimeExceededError once d
+// has elapsed since ConnectedAt, whether or not the session is active.
+// Zero disables the limit.
+func (session *Session) SetMaxLifetime(d time.Duration) {
+	session.timers.mutex.Lock()
+	session.timers.maxLifetime = d
+	session.timers.mutex.Unlock()
+	session.startTimers()
+}
+
+// SetIdleTimeout closes the session with IdleTimeoutError once d has
+// elapsed without a message sent or received. Zero disables the limit.
+func (session *Session) SetIdleTimeout(d time.Duration) {
+	session.timers.mutex.Lock()
+	session.timers.idleTimeout = d
+	session.timers.mutex.Unlock()
+	session.touch()
+	session.startTimers()
+}
+
+// touch restarts the idle timeout.
+func (session *Session) touch() {
+	atomic.StoreInt64(&session.lastActive, session.getClock().Now().UnixNano())
+}
+
+// SetHeartbeat makes the session ping the peer every interval and close
+// with HeartbeatTimeoutError when no pong arrives within timeout. The codec
+// must implement PingCodec, which handles the pings and pongs inside
+// Receive, so the session must keep receiving. Zero interval disables it.
+func (session *Session) SetHeartbeat(interval, timeout time.Duration) error {
+	if _, ok := session.codec.(PingCodec); !ok {
+		return HeartbeatUnsupportedError
+	}
+	session.timers.mutex.Lock()
+	session.timers.heartbeatInterval = interval
+	session.timers.heartbeatTimeout = timeout
+	session.timers.waitingPong = false
+	session.timers.lastPing = session.getClock().Now()
+	session.timers.mutex.Unlock()
+	session.startTimers()
+	return nil
+}
+
+// startTimers starts the timer goroutine if needed, otherwise it wakes the
+// goroutine up to pick up the new settings.
+func (session *Session) startTimers() {
+	timers := &session.timers
+	timers.mutex.Lock()
+	if !timers.started {
+		timers.started = true
+		timers.wakeChan = make(chan int, 1)
+		timers.mutex.Unlock()
+		session.goFunc(session.timerLoop)
+		return
+	}
+	timers.mutex.Unlock()
+	session.wakeTimers()
+}
+
+func (session *Session) wakeTimers() {
+	timers := &session.timers
+	timers.mutex.Lock()
+	defer timers.mutex.Unlock()
+	if !timers.started {
+		return
+	}
+	select {
+	case timers.wakeChan <- 1:
+	default:
+	}
+}
+
+func (session *Session) timerLoop() {
+	for {
+		clock := session.getClock()
+		now := clock.Now()
+		next := session.checkTimers(now)
+		if session.IsClosed() {
+			return
+		}
+
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			timeout = clock.After(next.Sub(now))
+		}
+
+		select {
+		case <-timeout:
+		case <-session.timers.wakeChan:
+		case <-session.closeChan:
+		}
+	}
+}
+
+// checkTimers closes the session if one of its timers expired, otherwise
+// it returns the next time a timer needs to be checked.
+func (session *Session) checkTimers(now time.Time) (next time.Time) {
+	timers := &session.timers
+	timers.mutex.Lock()
+	maxLifetime := timers.maxLifetime
+	idleTimeout := timers.idleTimeout
+	timers.mutex.Unlock()
+
+	if maxLifetime > 0 {
+		deadline := session.ConnectedAt().Add(maxLifetime)
+		if !now.Before(deadline) {
+			session.close(MaxLifetimeExceededError)
+			return
+		}
+		next = earliest(next, deadline)
+	}
+
+	if idleTimeout > 0 {
+		deadline := time.Unix(0, atomic.LoadInt64(&session.lastActive)).Add(idleTimeout)
+		if !now.Before(deadline) {
+			session.close(IdleTimeoutError)
+			return
+		}
+		next = earliest(next, deadline)
+	}
+
+	timers.mutex.Lock()
+	interval := timers.heartbeatInterval
+	timers.mutex.Unlock()
+	if interval > 0 {
+		var err error
+		if next, err = session.checkHeartbeat(now, next); err != nil {
+			session.close(err)
+			return
+		}
+	}
+	return session.checkSlowConsumer(now, next)
+}
+
+// checkHeartbeat sends a ping when the interval elapsed and fails when the
+// pong of the last ping is late.
+func (session *Session) checkHeartbeat(now, next time.Time) (time.Time, error) {
+	codec := session.codec.(PingCodec)
+	timers := &session.timers
+	timers.mutex.Lock()
+	if timers.waitingPong && codec.Pongs() != timers.pongsAtPing {
+		timers.waitingPong = false
+	}
+	if timers.waitingPong {
+		deadline := timers.lastPing.Add(timers.heartbeatTimeout)
+		timers.mutex.Unlock()
+		if !now.Before(deadline) {
+			return next, HeartbeatTimeoutError
+		}
+		return earliest(next, deadline), nil
+	}
+	pingAt := timers.lastPing.Add(timers.heartbeatInterval)
+	if now.Before(pingAt) {
+		timers.mutex.Unlock()
+		return earliest(next, pingAt), nil
+	}
+	timers.pongsAtPing = codec.Pongs()
+	timers.lastPing = now
+	timers.waitingPong = true
+	timeout := timers.heartbeatTimeout
+	timers.mutex.Unlock()
+
+	if err := codec.Ping(); err != nil {
+		return next, err
+	}
+	return earliest(next, now.Add(timeout)), nil
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
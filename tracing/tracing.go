@@ -0,0 +1,248 @@
+// Package tracing traces the messages of link sessions with
+// OpenTelemetry. New is a protocol that carries the trace context of
+// every message in a header, and Trace starts the spans of the messages a
+// session sends and receives.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/funny/link"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrBadHeader = errors.New("Bad Trace Header")
+
+const (
+	sessionIDKey = attribute.Key("link.session.id")
+	sizeKey      = attribute.Key("messaging.message.body.size")
+)
+
+// Message is a message with the context of its trace. Send a message
+// returned by WithContext to make it part of a trace, received messages
+// are always a *Message.
+type Message struct {
+	Ctx  context.Context
+	Msg  interface{}
+	size int
+	span trace.Span
+}
+
+// WithContext returns msg to send as part of the trace of ctx.
+func WithContext(ctx context.Context, msg interface{}) *Message {
+	return &Message{Ctx: ctx, Msg: msg}
+}
+
+// New prefixes every message encoded by base with a header holding the
+// trace context of the message, injected and extracted by propagator, or
+// by otel.GetTextMapPropagator() when it's nil. Plain messages are sent
+// with an empty header. It reads a whole message from the connection, so
+// it's meant to be wrapped by a framing protocol such as codec.FixLen.
+func New(base link.Protocol, propagator propagation.TextMapPropagator) link.Protocol {
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+	return &tracingProtocol{base, propagator}
+}
+
+// Trace makes session start a span with tracer for every message it sends
+// or receives, with the session id and the message size as attributes.
+// The protocol of the session must be made by New.
+func Trace(session *link.Session, tracer trace.Tracer) {
+	session.AddSendInterceptor(SendInterceptor(tracer))
+	session.AddRecvInterceptor(RecvInterceptor(tracer))
+}
+
+// SendInterceptor starts the spans of Trace for sent messages, such as
+// for Server.AddSendInterceptor. The spans end once the messages are
+// encoded by the protocol of New, including by PacketCodec.Packet.
+func SendInterceptor(tracer trace.Tracer) link.Interceptor {
+	return func(session *link.Session, msg interface{}) (interface{}, error) {
+		ctx := context.Background()
+		if m, ok := msg.(*Message); ok {
+			ctx, msg = m.Ctx, m.Msg
+		}
+		ctx, span := tracer.Start(ctx, "link.send",
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(sessionIDKey.Int64(int64(session.ID()))),
+		)
+		return &Message{Ctx: ctx, Msg: msg, span: span}, nil
+	}
+}
+
+// RecvInterceptor records the spans of Trace for received messages, such
+// as for Server.AddRecvInterceptor. The Ctx of the messages then holds
+// their span.
+func RecvInterceptor(tracer trace.Tracer) link.Interceptor {
+	return func(session *link.Session, msg interface{}) (interface{}, error) {
+		m, ok := msg.(*Message)
+		if !ok {
+			return msg, nil
+		}
+		ctx, span := tracer.Start(m.Ctx, "link.receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(sessionIDKey.Int64(int64(session.ID())), sizeKey.Int(m.size)),
+		)
+		span.End()
+		return &Message{Ctx: ctx, Msg: m.Msg, size: m.size}, nil
+	}
+}
+
+type tracingProtocol struct {
+	base       link.Protocol
+	propagator propagation.TextMapPropagator
+}
+
+func (p *tracingProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	codec := &tracingCodec{
+		rw:         rw,
+		propagator: p.propagator,
+	}
+	var err error
+	codec.base, err = p.base.NewCodec(&codec.buf)
+	if err != nil {
+		return nil, err
+	}
+	return codec, nil
+}
+
+type bufReadWriter struct {
+	recvBuf bytes.Reader
+	sendBuf bytes.Buffer
+}
+
+func (rw *bufReadWriter) Read(p []byte) (int, error) {
+	return rw.recvBuf.Read(p)
+}
+
+func (rw *bufReadWriter) Write(p []byte) (int, error) {
+	return rw.sendBuf.Write(p)
+}
+
+type tracingCodec struct {
+	base       link.Codec
+	rw         io.ReadWriter
+	propagator propagation.TextMapPropagator
+	buf        bufReadWriter
+	header     []byte
+}
+
+func (c *tracingCodec) Receive() (interface{}, error) {
+	data, err := ioutil.ReadAll(c.rw)
+	if err != nil {
+		return nil, err
+	}
+	carrier, body, err := decodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	c.buf.recvBuf.Reset(body)
+	msg, err := c.base.Receive()
+	if err != nil {
+		return nil, err
+	}
+	ctx := c.propagator.Extract(context.Background(), carrier)
+	return &Message{Ctx: ctx, Msg: msg, size: len(body)}, nil
+}
+
+func (c *tracingCodec) Send(msg interface{}) error {
+	m, ok := msg.(*Message)
+	if !ok {
+		m = &Message{Ctx: context.Background(), Msg: msg}
+	}
+	err := c.send(m)
+	if m.span != nil {
+		if err != nil {
+			m.span.RecordError(err)
+			m.span.SetStatus(codes.Error, err.Error())
+		}
+		m.span.End()
+	}
+	return err
+}
+
+func (c *tracingCodec) send(m *Message) error {
+	carrier := propagation.MapCarrier{}
+	c.propagator.Inject(m.Ctx, carrier)
+	c.header = encodeHeader(c.header[:0], carrier)
+
+	c.buf.sendBuf.Reset()
+	c.buf.sendBuf.Write(c.header)
+	if err := c.base.Send(m.Msg); err != nil {
+		return err
+	}
+	if m.span != nil {
+		m.span.SetAttributes(sizeKey.Int(c.buf.sendBuf.Len() - len(c.header)))
+	}
+	_, err := c.rw.Write(c.buf.sendBuf.Bytes())
+	return err
+}
+
+func (c *tracingCodec) Close() error {
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// encodeHeader appends the uvarint count of the carrier's fields followed
+// by each key and value prefixed with their uvarint length.
+func encodeHeader(dst []byte, carrier propagation.MapCarrier) []byte {
+	dst = appendUvarint(dst, uint64(len(carrier)))
+	for key, value := range carrier {
+		dst = appendUvarint(dst, uint64(len(key)))
+		dst = append(dst, key...)
+		dst = appendUvarint(dst, uint64(len(value)))
+		dst = append(dst, value...)
+	}
+	return dst
+}
+
+func decodeHeader(data []byte) (propagation.MapCarrier, []byte, error) {
+	n, data, ok := readUvarint(data)
+	if !ok || n > uint64(len(data)) {
+		return nil, nil, ErrBadHeader
+	}
+	carrier := make(propagation.MapCarrier, n)
+	for i := uint64(0); i < n; i++ {
+		var key, value []byte
+		if key, data, ok = readString(data); !ok {
+			return nil, nil, ErrBadHeader
+		}
+		if value, data, ok = readString(data); !ok {
+			return nil, nil, ErrBadHeader
+		}
+		carrier[string(key)] = string(value)
+	}
+	return carrier, data, nil
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func readUvarint(data []byte) (uint64, []byte, bool) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return v, data[n:], true
+}
+
+func readString(data []byte) ([]byte, []byte, bool) {
+	n, data, ok := readUvarint(data)
+	if !ok || n > uint64(len(data)) {
+		return nil, nil, false
+	}
+	return data[:n], data[n:], true
+}
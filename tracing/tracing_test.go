@@ -0,0 +1,108 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func Test_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := provider.Tracer("link")
+
+	protocol := codec.FixLen(New(codec.Bytes(), propagation.TraceContext{}), 2, binary.LittleEndian, 1024, 1024)
+	client, server, err := link.Pipe(protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	Trace(client, tracer)
+	Trace(server, tracer)
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	sent := make(chan error, 1)
+	go func() {
+		sent <- client.Send(WithContext(ctx, []byte("hello")))
+	}()
+
+	msg, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+	m, ok := msg.(*Message)
+	if !ok {
+		t.Fatalf("unexpected message: %#v", msg)
+	}
+	if string(m.Msg.([]byte)) != "hello" {
+		t.Fatalf("message not match: %q", m.Msg)
+	}
+	if trace.SpanContextFromContext(m.Ctx).TraceID() != parent.SpanContext().TraceID() {
+		t.Fatal("trace not propagated")
+	}
+
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	send, recv := spans["link.send"], spans["link.receive"]
+	if send == nil || recv == nil {
+		t.Fatalf("unexpected spans: %v", spans)
+	}
+	if send.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatal("send span not child of parent")
+	}
+	if recv.Parent().SpanID() != send.SpanContext().SpanID() || !recv.Parent().IsRemote() {
+		t.Fatal("receive span not child of send span")
+	}
+	for _, span := range []sdktrace.ReadOnlySpan{send, recv} {
+		attrs := map[string]int64{}
+		for _, kv := range span.Attributes() {
+			attrs[string(kv.Key)] = kv.Value.AsInt64()
+		}
+		if attrs[string(sizeKey)] != 5 {
+			t.Fatalf("unexpected size of %s: %v", span.Name(), attrs)
+		}
+		if _, ok := attrs[string(sessionIDKey)]; !ok {
+			t.Fatalf("no session id on %s", span.Name())
+		}
+	}
+}
+
+func Test_Untraced(t *testing.T) {
+	protocol := codec.FixLen(New(codec.Bytes(), propagation.TraceContext{}), 2, binary.LittleEndian, 1024, 1024)
+	client, server, err := link.Pipe(protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	go client.Send([]byte("hello"))
+	msg, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := msg.(*Message)
+	if string(m.Msg.([]byte)) != "hello" || trace.SpanContextFromContext(m.Ctx).IsValid() {
+		t.Fatalf("unexpected message: %#v", m)
+	}
+}
+
+func Test_BadHeader(t *testing.T) {
+	if _, _, err := decodeHeader([]byte{2, 5, 'a'}); err != ErrBadHeader {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+// Package udp runs link sessions over UDP. Every Write of a session is
+// sent as one datagram, so a protocol that writes each packet with a
+// single Write, like codec.FixLen's Send, maps packets to datagrams 1:1.
+// Reads return the received datagrams back to back. Datagrams may be lost
+// or reordered, so the protocol should be able to cope with that.
+package udp
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/funny/link"
+)
+
+const maxDatagram = 64 * 1024
+
+// Listen serves a session for every remote address that sends datagrams
+// to the UDP address.
+func Listen(address string, protocol link.Protocol, sendChanSize int, handler link.Handler) (*link.Server, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return link.NewServer(NewListener(conn, 64), protocol, sendChanSize, handler), nil
+}
+
+func Dial(address string, protocol link.Protocol, sendChanSize int) (*link.Session, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return link.NewConnSession(&clientConn{Conn: conn}, protocol, sendChanSize)
+}
+
+type clientConn struct {
+	net.Conn
+	buf     []byte
+	pending []byte
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, maxDatagram)
+		}
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.buf[:n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Listener demultiplexes the datagrams received by a PacketConn into one
+// connection per remote address.
+type Listener struct {
+	conn      net.PacketConn
+	queueSize int
+	accept    chan *Conn
+	closeChan chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	conns     map[string]*Conn
+}
+
+// NewListener creates a listener on conn. Every connection queues up to
+// queueSize datagrams, more are dropped until it reads again.
+func NewListener(conn net.PacketConn, queueSize int) *Listener {
+	l := &Listener{
+		conn:      conn,
+		queueSize: queueSize,
+		accept:    make(chan *Conn),
+		closeChan: make(chan struct{}),
+		conns:     make(map[string]*Conn),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *Listener) readLoop() {
+	defer l.Close()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		datagram := append([]byte(nil), buf[:n]...)
+
+		l.mutex.Lock()
+		conn, ok := l.conns[addr.String()]
+		if !ok {
+			conn = newConn(l, addr)
+			l.conns[addr.String()] = conn
+		}
+		l.mutex.Unlock()
+
+		if !ok {
+			select {
+			case l.accept <- conn:
+			case <-l.closeChan:
+				return
+			}
+		}
+		select {
+		case conn.recvChan <- datagram:
+		default:
+		}
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closeChan:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the PacketConn and all connections of the listener.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *Listener) remove(conn *Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conns[conn.addr.String()] == conn {
+		delete(l.conns, conn.addr.String())
+	}
+}
+
+// Conn is the connection of one remote address on a Listener. Only read
+// deadlines are supported.
+type Conn struct {
+	listener  *Listener
+	addr      net.Addr
+	recvChan  chan []byte
+	pending   []byte
+	closeChan chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	deadline  time.Time
+}
+
+func newConn(listener *Listener, addr net.Addr) *Conn {
+	return &Conn{
+		listener:  listener,
+		addr:      addr,
+		recvChan:  make(chan []byte, listener.queueSize),
+		closeChan: make(chan struct{}),
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		var timeout <-chan time.Time
+		c.mutex.Lock()
+		deadline := c.deadline
+		c.mutex.Unlock()
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case c.pending = <-c.recvChan:
+		case <-c.closeChan:
+			return 0, net.ErrClosed
+		case <-c.listener.closeChan:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends b as one datagram.
+func (c *Conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closeChan:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.listener.conn.WriteTo(b, c.addr)
+}
+
+// Close stops the connection. Datagrams received from the same address
+// afterwards are accepted as a new connection.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		c.listener.remove(c)
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.listener.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+)
+
+func Test_UDP(t *testing.T) {
+	protocol := codec.FixLen(codec.Bytes(), 2, binary.LittleEndian, 4096, 4096)
+	server, err := Listen("127.0.0.1:0", protocol, 0, link.HandlerFunc(func(session *link.Session) {
+		defer session.Close()
+		for {
+			msg, err := session.Receive()
+			if err != nil || session.Send(msg) != nil {
+				return
+			}
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	addr := server.Listener().Addr().String()
+	sessions := make([]*link.Session, 2)
+	for i := range sessions {
+		if sessions[i], err = Dial(addr, protocol, 0); err != nil {
+			t.Fatal(err)
+		}
+		defer sessions[i].Close()
+	}
+	for i := 0; i < 20; i++ {
+		for j, session := range sessions {
+			msg := bytes.Repeat([]byte{byte(j)}, i*100+1)
+			if err := session.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+			recv, err := session.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg, recv.([]byte)) {
+				t.Fatalf("message not match on session %d", j)
+			}
+		}
+	}
+	if n := server.SessionCount(); n != 2 {
+		t.Fatalf("unexpected session count: %d", n)
+	}
+}
+
+func Test_UDPPacket(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protocol := codec.FixLen(codec.Bytes(), 2, binary.BigEndian, 4096, 4096)
+	session, err := Dial(conn.LocalAddr().String(), protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err := session.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	packetCodec := session.Codec().(link.PacketCodec)
+	packet, _ := packetCodec.Packet(nil, []byte("hello"))
+	if err := packetCodec.SendPacket(packet); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "\x00\x05hello" {
+			t.Fatalf("datagram %d: %q", i, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package link
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ListenUnix listens on a unix socket at path and makes it accessible with
+// perm. A socket file left behind by a previous process is removed first.
+// The file is removed again when the server stops.
+func ListenUnix(path string, perm os.FileMode, protocol Protocol, sendChanSize int, handler Handler) (*Server, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, &net.OpError{Op: "listen", Net: "unix", Err: syscall.EADDRINUSE}
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return NewServer(listener, protocol, sendChanSize, handler), nil
+}
+
+const systemdFirstFd = 3
+
+// SystemdListeners returns the listeners passed by systemd socket
+// activation, keyed by the names in FileDescriptorName=. Unnamed sockets
+// are named "unknown". It returns nil when the process was not activated
+// by systemd. The environment variables are cleared, so child processes
+// don't take the sockets too.
+func SystemdListeners() (map[string][]net.Listener, error) {
+	return systemdListeners(systemdFirstFd)
+}
+
+func systemdListeners(firstFd int) (map[string][]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(firstFd+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, ls := range listeners {
+				for _, l := range ls {
+					l.Close()
+				}
+			}
+			return nil, err
+		}
+		listeners[name] = append(listeners[name], listener)
+	}
+	return listeners, nil
+}
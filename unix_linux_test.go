@@ -0,0 +1,83 @@
+package link
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/funny/utest"
+)
+
+func Test_ListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "link")
+	utest.IsNilNow(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.sock")
+
+	// Leave a stale socket file behind.
+	stale, err := net.Listen("unix", path)
+	utest.IsNilNow(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server, err := ListenUnix(path, 0600, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		session.Close()
+	}))
+	utest.IsNilNow(t, err)
+	go server.Serve()
+	info, err := os.Stat(path)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, info.Mode().Perm(), os.FileMode(0600))
+
+	_, err = ListenUnix(path, 0600, ProtocolFunc(NewTestCodec), 0, nil)
+	utest.NotNilNow(t, err)
+
+	server.Stop()
+	_, err = os.Stat(path)
+	utest.AssertNow(t, os.IsNotExist(err))
+}
+
+func Test_SystemdListeners(t *testing.T) {
+	listeners, err := SystemdListeners()
+	utest.IsNilNow(t, err)
+	utest.IsNilNow(t, listeners)
+
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer lsn.Close()
+	file, err := lsn.(*net.TCPListener).File()
+	utest.IsNilNow(t, err)
+	fd, err := syscall.Dup(int(file.Fd()))
+	utest.IsNilNow(t, err)
+	file.Close()
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "link")
+	listeners, err = systemdListeners(fd)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(listeners["link"]), 1)
+	utest.EqualNow(t, os.Getenv("LISTEN_FDS"), "")
+
+	server := NewServer(listeners["link"][0], ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		msg, err := session.Receive()
+		if err == nil {
+			session.Send(msg)
+		}
+	}))
+	go server.Serve()
+	defer server.Stop()
+
+	session, err := Dial("tcp", lsn.Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	utest.IsNilNow(t, session.Send([]byte("activated")))
+	msg, err := session.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(msg.([]byte)), "activated")
+}
@@ -0,0 +1,144 @@
+// Package websocket runs link sessions over websocket connections.
+//
+// Every Write on a connection is sent as one binary message, so a protocol
+// that writes each packet with a single Write, like codec.FixLen's Send or
+// any protocol wrapped by codec.Bufio, maps packets to messages 1:1.
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/gorilla/websocket"
+)
+
+var ErrNotBinary = errors.New("Not Binary")
+
+// Conn adapts a websocket connection to net.Conn.
+type Conn struct {
+	ws *websocket.Conn
+	r  io.Reader
+}
+
+func NewConn(ws *websocket.Conn) *Conn {
+	return &Conn{ws: ws}
+}
+
+// WebSocket returns the underlying websocket connection.
+func (c *Conn) WebSocket() *websocket.Conn {
+	return c.ws
+}
+
+// Read returns the payloads of the received binary messages back to back.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			kind, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				return 0, ErrNotBinary
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends b as one binary message.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// Dial connects to a websocket server at url, like "ws://host/path".
+func Dial(url string, protocol link.Protocol, sendChanSize int) (*link.Session, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return link.NewConnSession(NewConn(ws), protocol, sendChanSize)
+}
+
+// Handler is an http.Handler that upgrades requests to websocket and
+// hands a session for each of them to a link.Handler.
+type Handler struct {
+	Upgrader     websocket.Upgrader
+	manager      *link.Manager
+	protocol     link.Protocol
+	sendChanSize int
+	handler      link.Handler
+}
+
+func NewHandler(protocol link.Protocol, sendChanSize int, handler link.Handler) *Handler {
+	return &Handler{
+		manager:      link.NewManager(),
+		protocol:     protocol,
+		sendChanSize: sendChanSize,
+		handler:      handler,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	session, err := h.manager.NewConnSession(NewConn(ws), h.protocol, h.sendChanSize)
+	if err != nil {
+		return
+	}
+	h.handler.HandleSession(session)
+}
+
+// Manager returns the manager of the sessions created by the handler.
+func (h *Handler) Manager() *link.Manager {
+	return h.manager
+}
+
+// Stop closes all sessions created by the handler.
+func (h *Handler) Stop() {
+	h.manager.Dispose()
+}
@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"github.com/gorilla/websocket"
+)
+
+func Test_WebSocket(t *testing.T) {
+	protocol := codec.FixLen(codec.Bytes(), 2, binary.LittleEndian, 1024, 1024)
+	handler := NewHandler(protocol, 0, link.HandlerFunc(func(session *link.Session) {
+		defer session.Close()
+		for {
+			msg, err := session.Receive()
+			if err != nil || session.Send(msg) != nil {
+				return
+			}
+		}
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	defer handler.Stop()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	session, err := Dial(url, protocol, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	for _, msg := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 1000)} {
+		if err := session.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		recv, err := session.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, recv.([]byte)) {
+			t.Fatalf("message not match: %q", recv)
+		}
+	}
+
+	// Every packet travels in one binary message.
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	packet := []byte{3, 0, 'a', 'b', 'c'}
+	if err := ws.WriteMessage(websocket.BinaryMessage, packet); err != nil {
+		t.Fatal(err)
+	}
+	kind, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != websocket.BinaryMessage || !bytes.Equal(data, packet) {
+		t.Fatalf("unexpected message: %d %v", kind, data)
+	}
+}